@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"vte/internal/database"
+	"vte/internal/models"
+)
+
+// AdminTokenPrefix 管理令牌的固定前缀，用于与登录令牌和网关密钥区分
+const AdminTokenPrefix = "vte-admin-"
+
+// adminTokenLookupLength 查找令牌时使用的前缀长度（固定前缀之后再取 8 位）
+const adminTokenLookupLength = len(AdminTokenPrefix) + 8
+
+var (
+	ErrAdminTokenInvalid = errors.New("无效的管理令牌")
+	ErrAdminTokenRevoked = errors.New("管理令牌已吊销")
+	ErrAdminTokenExpired = errors.New("管理令牌已过期")
+)
+
+// AdminTokenColumns 查询管理令牌时使用的列，与 ScanAdminToken 对应
+const AdminTokenColumns = `t.id, t.user_id, COALESCE(u.username, ''), t.name, t.token_hash, t.token_prefix, COALESCE(t.permissions, ''),
+	t.expires_at, t.is_revoked, t.last_used_at, COALESCE(t.last_used_ip, ''), t.created_at`
+
+// AdminTokenFrom 与 AdminTokenColumns 配合使用的表
+const AdminTokenFrom = ` FROM admin_tokens t LEFT JOIN users u ON u.id = t.user_id`
+
+// ScanAdminToken 扫描 AdminTokenColumns 对应的一行
+func ScanAdminToken(row interface{ Scan(...interface{}) error }) (*models.AdminToken, error) {
+	var token models.AdminToken
+	var permissions string
+	var isRevoked int
+	var expiresAt, lastUsedAt sql.NullTime
+	err := row.Scan(&token.ID, &token.UserID, &token.Username, &token.Name, &token.TokenHash, &token.TokenPrefix, &permissions,
+		&expiresAt, &isRevoked, &lastUsedAt, &token.LastUsedIP, &token.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	token.Permissions = SplitList(permissions)
+	token.IsRevoked = isRevoked == 1
+	if expiresAt.Valid {
+		token.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		token.LastUsedAt = &lastUsedAt.Time
+	}
+	return &token, nil
+}
+
+// IsAdminToken 判断凭据是否为管理令牌
+func IsAdminToken(token string) bool {
+	return strings.HasPrefix(token, AdminTokenPrefix)
+}
+
+// GenerateAdminToken 生成新的管理令牌
+func GenerateAdminToken() string {
+	return AdminTokenPrefix + GenerateAPIKey()
+}
+
+func adminTokenLookup(token string) string {
+	if len(token) > adminTokenLookupLength {
+		return token[:adminTokenLookupLength]
+	}
+	return token
+}
+
+// ValidateAdminTokenPermissions 检查令牌权限，只能授予所属用户角色拥有的权限
+func ValidateAdminTokenPermissions(perms []string, owner *models.User) string {
+	if len(perms) == 0 {
+		return "至少需要一个权限"
+	}
+	for _, perm := range perms {
+		if !HasPermission(owner, perm) {
+			return fmt.Sprintf("无法授予权限: %s", perm)
+		}
+	}
+	return ""
+}
+
+// InsertAdminToken 为用户添加管理令牌（只保存前缀和哈希）
+func InsertAdminToken(userID int, token string, req *models.AdminTokenCreate) (int64, error) {
+	result, err := database.DB().Exec(`
+		INSERT INTO admin_tokens (user_id, name, token_hash, token_prefix, permissions, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, userID, req.Name, database.HashAPIKey(token), adminTokenLookup(token), JoinList(req.Permissions), FormatDBTime(req.ExpiresAt))
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// AuthenticateAdminToken 校验管理令牌：存在、未吊销、未过期、所属用户已启用且客户端 IP 通过全局规则，并记录最后使用的时间和 IP
+func AuthenticateAdminToken(token, ip string) (*models.User, *models.AdminToken, error) {
+	found, err := findAdminToken(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if found.IsRevoked {
+		return nil, nil, ErrAdminTokenRevoked
+	}
+	if found.IsExpired() {
+		return nil, nil, ErrAdminTokenExpired
+	}
+
+	user, err := GetUserByID(found.UserID)
+	if err != nil || !user.IsActive {
+		return nil, nil, ErrAdminTokenInvalid
+	}
+	if err := CheckGlobalIP(ip); err != nil {
+		return nil, nil, err
+	}
+
+	go database.DB().Exec("UPDATE admin_tokens SET last_used_at = CURRENT_TIMESTAMP, last_used_ip = ? WHERE id = ?", ip, found.ID)
+
+	return user, found, nil
+}
+
+// findAdminToken 按前缀查找候选令牌，再以常量时间比较哈希
+func findAdminToken(token string) (*models.AdminToken, error) {
+	rows, err := database.DB().Query(
+		"SELECT "+AdminTokenColumns+AdminTokenFrom+" WHERE t.token_prefix = ?", adminTokenLookup(token),
+	)
+	if err != nil {
+		return nil, ErrAdminTokenInvalid
+	}
+	defer rows.Close()
+
+	hash := []byte(database.HashAPIKey(token))
+	var found *models.AdminToken
+	for rows.Next() {
+		t, err := ScanAdminToken(rows)
+		if err != nil {
+			continue
+		}
+		if subtle.ConstantTimeCompare(hash, []byte(t.TokenHash)) == 1 && found == nil {
+			found = t
+		}
+	}
+	if found == nil {
+		return nil, ErrAdminTokenInvalid
+	}
+	return found, nil
+}
+
+// Middleware: 管理接口认证，在 JWTAuth 的基础上接受管理令牌和 admin-read 网关密钥
+// 只用于每个路由都声明了 RequirePermission 的分组，个人账号相关的接口不接受管理令牌和网关密钥
+func AdminAuth() gin.HandlerFunc {
+	jwtAuth := JWTAuth()
+	return func(c *gin.Context) {
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !IsAdminToken(token) {
+			// 不是登录令牌时尝试按 admin-read 网关密钥认证
+			if _, _, err := ParseToken(token); err != nil && adminReadKeyAuth(c, token) {
+				return
+			}
+			jwtAuth(c)
+			return
+		}
+
+		user, adminToken, err := AuthenticateAdminToken(token, c.ClientIP())
+		if err != nil {
+			status := 401
+			if errors.Is(err, ErrIPNotAllowed) {
+				status = 403
+			}
+			c.JSON(status, gin.H{"detail": err.Error()})
+			c.Abort()
+			return
+		}
+
+		c.Set("user", user)
+		c.Set("admin_token", adminToken)
+		c.Next()
+	}
+}
+
+// adminReadKeyAuth 拥有 admin-read 权限的网关密钥可以按所属用户的角色只读访问管理接口
+// 不是可用的 admin-read 密钥时返回 false，交给 JWTAuth 处理
+func adminReadKeyAuth(c *gin.Context, token string) bool {
+	if c.Request.Method != "GET" && c.Request.Method != "HEAD" {
+		return false
+	}
+	user, key, err := AuthenticateAPIKey(token)
+	if err != nil || !key.HasScope(models.ScopeAdminRead) || !IsStaff(user) {
+		return false
+	}
+	if err := CheckAPIKeyIP(key, c.ClientIP()); err != nil {
+		c.JSON(403, gin.H{"detail": err.Error()})
+		c.Abort()
+		return true
+	}
+	c.Set("user", user)
+	c.Set("api_key", key)
+	c.Next()
+	return true
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"vte/internal/database"
+	"vte/internal/models"
+)
+
+func TestAdminAuthChecksGlobalIP(t *testing.T) {
+	setupTestDB(t)
+	gin.SetMode(gin.TestMode)
+
+	result, err := database.DB().Exec("INSERT INTO users (username, hashed_password, api_key, role) VALUES ('ops', '', 'legacy', 'operator')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, _ := result.LastInsertId()
+	token := GenerateAdminToken()
+	if _, err := InsertAdminToken(int(userID), token, &models.AdminTokenCreate{
+		Name: "ci", Permissions: []string{PermViewStats},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.GET("/api/providers", AdminAuth(), func(c *gin.Context) { c.Status(200) })
+
+	tests := []struct {
+		name     string
+		ipAccess string
+		status   int
+	}{
+		{"no rules", `{"allowed_ips":[],"denied_ips":[]}`, 200},
+		{"denied", `{"allowed_ips":[],"denied_ips":["203.0.113.0/24"]}`, 403},
+		{"not in allow list", `{"allowed_ips":["10.0.0.0/8"],"denied_ips":[]}`, 403},
+		{"in allow list", `{"allowed_ips":["203.0.113.5"],"denied_ips":[]}`, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database.DB().Exec("INSERT OR REPLACE INTO settings (key, value) VALUES ('ip_access', ?)", tt.ipAccess)
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/api/providers", nil)
+			req.RemoteAddr = "203.0.113.5:40000"
+			req.Header.Set("Authorization", "Bearer "+token)
+			r.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"vte/internal/database"
+	"vte/internal/models"
+)
+
+// DefaultScopes 未指定权限范围时新密钥的默认权限
+var DefaultScopes = []string{models.ScopeChat, models.ScopeEmbeddings}
+
+// ValidScopes 所有可用的权限范围
+var ValidScopes = []string{models.ScopeChat, models.ScopeEmbeddings, models.ScopeAdminRead}
+
+var (
+	ErrAPIKeyInvalid = errors.New("无效的 API Key")
+	ErrAPIKeyRevoked = errors.New("API Key 已吊销")
+	ErrAPIKeyExpired = errors.New("API Key 已过期")
+)
+
+// GatewayKeyColumns 查询网关密钥时使用的列，与 ScanGatewayKey 对应
+const GatewayKeyColumns = `g.id, g.user_id, g.name, g.api_key, COALESCE(g.key_prefix, ''), COALESCE(g.scopes, ''),
+	g.expires_at, g.is_revoked, g.last_used_at, g.created_at,
+	COALESCE(g.allowed_models, ''), COALESCE(g.denied_models, ''), COALESCE(g.quota, ''),
+	COALESCE(g.allowed_ips, ''), COALESCE(g.denied_ips, '')`
+
+// ScanGatewayKey 扫描 GatewayKeyColumns 对应的一行
+func ScanGatewayKey(row interface{ Scan(...interface{}) error }) (*models.GatewayAPIKey, error) {
+	var key models.GatewayAPIKey
+	var scopes, allowedModels, deniedModels, quota, allowedIPs, deniedIPs string
+	var isRevoked int
+	var expiresAt, lastUsedAt sql.NullTime
+	err := row.Scan(&key.ID, &key.UserID, &key.Name, &key.KeyHash, &key.KeyPrefix, &scopes,
+		&expiresAt, &isRevoked, &lastUsedAt, &key.CreatedAt, &allowedModels, &deniedModels, &quota,
+		&allowedIPs, &deniedIPs)
+	if err != nil {
+		return nil, err
+	}
+	key.Scopes = SplitList(scopes)
+	key.AllowedModels = SplitList(allowedModels)
+	key.DeniedModels = SplitList(deniedModels)
+	key.AllowedIPs = SplitList(allowedIPs)
+	key.DeniedIPs = SplitList(deniedIPs)
+	key.Quota = ParseQuota(quota)
+	key.IsRevoked = isRevoked == 1
+	if expiresAt.Valid {
+		key.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		key.LastUsedAt = &lastUsedAt.Time
+	}
+	return &key, nil
+}
+
+// SplitList 解析逗号分隔的列表（权限范围、模型模式、IP 规则）
+func SplitList(list string) []string {
+	result := []string{}
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// FormatDBTime 将时间格式化为与 CURRENT_TIMESTAMP 一致的 UTC 字符串
+func FormatDBTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// JoinList 将列表保存为逗号分隔的字符串，去除空白和空项
+func JoinList(list []string) string {
+	return strings.Join(SplitList(strings.Join(list, ",")), ",")
+}
+
+// ParseQuota 解析 JSON 保存的配额，为空、无效或未设置任何限制时返回 nil
+func ParseQuota(raw string) *models.Quota {
+	if raw == "" {
+		return nil
+	}
+	var quota models.Quota
+	if err := json.Unmarshal([]byte(raw), &quota); err != nil || quota.IsZero() {
+		return nil
+	}
+	return &quota
+}
+
+// FormatQuota 将配额保存为 JSON，未设置任何限制时返回 nil（数据库中为 NULL）
+func FormatQuota(quota *models.Quota) interface{} {
+	if quota.IsZero() {
+		return nil
+	}
+	data, _ := json.Marshal(quota)
+	return string(data)
+}
+
+// InsertGatewayKey 为用户添加一个网关密钥（只保存前缀和哈希），opts 为 nil 时使用默认权限且不限制模型
+func InsertGatewayKey(userID int, apiKey string, opts *models.GatewayAPIKeyCreate) (int64, error) {
+	if opts == nil {
+		opts = &models.GatewayAPIKeyCreate{Name: "默认密钥"}
+	}
+	scopes := opts.Scopes
+	if len(scopes) == 0 {
+		scopes = DefaultScopes
+	}
+	result, err := database.DB().Exec(`
+		INSERT INTO gateway_api_keys (user_id, name, api_key, key_prefix, scopes, expires_at, allowed_models, denied_models, quota, allowed_ips, denied_ips)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, userID, opts.Name, database.HashAPIKey(apiKey), database.APIKeyPrefix(apiKey), strings.Join(scopes, ","), FormatDBTime(opts.ExpiresAt),
+		JoinList(opts.AllowedModels), JoinList(opts.DeniedModels), FormatQuota(opts.Quota), JoinList(opts.AllowedIPs), JoinList(opts.DeniedIPs))
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// AuthenticateAPIKey 校验网关密钥：存在、未吊销、未过期且所属用户已启用
+func AuthenticateAPIKey(apiKey string) (*models.User, *models.GatewayAPIKey, error) {
+	if apiKey == "" {
+		return nil, nil, ErrAPIKeyInvalid
+	}
+
+	db := database.DB()
+	key, err := findGatewayKey(apiKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if key.IsRevoked {
+		return nil, nil, ErrAPIKeyRevoked
+	}
+	if key.IsExpired() {
+		return nil, nil, ErrAPIKeyExpired
+	}
+
+	user, err := GetUserByID(key.UserID)
+	if err != nil || !user.IsActive {
+		return nil, nil, ErrAPIKeyInvalid
+	}
+
+	go db.Exec("UPDATE gateway_api_keys SET last_used_at = CURRENT_TIMESTAMP WHERE id = ?", key.ID)
+
+	return user, key, nil
+}
+
+// findGatewayKey 按前缀查找候选密钥，再以常量时间比较哈希
+func findGatewayKey(apiKey string) (*models.GatewayAPIKey, error) {
+	rows, err := database.DB().Query(
+		"SELECT "+GatewayKeyColumns+" FROM gateway_api_keys g WHERE g.key_prefix = ?", database.APIKeyPrefix(apiKey),
+	)
+	if err != nil {
+		return nil, ErrAPIKeyInvalid
+	}
+	defer rows.Close()
+
+	hash := []byte(database.HashAPIKey(apiKey))
+	var found *models.GatewayAPIKey
+	for rows.Next() {
+		key, err := ScanGatewayKey(rows)
+		if err != nil {
+			continue
+		}
+		if subtle.ConstantTimeCompare(hash, []byte(key.KeyHash)) == 1 && found == nil {
+			found = key
+		}
+	}
+	if found == nil {
+		return nil, ErrAPIKeyInvalid
+	}
+	return found, nil
+}
@@ -39,62 +39,108 @@ func GenerateAPIKey() string {
 	return hex.EncodeToString(b)
 }
 
-func GenerateToken(username string) (string, error) {
+// GenerateToken 生成短期有效的访问令牌，sid 指向服务端保存的会话，会话吊销后令牌立即失效
+func GenerateToken(username, sessionID string) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"sub": username,
-		"exp": time.Now().Add(7 * 24 * time.Hour).Unix(),
+		"sid": sessionID,
+		"exp": time.Now().Add(AccessTokenTTL).Unix(),
 	})
 	return token.SignedString([]byte(secretKey))
 }
 
-func ParseToken(tokenString string) (string, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte(secretKey), nil
+// ParseToken 解析访问令牌，返回用户名和会话 ID
+func ParseToken(tokenString string) (string, string, error) {
+	claims, err := parseTokenWithPurpose(tokenString, "")
+	if err != nil {
+		return "", "", err
+	}
+	sid, _ := claims["sid"].(string)
+	if sid == "" {
+		return "", "", errors.New("invalid token")
+	}
+	sub, _ := claims["sub"].(string)
+	return sub, sid, nil
+}
+
+// GenerateChallengeToken 生成两步验证的临时令牌，只能用于提交验证码，不能访问其他接口
+func GenerateChallengeToken(username string) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":     username,
+		"purpose": "2fa",
+		"exp":     time.Now().Add(5 * time.Minute).Unix(),
 	})
+	return token.SignedString([]byte(secretKey))
+}
+
+// ParseChallengeToken 解析两步验证的临时令牌
+func ParseChallengeToken(tokenString string) (string, error) {
+	claims, err := parseTokenWithPurpose(tokenString, "2fa")
 	if err != nil {
 		return "", err
 	}
+	sub, _ := claims["sub"].(string)
+	return sub, nil
+}
+
+func parseTokenWithPurpose(tokenString, purpose string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		return []byte(secretKey), nil
+	}, jwt.WithValidMethods([]string{"HS256"}))
+	if err != nil {
+		return nil, err
+	}
 
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		if sub, ok := claims["sub"].(string); ok {
-			return sub, nil
+		p, _ := claims["purpose"].(string)
+		if sub, ok := claims["sub"].(string); ok && sub != "" && p == purpose {
+			return claims, nil
 		}
 	}
-	return "", errors.New("invalid token")
+	return nil, errors.New("invalid token")
+}
+
+// AdminTwoFactorRequired 是否要求所有管理员启用两步验证
+func AdminTwoFactorRequired() bool {
+	var value string
+	database.DB().QueryRow("SELECT value FROM settings WHERE key = 'require_admin_2fa'").Scan(&value)
+	return value == "true"
 }
 
 func GetUserByUsername(username string) (*models.User, error) {
 	db := database.DB()
 	row := db.QueryRow(
-		"SELECT id, username, hashed_password, api_key, is_admin, is_active FROM users WHERE username = ?",
+		"SELECT id, username, hashed_password, api_key, is_admin, COALESCE(role, ''), is_active, COALESCE(totp_enabled, 0) FROM users WHERE username = ?",
 		username,
 	)
 
 	var user models.User
 	var isAdmin, isActive int
-	err := row.Scan(&user.ID, &user.Username, &user.HashedPassword, &user.APIKey, &isAdmin, &isActive)
+	err := row.Scan(&user.ID, &user.Username, &user.HashedPassword, &user.APIKey, &isAdmin, &user.Role, &isActive, &user.TOTPEnabled)
 	if err != nil {
 		return nil, err
 	}
 	user.IsAdmin = isAdmin == 1
+	user.Role = ResolveRole(user.IsAdmin, user.Role)
 	user.IsActive = isActive == 1
 	return &user, nil
 }
 
-func GetUserByAPIKey(apiKey string) (*models.User, error) {
+func GetUserByID(id int) (*models.User, error) {
 	db := database.DB()
 	row := db.QueryRow(
-		"SELECT id, username, hashed_password, api_key, is_admin, is_active FROM users WHERE api_key = ? AND is_active = 1",
-		apiKey,
+		"SELECT id, username, hashed_password, api_key, is_admin, COALESCE(role, ''), is_active, COALESCE(totp_enabled, 0) FROM users WHERE id = ?",
+		id,
 	)
 
 	var user models.User
 	var isAdmin, isActive int
-	err := row.Scan(&user.ID, &user.Username, &user.HashedPassword, &user.APIKey, &isAdmin, &isActive)
+	err := row.Scan(&user.ID, &user.Username, &user.HashedPassword, &user.APIKey, &isAdmin, &user.Role, &isActive, &user.TOTPEnabled)
 	if err != nil {
 		return nil, err
 	}
 	user.IsAdmin = isAdmin == 1
+	user.Role = ResolveRole(user.IsAdmin, user.Role)
 	user.IsActive = isActive == 1
 	return &user, nil
 }
@@ -110,14 +156,21 @@ func JWTAuth() gin.HandlerFunc {
 		}
 
 		token := strings.TrimPrefix(authHeader, "Bearer ")
-		username, err := ParseToken(token)
+		_, sid, err := ParseToken(token)
 		if err != nil {
 			c.JSON(401, gin.H{"detail": "无效的认证凭据"})
 			c.Abort()
 			return
 		}
 
-		user, err := GetUserByUsername(username)
+		// 按会话所属的用户 ID 查找用户，改名后旧令牌不会指向同名的其他用户
+		userID, err := ValidateSession(sid, c.ClientIP())
+		if err != nil {
+			c.JSON(401, gin.H{"detail": "登录已失效，请重新登录"})
+			c.Abort()
+			return
+		}
+		user, err := GetUserByID(userID)
 		if err != nil || !user.IsActive {
 			c.JSON(401, gin.H{"detail": "用户不存在或已禁用"})
 			c.Abort()
@@ -125,49 +178,68 @@ func JWTAuth() gin.HandlerFunc {
 		}
 
 		c.Set("user", user)
+		c.Set("session_id", sid)
 		c.Next()
 	}
 }
 
+// apiKeyHeaders 除 Authorization 外可携带 API Key 的请求头：Anthropic、Azure 和 Gemini SDK 的约定
+var apiKeyHeaders = []string{"x-api-key", "api-key", "x-goog-api-key"}
+
+// ExtractAPIKey 从请求中取出 API Key，依次检查 Authorization: Bearer、各 SDK 约定的请求头和 ?key= 查询参数
+// Authorization 使用其他认证方式（如 Basic）时忽略，继续检查后面的位置
+func ExtractAPIKey(c *gin.Context) string {
+	if scheme, token, ok := strings.Cut(strings.TrimSpace(c.GetHeader("Authorization")), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		if key := strings.TrimSpace(token); key != "" {
+			return key
+		}
+	}
+	for _, header := range apiKeyHeaders {
+		if key := strings.TrimSpace(c.GetHeader(header)); key != "" {
+			return key
+		}
+	}
+	return strings.TrimSpace(c.Query("key"))
+}
+
 // Middleware: API Key 认证（用于 OpenAI 兼容接口）
 func APIKeyAuth() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
+		apiKey := ExtractAPIKey(c)
+		if apiKey == "" {
 			c.JSON(401, gin.H{"detail": "缺少 API Key"})
 			c.Abort()
 			return
 		}
 
-		apiKey := strings.TrimPrefix(authHeader, "Bearer ")
-		user, err := GetUserByAPIKey(apiKey)
+		user, key, err := AuthenticateAPIKey(apiKey)
 		if err != nil {
-			c.JSON(401, gin.H{"detail": "无效的 API Key"})
+			c.JSON(401, gin.H{"detail": err.Error()})
+			c.Abort()
+			return
+		}
+		if err := CheckAPIKeyIP(key, c.ClientIP()); err != nil {
+			c.JSON(403, gin.H{"detail": err.Error()})
 			c.Abort()
 			return
 		}
 
 		c.Set("user", user)
+		c.Set("api_key", key)
 		c.Next()
 	}
 }
 
-// Middleware: 要求管理员权限
-func AdminRequired() gin.HandlerFunc {
+// Middleware: 要求 API Key 拥有指定权限，需在 APIKeyAuth 之后使用
+func RequireScope(scope string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		user, exists := c.Get("user")
-		if !exists {
-			c.JSON(401, gin.H{"detail": "未认证"})
-			c.Abort()
-			return
+		if key, ok := c.Get("api_key"); ok {
+			if k, ok := key.(*models.GatewayAPIKey); ok && !k.HasScope(scope) {
+				c.JSON(403, gin.H{"detail": "API Key 缺少 " + scope + " 权限"})
+				c.Abort()
+				return
+			}
 		}
-
-		if u, ok := user.(*models.User); !ok || !u.IsAdmin {
-			c.JSON(403, gin.H{"detail": "需要管理员权限"})
-			c.Abort()
-			return
-		}
-
 		c.Next()
 	}
 }
@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestExtractAPIKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		headers map[string]string
+		want    string
+	}{
+		{"bearer", "/v1/models", map[string]string{"Authorization": "Bearer sk-a"}, "sk-a"},
+		{"bearer case-insensitive", "/v1/models", map[string]string{"Authorization": "bearer  sk-a "}, "sk-a"},
+		{"bearer before x-api-key", "/v1/models", map[string]string{"Authorization": "Bearer sk-a", "x-api-key": "sk-b"}, "sk-a"},
+		{"basic falls through to x-api-key", "/v1/models", map[string]string{"Authorization": "Basic dXNlcjpwYXNz", "x-api-key": "sk-b"}, "sk-b"},
+		{"basic falls through to api-key", "/v1/models", map[string]string{"Authorization": "Basic dXNlcjpwYXNz", "api-key": "sk-c"}, "sk-c"},
+		{"bare token is ignored", "/v1/models?key=sk-d", map[string]string{"Authorization": "sk-a"}, "sk-d"},
+		{"x-goog-api-key", "/v1/models", map[string]string{"x-goog-api-key": "sk-e"}, "sk-e"},
+		{"query", "/v1/models?key=sk-d", nil, "sk-d"},
+		{"none", "/v1/models", map[string]string{"Authorization": "Basic dXNlcjpwYXNz"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", tt.url, nil)
+			for k, v := range tt.headers {
+				c.Request.Header.Set(k, v)
+			}
+			if got := ExtractAPIKey(c); got != tt.want {
+				t.Errorf("ExtractAPIKey = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"vte/internal/database"
+	"vte/internal/models"
+)
+
+var ErrIPNotAllowed = errors.New("当前 IP 不允许使用该凭据")
+
+// trustedProxies 可信的反向代理（IP 或 CIDR），与 gin 的 TrustedProxies 使用同一配置
+var trustedProxies []string
+
+// SetTrustedProxies 设置可信的反向代理
+func SetTrustedProxies(proxies []string) {
+	trustedProxies = proxies
+}
+
+// FromTrustedProxy 判断请求是否由可信的反向代理直接转发，只有这时才能采用 X-Forwarded-* 请求头
+func FromTrustedProxy(c *gin.Context) bool {
+	addr, err := netip.ParseAddr(c.RemoteIP())
+	return err == nil && matchIPRules(addr.Unmap(), trustedProxies)
+}
+
+// parseIPRule 解析单个 IP 或 CIDR，单个 IP 视为 /32 或 /128
+func parseIPRule(rule string) (netip.Prefix, error) {
+	rule = strings.TrimSpace(rule)
+	if strings.Contains(rule, "/") {
+		prefix, err := netip.ParsePrefix(rule)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if prefix.Addr().Is4In6() {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(rule)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ValidateIPRules 检查 IP 规则列表，返回第一个无效规则的提示，全部有效时返回空字符串
+func ValidateIPRules(rules []string) string {
+	for _, rule := range SplitList(strings.Join(rules, ",")) {
+		if _, err := parseIPRule(rule); err != nil {
+			return fmt.Sprintf("无效的 IP 或 CIDR: %s", rule)
+		}
+	}
+	return ""
+}
+
+// matchIPRules 判断 IP 是否匹配任意一条规则，无效的规则忽略
+func matchIPRules(addr netip.Addr, rules []string) bool {
+	for _, rule := range rules {
+		prefix, err := parseIPRule(rule)
+		if err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipAllowed 黑名单优先，白名单非空时必须匹配
+func ipAllowed(addr netip.Addr, allowed, denied []string) bool {
+	if matchIPRules(addr, denied) {
+		return false
+	}
+	return len(allowed) == 0 || matchIPRules(addr, allowed)
+}
+
+// GetIPAccess 读取全局 IP 访问控制设置
+func GetIPAccess() models.IPAccessSettings {
+	settings := models.IPAccessSettings{AllowedIPs: []string{}, DeniedIPs: []string{}}
+	var raw string
+	if err := database.DB().QueryRow("SELECT value FROM settings WHERE key = 'ip_access'").Scan(&raw); err == nil {
+		json.Unmarshal([]byte(raw), &settings)
+	}
+	return settings
+}
+
+// CheckGlobalIP 检查客户端 IP 是否通过全局规则，用于不带自身规则的管理令牌
+func CheckGlobalIP(ip string) error {
+	global := GetIPAccess()
+	return checkIPRules(ip, global.AllowedIPs, global.DeniedIPs, nil, nil)
+}
+
+// CheckAPIKeyIP 检查客户端 IP 是否允许使用网关密钥，先检查全局规则再检查密钥自身的规则
+func CheckAPIKeyIP(key *models.GatewayAPIKey, ip string) error {
+	global := GetIPAccess()
+	return checkIPRules(ip, global.AllowedIPs, global.DeniedIPs, key.AllowedIPs, key.DeniedIPs)
+}
+
+// checkIPRules 依次检查全局规则和凭据自身的规则，都为空时不解析 IP
+func checkIPRules(ip string, globalAllowed, globalDenied, allowed, denied []string) error {
+	if len(globalAllowed) == 0 && len(globalDenied) == 0 && len(allowed) == 0 && len(denied) == 0 {
+		return nil
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ErrIPNotAllowed
+	}
+	addr = addr.Unmap()
+	if !ipAllowed(addr, globalAllowed, globalDenied) || !ipAllowed(addr, allowed, denied) {
+		return ErrIPNotAllowed
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"vte/internal/database"
+	"vte/internal/models"
+)
+
+// 登录失败计数的范围
+const (
+	LoginScopeUser = "user"
+	LoginScopeIP   = "ip"
+)
+
+const (
+	loginFailureResetAfter = 24 * time.Hour // 最后一次失败超过该时间后重新计数
+	maxLoginLockout        = 24 * time.Hour
+
+	maxUserLoginsInFlight = 1 // 同一用户名同时只处理一个登录请求，避免并发请求绕过计数
+	maxIPLoginsInFlight   = 4
+)
+
+var (
+	loginInFlight   = make(map[string]int) // scope:key -> 正在处理的登录请求数
+	loginInFlightMu sync.Mutex
+
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// DefaultLoginProtection 默认的登录防暴力破解设置
+func DefaultLoginProtection() models.LoginProtectionSettings {
+	return models.LoginProtectionSettings{
+		Enabled:         true,
+		MaxUserFailures: 10,
+		MaxIPFailures:   50,
+		LockoutMinutes:  15,
+	}
+}
+
+// GetLoginProtection 读取登录防暴力破解设置，未设置时使用默认值
+func GetLoginProtection() models.LoginProtectionSettings {
+	settings := DefaultLoginProtection()
+	var raw string
+	if err := database.DB().QueryRow("SELECT value FROM settings WHERE key = 'login_protection'").Scan(&raw); err == nil {
+		json.Unmarshal([]byte(raw), &settings)
+	}
+	return settings
+}
+
+// LoginUserKey 用户名计数使用的键，忽略大小写和首尾空格
+func LoginUserKey(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// BeginLoginAttempt 登记一个正在处理的登录请求，超过并发上限时返回 false
+// 返回的函数用于在请求处理完成后释放
+func BeginLoginAttempt(username, ip string) (func(), bool) {
+	userKey := LoginScopeUser + ":" + LoginUserKey(username)
+	ipKey := LoginScopeIP + ":" + ip
+
+	loginInFlightMu.Lock()
+	defer loginInFlightMu.Unlock()
+	if loginInFlight[userKey] >= maxUserLoginsInFlight || loginInFlight[ipKey] >= maxIPLoginsInFlight {
+		return nil, false
+	}
+	loginInFlight[userKey]++
+	loginInFlight[ipKey]++
+
+	return func() {
+		loginInFlightMu.Lock()
+		defer loginInFlightMu.Unlock()
+		for _, k := range []string{userKey, ipKey} {
+			if loginInFlight[k]--; loginInFlight[k] <= 0 {
+				delete(loginInFlight, k)
+			}
+		}
+	}, true
+}
+
+// LoginThrottle 某个用户名或 IP 的连续失败记录
+type LoginThrottle struct {
+	Scope         string    `json:"scope"`
+	Key           string    `json:"key"`
+	Failures      int       `json:"failures"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+	LockedUntil   time.Time `json:"locked_until"`
+}
+
+func loadLoginThrottle(scope, key string) LoginThrottle {
+	t := LoginThrottle{Scope: scope, Key: key}
+	var last, locked sql.NullTime
+	err := database.DB().QueryRow("SELECT failures, last_failure_at, locked_until FROM login_throttle WHERE scope = ? AND key = ?", scope, key).
+		Scan(&t.Failures, &last, &locked)
+	if err != nil || !last.Valid || time.Since(last.Time) > loginFailureResetAfter {
+		return LoginThrottle{Scope: scope, Key: key}
+	}
+	t.LastFailureAt = last.Time
+	if locked.Valid {
+		t.LockedUntil = locked.Time
+	}
+	return t
+}
+
+// LoginRetryAfter 返回用户名或 IP 还需等待多久才能再次尝试登录，0 表示可以立即尝试
+func LoginRetryAfter(username, ip string) time.Duration {
+	var wait time.Duration
+	for _, t := range []LoginThrottle{
+		loadLoginThrottle(LoginScopeUser, LoginUserKey(username)),
+		loadLoginThrottle(LoginScopeIP, ip),
+	} {
+		if d := time.Until(t.LockedUntil); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// loginBackoff 计算连续失败 failures 次后的等待时间
+// 达到阈值一半后从 1 秒开始翻倍（不超过锁定时长），达到阈值后锁定，之后每次失败锁定时间翻倍
+func loginBackoff(failures, max int, lockout time.Duration) (time.Duration, bool) {
+	start := max / 2
+	if start < 1 {
+		start = 1
+	}
+
+	var base time.Duration
+	var exp int
+	switch {
+	case failures >= max:
+		base, exp = lockout, failures-max
+	case failures >= start:
+		base, exp = time.Second, failures-start
+	default:
+		return 0, false
+	}
+
+	d := base
+	for i := 0; i < exp && d < maxLoginLockout; i++ {
+		d *= 2
+	}
+	if failures < max && d > lockout {
+		d = lockout
+	}
+	if d > maxLoginLockout {
+		d = maxLoginLockout
+	}
+	return d, failures >= max
+}
+
+// RecordLoginFailure 记录一次登录失败并更新用户名和 IP 的失败计数
+// 返回用户名需要等待的时间，以及本次失败是否导致用户名或 IP 被锁定
+func RecordLoginFailure(settings models.LoginProtectionSettings, username, ip, userAgent, reason string) (time.Duration, bool) {
+	db := database.DB()
+	db.Exec("INSERT INTO login_failures (username, ip, user_agent, reason) VALUES (?, ?, ?, ?)",
+		strings.TrimSpace(username), ip, userAgent, reason)
+	if !settings.Enabled {
+		return 0, false
+	}
+
+	lockout := time.Duration(settings.LockoutMinutes) * time.Minute
+	now := time.Now().UTC()
+
+	var userWait time.Duration
+	lockedNow := false
+	for _, s := range []struct {
+		scope, key string
+		max        int
+	}{
+		{LoginScopeUser, LoginUserKey(username), settings.MaxUserFailures},
+		{LoginScopeIP, ip, settings.MaxIPFailures},
+	} {
+		t := loadLoginThrottle(s.scope, s.key)
+		t.Failures++
+		wait, locked := loginBackoff(t.Failures, s.max, lockout)
+		db.Exec(`INSERT INTO login_throttle (scope, key, failures, last_failure_at, locked_until) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(scope, key) DO UPDATE SET failures = ?, last_failure_at = ?, locked_until = ?`,
+			s.scope, s.key, t.Failures, now, now.Add(wait), t.Failures, now, now.Add(wait))
+
+		if s.scope == LoginScopeUser {
+			userWait = wait
+		}
+		if locked {
+			lockedNow = true
+		}
+	}
+	return userWait, lockedNow
+}
+
+// ClearLoginFailures 清除用户名或 IP 的失败计数和锁定
+func ClearLoginFailures(scope, key string) bool {
+	result, err := database.DB().Exec("DELETE FROM login_throttle WHERE scope = ? AND key = ?", scope, key)
+	if err != nil {
+		return false
+	}
+	n, _ := result.RowsAffected()
+	return n > 0
+}
+
+// CompareDummyPassword 用户不存在时也执行一次 bcrypt 比较，避免通过响应时间判断用户名是否存在
+func CompareDummyPassword(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"github.com/gin-gonic/gin"
+	"vte/internal/models"
+)
+
+// 管理接口的权限，每个路由在 router.Setup 中声明所需的权限
+const (
+	PermViewStats       = "view_stats"       // 查看统计、请求日志、模型、价格和提供商列表
+	PermManageModels    = "manage_models"    // 启用/禁用模型和提供商密钥
+	PermRunTests        = "run_tests"        // 测试提供商连接
+	PermManageProviders = "manage_providers" // 增删改提供商、提供商密钥和模型
+	PermManageSettings  = "manage_settings"  // 系统设置、价格，清空日志和统计
+	PermManageUsers     = "manage_users"     // 用户管理和登录安全
+	PermViewAudit       = "view_audit"       // 查看和导出审计日志
+)
+
+// rolePermissions 各角色拥有的权限
+var rolePermissions = map[string][]string{
+	models.RoleUser:     {},
+	models.RoleViewer:   {PermViewStats},
+	models.RoleOperator: {PermViewStats, PermManageModels, PermRunTests},
+	models.RoleAdmin: {PermViewStats, PermManageModels, PermRunTests, PermManageProviders,
+		PermManageSettings, PermManageUsers, PermViewAudit},
+}
+
+// ValidRole 是否为已知的角色
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// ResolveRole 根据 is_admin 和 role 列得出用户角色，管理员始终为 admin
+func ResolveRole(isAdmin bool, role string) string {
+	if isAdmin {
+		return models.RoleAdmin
+	}
+	if role == models.RoleAdmin || !ValidRole(role) {
+		return models.RoleUser
+	}
+	return role
+}
+
+// RolePermissions 返回角色拥有的权限
+func RolePermissions(role string) []string {
+	perms := rolePermissions[role]
+	if perms == nil {
+		return []string{}
+	}
+	return perms
+}
+
+// HasPermission 用户是否拥有指定权限
+func HasPermission(user *models.User, perm string) bool {
+	for _, p := range rolePermissions[ResolveRole(user.IsAdmin, user.Role)] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// IsStaff 用户是否拥有任何管理接口的权限
+func IsStaff(user *models.User) bool {
+	return len(rolePermissions[ResolveRole(user.IsAdmin, user.Role)]) > 0
+}
+
+// Middleware: 要求当前用户拥有指定权限，需在 JWTAuth 或 AdminAuth 之后使用
+// 使用管理令牌时，令牌本身也必须拥有该权限
+func RequirePermission(perm string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, exists := c.Get("user")
+		if !exists {
+			c.JSON(401, gin.H{"detail": "未认证"})
+			c.Abort()
+			return
+		}
+
+		u, ok := user.(*models.User)
+		if !ok || !HasPermission(u, perm) {
+			c.JSON(403, gin.H{"detail": "没有权限执行该操作", "permission": perm})
+			c.Abort()
+			return
+		}
+		if t, viaToken := c.Get("admin_token"); viaToken {
+			if token, ok := t.(*models.AdminToken); !ok || !token.HasPermission(perm) {
+				c.JSON(403, gin.H{"detail": "管理令牌缺少 " + perm + " 权限", "permission": perm})
+				c.Abort()
+				return
+			}
+		}
+
+		// 要求管理员启用两步验证时，未启用的管理员只能访问个人接口，通过 admin-read 密钥访问同样受限
+		if u.IsAdmin && !u.TOTPEnabled && AdminTwoFactorRequired() {
+			c.JSON(403, gin.H{"detail": "请先在仪表盘中启用两步验证", "code": "two_factor_setup_required"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
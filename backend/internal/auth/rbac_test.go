@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"vte/internal/database"
+	"vte/internal/models"
+)
+
+func TestRequirePermissionAdminTwoFactor(t *testing.T) {
+	setupTestDB(t)
+	database.DB().Exec("INSERT INTO settings (key, value) VALUES ('require_admin_2fa', 'true')")
+	gin.SetMode(gin.TestMode)
+
+	admin := &models.User{ID: 1, Username: "admin", IsAdmin: true, Role: models.RoleAdmin, IsActive: true}
+	enrolled := *admin
+	enrolled.TOTPEnabled = true
+	key := &models.GatewayAPIKey{ID: 1, UserID: 1}
+
+	tests := []struct {
+		name   string
+		user   *models.User
+		key    *models.GatewayAPIKey
+		status int
+	}{
+		{"session without 2FA", admin, nil, 403},
+		{"admin-read key without 2FA", admin, key, 403},
+		{"admin-read key with 2FA", &enrolled, key, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("GET", "/api/providers", nil)
+			c.Set("user", tt.user)
+			if tt.key != nil {
+				c.Set("api_key", tt.key)
+			}
+			RequirePermission(PermViewStats)(c)
+			if !c.IsAborted() {
+				c.Status(200)
+			}
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"vte/internal/database"
+	"vte/internal/models"
+)
+
+const (
+	AccessTokenTTL = 15 * time.Minute
+	SessionIdleTTL = 7 * 24 * time.Hour // 超过该时间未刷新的会话失效
+
+	sessionTouchInterval = 5 * time.Minute  // 最后活动时间的更新间隔，避免每个请求都写库
+	refreshReuseGrace    = 30 * time.Second // 多个标签页同时刷新时，旧刷新令牌在该时间内被拒绝但不视为盗用
+	sessionRetention     = 30 * 24 * time.Hour
+)
+
+var (
+	ErrSessionInvalid = errors.New("session is invalid")
+	ErrRefreshReused  = errors.New("refresh token reused")
+)
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashRefreshSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSession 创建登录会话，返回会话 ID 和刷新令牌（格式为 <会话ID>.<随机串>，只保存随机串的哈希）
+func CreateSession(userID int, ip, userAgent string) (string, string, error) {
+	sid, err := randomHex(16)
+	if err != nil {
+		return "", "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now().UTC()
+	_, err = database.DB().Exec(`INSERT INTO sessions (id, user_id, refresh_hash, ip, user_agent, created_at, last_seen_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		sid, userID, hashRefreshSecret(secret), ip, truncateUserAgent(userAgent), now, now, now.Add(SessionIdleTTL))
+	if err != nil {
+		return "", "", err
+	}
+	return sid, sid + "." + secret, nil
+}
+
+func truncateUserAgent(ua string) string {
+	if len(ua) > 255 {
+		return ua[:255]
+	}
+	return ua
+}
+
+// ValidateSession 检查会话未被吊销且未过期，返回会话所属的用户 ID
+func ValidateSession(sid, ip string) (int, error) {
+	db := database.DB()
+	var userID int
+	var lastSeen, expires time.Time
+	var revoked sql.NullTime
+	err := db.QueryRow("SELECT user_id, last_seen_at, expires_at, revoked_at FROM sessions WHERE id = ?", sid).
+		Scan(&userID, &lastSeen, &expires, &revoked)
+	if err != nil || revoked.Valid || time.Now().After(expires) {
+		return 0, ErrSessionInvalid
+	}
+
+	if time.Since(lastSeen) > sessionTouchInterval {
+		db.Exec("UPDATE sessions SET last_seen_at = ?, ip = ? WHERE id = ?", time.Now().UTC(), ip, sid)
+	}
+	return userID, nil
+}
+
+// RefreshSession 校验刷新令牌并轮换，返回会话所属用户 ID、会话 ID 和新的刷新令牌
+// 已轮换的旧令牌再次出现说明可能被盗用，会吊销整个会话
+func RefreshSession(refreshToken, ip, userAgent string) (int, string, string, error) {
+	sid, secret, ok := strings.Cut(refreshToken, ".")
+	if !ok || sid == "" || secret == "" {
+		return 0, "", "", ErrSessionInvalid
+	}
+
+	db := database.DB()
+	var userID int
+	var currentHash, previousHash string
+	var expires time.Time
+	var revoked, refreshedAt sql.NullTime
+	err := db.QueryRow(`SELECT user_id, refresh_hash, COALESCE(previous_refresh_hash, ''), expires_at, revoked_at, refreshed_at
+		FROM sessions WHERE id = ?`, sid).
+		Scan(&userID, &currentHash, &previousHash, &expires, &revoked, &refreshedAt)
+	if err != nil || revoked.Valid || time.Now().After(expires) {
+		return 0, "", "", ErrSessionInvalid
+	}
+
+	hash := hashRefreshSecret(secret)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(currentHash)) != 1 {
+		if previousHash != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(previousHash)) == 1 &&
+			refreshedAt.Valid && time.Since(refreshedAt.Time) > refreshReuseGrace {
+			RevokeSession(userID, sid)
+			return userID, "", "", ErrRefreshReused
+		}
+		return 0, "", "", ErrSessionInvalid
+	}
+
+	newSecret, err := randomHex(32)
+	if err != nil {
+		return 0, "", "", err
+	}
+	now := time.Now().UTC()
+	result, err := db.Exec(`UPDATE sessions SET refresh_hash = ?, previous_refresh_hash = ?, refreshed_at = ?,
+		last_seen_at = ?, expires_at = ?, ip = ?, user_agent = ? WHERE id = ? AND refresh_hash = ?`,
+		hashRefreshSecret(newSecret), currentHash, now, now, now.Add(SessionIdleTTL), ip, truncateUserAgent(userAgent), sid, currentHash)
+	if err != nil {
+		return 0, "", "", err
+	}
+	if n, _ := result.RowsAffected(); n != 1 {
+		return 0, "", "", ErrSessionInvalid
+	}
+	return userID, sid, sid + "." + newSecret, nil
+}
+
+// ListSessions 列出用户未过期且未吊销的会话
+func ListSessions(userID int) ([]models.Session, error) {
+	rows, err := database.DB().Query(`SELECT id, ip, user_agent, created_at, last_seen_at, expires_at FROM sessions
+		WHERE user_id = ? AND revoked_at IS NULL ORDER BY last_seen_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		var s models.Session
+		if err := rows.Scan(&s.ID, &s.IP, &s.UserAgent, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt); err != nil {
+			continue
+		}
+		if time.Now().After(s.ExpiresAt) {
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession 吊销用户的一个会话
+func RevokeSession(userID int, sid string) bool {
+	result, err := database.DB().Exec("UPDATE sessions SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL",
+		time.Now().UTC(), sid, userID)
+	if err != nil {
+		return false
+	}
+	n, _ := result.RowsAffected()
+	return n > 0
+}
+
+// RevokeUserSessions 吊销用户的所有会话，exceptSID 不为空时保留该会话，返回吊销的数量
+func RevokeUserSessions(userID int, exceptSID string) int {
+	result, err := database.DB().Exec("UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND id != ? AND revoked_at IS NULL",
+		time.Now().UTC(), userID, exceptSID)
+	if err != nil {
+		return 0
+	}
+	n, _ := result.RowsAffected()
+	return int(n)
+}
+
+// DeleteExpiredSessions 删除过期或吊销超过 30 天的会话记录
+func DeleteExpiredSessions() error {
+	cutoff := time.Now().UTC().Add(-sessionRetention)
+	_, err := database.DB().Exec("DELETE FROM sessions WHERE expires_at < ? OR revoked_at < ?", cutoff, cutoff)
+	return err
+}
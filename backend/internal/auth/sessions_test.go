@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"vte/internal/database"
+)
+
+// setupTestDB 使用临时数据库，测试结束后关闭
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	if err := database.Init(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(database.Close)
+}
+
+func TestDeleteExpiredSessions(t *testing.T) {
+	setupTestDB(t)
+	db := database.DB()
+
+	ids := map[string]bool{}
+	for name, keep := range map[string]bool{"active": true, "recently-expired": true, "recently-revoked": true, "expired": false, "revoked": false} {
+		sid, _, err := CreateSession(1, "127.0.0.1", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[sid] = keep
+		old := time.Now().UTC().Add(-sessionRetention - time.Hour)
+		recent := time.Now().UTC().Add(-time.Hour)
+		switch name {
+		case "recently-expired":
+			db.Exec("UPDATE sessions SET expires_at = ? WHERE id = ?", recent, sid)
+		case "recently-revoked":
+			db.Exec("UPDATE sessions SET revoked_at = ? WHERE id = ?", recent, sid)
+		case "expired":
+			db.Exec("UPDATE sessions SET expires_at = ? WHERE id = ?", old, sid)
+		case "revoked":
+			db.Exec("UPDATE sessions SET revoked_at = ? WHERE id = ?", old, sid)
+		}
+	}
+
+	if err := DeleteExpiredSessions(); err != nil {
+		t.Fatalf("DeleteExpiredSessions: %v", err)
+	}
+	for sid, keep := range ids {
+		var count int
+		db.QueryRow("SELECT COUNT(*) FROM sessions WHERE id = ?", sid).Scan(&count)
+		if (count == 1) != keep {
+			t.Errorf("session %s kept = %v, want %v", sid, count == 1, keep)
+		}
+	}
+}
@@ -5,7 +5,11 @@ import (
 	"encoding/hex"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+
+	"vte/internal/models"
 )
 
 type Config struct {
@@ -15,6 +19,31 @@ type Config struct {
 	SecretKey     string
 	AdminUsername string
 	AdminPassword string
+	MasterKey     string // 加密提供商密钥的主密钥
+	MasterKeyFile string // 主密钥文件，未设置 MasterKey 时使用
+
+	// TrustedProxies 可信的反向代理（IP 或 CIDR），只有来自这些地址的 X-Forwarded-For / X-Real-IP 才会被采用
+	TrustedProxies []string
+
+	AdminCORS  CORSPolicy // /api 管理接口，默认只允许同源访问
+	PublicCORS CORSPolicy // /v1 OpenAI 兼容接口，默认允许任意来源
+}
+
+// CORSPolicy 跨域策略，列表中的 * 表示不限；Origins 为空时不允许跨域访问，支持 https://*.example.com 形式的通配符
+type CORSPolicy struct {
+	Origins []string
+	Methods []string
+	Headers []string
+}
+
+// AllowsOrigin 判断来源是否匹配允许列表，忽略大小写和末尾的 /
+func (p CORSPolicy) AllowsOrigin(origin string) bool {
+	for _, pattern := range p.Origins {
+		if pattern == "*" || models.MatchModelPattern(strings.TrimSuffix(pattern, "/"), origin) {
+			return true
+		}
+	}
+	return false
 }
 
 func Load() *Config {
@@ -25,10 +54,51 @@ func Load() *Config {
 		SecretKey:     getEnv("SECRET_KEY", ""), // 如果为空，后续从数据库获取
 		AdminUsername: getEnv("ADMIN_USERNAME", "admin"),
 		AdminPassword: getEnv("ADMIN_PASSWORD", "admin123"),
+		MasterKey:     getEnv("MASTER_KEY", ""),
+	}
+	cfg.MasterKeyFile = getEnv("MASTER_KEY_FILE", defaultMasterKeyFile(cfg.DatabasePath))
+	cfg.TrustedProxies = getEnvList("TRUSTED_PROXIES", "127.0.0.1,::1")
+	cfg.AdminCORS = CORSPolicy{
+		Origins: getEnvList("CORS_ADMIN_ORIGINS", "none"),
+		Methods: getEnvList("CORS_ADMIN_METHODS", "GET,POST,PUT,DELETE,PATCH"),
+		Headers: getEnvList("CORS_ADMIN_HEADERS", "Authorization,Content-Type"),
+	}
+	cfg.PublicCORS = CORSPolicy{
+		Origins: getEnvList("CORS_PUBLIC_ORIGINS", "*"),
+		Methods: getEnvList("CORS_PUBLIC_METHODS", "GET,POST"),
+		Headers: getEnvList("CORS_PUBLIC_HEADERS", "*"),
 	}
 	return cfg
 }
 
+// defaultMasterKeyFile 未设置 MASTER_KEY_FILE 时的主密钥文件：数据目录旁的 keys/master.key
+// 不放在数据目录中，备份数据目录时不会把密文和主密钥一起复制；旧版本生成在数据目录中的 master.key 继续使用
+func defaultMasterKeyFile(databasePath string) string {
+	dataDir, err := filepath.Abs(filepath.Dir(databasePath))
+	if err != nil {
+		dataDir = filepath.Dir(databasePath)
+	}
+	if legacy := filepath.Join(dataDir, "master.key"); fileExists(legacy) {
+		return legacy
+	}
+	return filepath.Join(filepath.Dir(dataDir), "keys", "master.key")
+}
+
+// MasterKeyInDataDir 主密钥文件是否与数据库位于同一目录
+func (c *Config) MasterKeyInDataDir() bool {
+	if c.MasterKey != "" || c.MasterKeyFile == "" {
+		return false
+	}
+	keyDir, err1 := filepath.Abs(filepath.Dir(c.MasterKeyFile))
+	dataDir, err2 := filepath.Abs(filepath.Dir(c.DatabasePath))
+	return err1 == nil && err2 == nil && keyDir == dataDir
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
 // SetSecretKey 设置 SecretKey（用于从数据库加载后更新）
 func (c *Config) SetSecretKey(key string) {
 	c.SecretKey = key
@@ -54,6 +124,21 @@ func getEnvInt(key string, defaultVal int) int {
 	return defaultVal
 }
 
+// getEnvList 读取逗号分隔的列表，值为 none 时返回空列表
+func getEnvList(key, defaultVal string) []string {
+	val := getEnv(key, defaultVal)
+	if strings.EqualFold(strings.TrimSpace(val), "none") {
+		return nil
+	}
+	var list []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 func generateSecretKey() string {
 	b := make([]byte, 32)
 	if _, err := rand.Read(b); err != nil {
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultMasterKeyFile(t *testing.T) {
+	root := t.TempDir()
+	dataDir := filepath.Join(root, "data")
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(dataDir, "gateway.db")
+
+	want := filepath.Join(root, "keys", "master.key")
+	if got := defaultMasterKeyFile(dbPath); got != want {
+		t.Errorf("defaultMasterKeyFile = %q, want %q outside the data directory", got, want)
+	}
+	cfg := &Config{DatabasePath: dbPath, MasterKeyFile: want}
+	if cfg.MasterKeyInDataDir() {
+		t.Error("key file outside the data directory reported as inside it")
+	}
+
+	// 旧版本生成在数据目录中的主密钥继续使用，但会被标记出来
+	legacy := filepath.Join(dataDir, "master.key")
+	if err := os.WriteFile(legacy, []byte("key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := defaultMasterKeyFile(dbPath); got != legacy {
+		t.Errorf("defaultMasterKeyFile = %q, want the existing %q", got, legacy)
+	}
+	cfg.MasterKeyFile = legacy
+	if !cfg.MasterKeyInDataDir() {
+		t.Error("key file in the data directory was not reported")
+	}
+	cfg.MasterKey = "from-env"
+	if cfg.MasterKeyInDataDir() {
+		t.Error("MASTER_KEY is set, the key file is not used")
+	}
+}
@@ -2,6 +2,7 @@ package database
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"fmt"
@@ -94,7 +95,8 @@ func createTables() error {
 		`CREATE TABLE IF NOT EXISTS provider_api_keys (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			provider_id INTEGER NOT NULL,
-			api_key TEXT NOT NULL,
+			api_key TEXT NOT NULL, -- 信封加密后的密钥
+			key_hint TEXT DEFAULT '',
 			name TEXT DEFAULT '',
 			is_active INTEGER DEFAULT 1,
 			usage_count INTEGER DEFAULT 0,
@@ -114,6 +116,114 @@ func createTables() error {
 		)`,
 		`CREATE INDEX IF NOT EXISTS idx_token_usage_created_at ON token_usage(created_at)`,
 		`CREATE INDEX IF NOT EXISTS idx_token_usage_model ON token_usage(model_name)`,
+		`CREATE TABLE IF NOT EXISTS gateway_api_keys (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			api_key TEXT UNIQUE NOT NULL, -- 密钥的 SHA-256 哈希
+			key_prefix TEXT DEFAULT '',   -- 密钥的前几位，用于查找和展示
+			scopes TEXT DEFAULT 'chat,embeddings',
+			allowed_models TEXT DEFAULT '',
+			denied_models TEXT DEFAULT '',
+			allowed_ips TEXT DEFAULT '',
+			denied_ips TEXT DEFAULT '',
+			expires_at DATETIME,
+			is_revoked INTEGER DEFAULT 0,
+			last_used_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_gateway_api_keys_user ON gateway_api_keys(user_id)`,
+		`CREATE TABLE IF NOT EXISTS admin_tokens (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			token_hash TEXT UNIQUE NOT NULL, -- 令牌的 SHA-256 哈希
+			token_prefix TEXT NOT NULL,      -- 令牌的前几位，用于查找和展示
+			permissions TEXT DEFAULT '',
+			expires_at DATETIME,
+			is_revoked INTEGER DEFAULT 0,
+			last_used_at DATETIME,
+			last_used_ip TEXT DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_admin_tokens_prefix ON admin_tokens(token_prefix)`,
+		`CREATE TABLE IF NOT EXISTS credit_transactions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			type TEXT NOT NULL,
+			amount REAL NOT NULL,
+			balance REAL NOT NULL,
+			model_name TEXT DEFAULT '',
+			token_usage_id INTEGER DEFAULT 0,
+			description TEXT DEFAULT '',
+			operator TEXT DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_credit_transactions_user ON credit_transactions(user_id, created_at)`,
+		`CREATE TABLE IF NOT EXISTS sessions (
+			id TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			refresh_hash TEXT NOT NULL,
+			previous_refresh_hash TEXT DEFAULT '',
+			ip TEXT DEFAULT '',
+			user_agent TEXT DEFAULT '',
+			created_at DATETIME NOT NULL,
+			last_seen_at DATETIME NOT NULL,
+			refreshed_at DATETIME,
+			expires_at DATETIME NOT NULL,
+			revoked_at DATETIME
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id)`,
+		`CREATE TABLE IF NOT EXISTS login_throttle (
+			scope TEXT NOT NULL,
+			key TEXT NOT NULL,
+			failures INTEGER DEFAULT 0,
+			last_failure_at DATETIME,
+			locked_until DATETIME,
+			PRIMARY KEY (scope, key)
+		)`,
+		`CREATE TABLE IF NOT EXISTS login_failures (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			user_agent TEXT DEFAULT '',
+			reason TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_login_failures_created_at ON login_failures(created_at)`,
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			actor_id INTEGER DEFAULT 0,
+			actor TEXT NOT NULL,
+			ip TEXT DEFAULT '',
+			method TEXT NOT NULL,
+			path TEXT NOT NULL,
+			action TEXT NOT NULL,
+			target TEXT DEFAULT '',
+			status INTEGER DEFAULT 0,
+			changes TEXT DEFAULT '', -- 修改前后的字段差异（JSON，敏感字段已脱敏）
+			request TEXT DEFAULT '', -- 请求体（JSON，敏感字段已脱敏）
+			credential TEXT DEFAULT '', -- 使用管理令牌操作时为 admin_token:ID，登录会话为空
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_created_at ON audit_log(created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_actor ON audit_log(actor)`,
+		`CREATE TABLE IF NOT EXISTS model_prices (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			model_name TEXT UNIQUE NOT NULL,
+			input_price REAL DEFAULT 0,
+			cached_input_price REAL DEFAULT 0,
+			output_price REAL DEFAULT 0,
+			image_price REAL DEFAULT 0,
+			second_price REAL DEFAULT 0,
+			max_output_tokens INTEGER DEFAULT 0,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		// 按模型名查价格时使用：精确匹配忽略大小写，通配符模式单独建部分索引
+		`CREATE INDEX IF NOT EXISTS idx_model_prices_name_nocase ON model_prices(model_name COLLATE NOCASE)`,
+		`CREATE INDEX IF NOT EXISTS idx_model_prices_pattern ON model_prices(model_name) WHERE instr(model_name, '*') > 0`,
 	}
 
 	for _, schema := range schemas {
@@ -128,6 +238,17 @@ func createTables() error {
 	// 迁移：将 providers 表中的 api_key 迁移到 provider_api_keys 表
 	migrateProviderAPIKeys()
 
+	// 迁移：将 users 表中的 api_key 迁移到 gateway_api_keys 表
+	migrateGatewayAPIKeys()
+
+	// 迁移：将明文保存的网关密钥替换为哈希
+	migrateHashAPIKeys()
+
+	// 迁移：加密明文保存的提供商密钥
+	if err := migrateEncryptProviderKeys(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -139,6 +260,51 @@ func migrateAddMissingColumns() {
 	db.Exec("ALTER TABLE provider_api_keys ADD COLUMN last_used_at DATETIME")
 	// 检查并添加 custom_name 列（用于标记用户自定义的模型显示名称）
 	db.Exec("ALTER TABLE models ADD COLUMN custom_name INTEGER DEFAULT 0")
+	// 检查并添加 mock_config 列（mock 提供商的行为配置）
+	db.Exec("ALTER TABLE providers ADD COLUMN mock_config TEXT")
+	// 检查并添加 user_id 列（按用户统计 token 使用）
+	db.Exec("ALTER TABLE token_usage ADD COLUMN user_id INTEGER DEFAULT 0")
+	db.Exec("CREATE INDEX IF NOT EXISTS idx_token_usage_user ON token_usage(user_id, created_at)")
+	// 检查并添加 allowed_models / denied_models 列（网关密钥的模型白名单和黑名单）
+	db.Exec("ALTER TABLE gateway_api_keys ADD COLUMN allowed_models TEXT DEFAULT ''")
+	db.Exec("ALTER TABLE gateway_api_keys ADD COLUMN denied_models TEXT DEFAULT ''")
+	// 检查并添加 quota 列（用户和网关密钥的每日/每月配额，JSON）
+	db.Exec("ALTER TABLE users ADD COLUMN quota TEXT")
+	db.Exec("ALTER TABLE gateway_api_keys ADD COLUMN quota TEXT")
+	// 检查并添加 api_key_id / cost 列（按网关密钥统计用量和估算费用）
+	db.Exec("ALTER TABLE token_usage ADD COLUMN api_key_id INTEGER DEFAULT 0")
+	db.Exec("ALTER TABLE token_usage ADD COLUMN cost REAL DEFAULT 0")
+	db.Exec("CREATE INDEX IF NOT EXISTS idx_token_usage_api_key ON token_usage(api_key_id, created_at)")
+	// 检查并添加 users.credit_balance / group_name 列（余额计费）
+	db.Exec("ALTER TABLE users ADD COLUMN credit_balance REAL DEFAULT 0")
+	db.Exec("ALTER TABLE users ADD COLUMN group_name TEXT DEFAULT ''")
+	// 检查并添加 cached_tokens / image_count / duration 列（按模型价格计算费用）
+	db.Exec("ALTER TABLE token_usage ADD COLUMN cached_tokens INTEGER DEFAULT 0")
+	db.Exec("ALTER TABLE token_usage ADD COLUMN image_count INTEGER DEFAULT 0")
+	db.Exec("ALTER TABLE token_usage ADD COLUMN duration REAL DEFAULT 0")
+	// 检查并添加 key_prefix 列（网关密钥只保存前缀和哈希）
+	db.Exec("ALTER TABLE gateway_api_keys ADD COLUMN key_prefix TEXT DEFAULT ''")
+	db.Exec("CREATE INDEX IF NOT EXISTS idx_gateway_api_keys_prefix ON gateway_api_keys(key_prefix)")
+	// 检查并添加 key_hint 列（提供商密钥加密后用于界面展示的末尾字符）
+	db.Exec("ALTER TABLE provider_api_keys ADD COLUMN key_hint TEXT DEFAULT ''")
+	// 检查并添加 email / oidc_subject 列（单点登录按邮箱或 OIDC 主体匹配账户）
+	db.Exec("ALTER TABLE users ADD COLUMN email TEXT DEFAULT ''")
+	db.Exec("ALTER TABLE users ADD COLUMN oidc_subject TEXT DEFAULT ''")
+	db.Exec("CREATE INDEX IF NOT EXISTS idx_users_oidc_subject ON users(oidc_subject)")
+	// 检查并添加两步验证相关列（TOTP 密钥加密保存，恢复码只保存哈希）
+	db.Exec("ALTER TABLE users ADD COLUMN totp_secret TEXT DEFAULT ''")
+	db.Exec("ALTER TABLE users ADD COLUMN totp_enabled INTEGER DEFAULT 0")
+	db.Exec("ALTER TABLE users ADD COLUMN totp_last_step INTEGER DEFAULT 0")
+	db.Exec("ALTER TABLE users ADD COLUMN recovery_codes TEXT DEFAULT ''")
+	// 检查并添加 role 列（viewer / operator 等角色，为空时按 is_admin 决定）
+	db.Exec("ALTER TABLE users ADD COLUMN role TEXT DEFAULT ''")
+	// 检查并添加 allowed_ips / denied_ips 列（网关密钥的 IP 白名单和黑名单）
+	db.Exec("ALTER TABLE gateway_api_keys ADD COLUMN allowed_ips TEXT DEFAULT ''")
+	db.Exec("ALTER TABLE gateway_api_keys ADD COLUMN denied_ips TEXT DEFAULT ''")
+	// 检查并添加 credential 列（审计日志中记录操作使用的管理令牌）
+	db.Exec("ALTER TABLE audit_log ADD COLUMN credential TEXT DEFAULT ''")
+	// 检查并添加 max_output_tokens 列（请求未指定 max_tokens 时预扣余额使用的输出 token 数）
+	db.Exec("ALTER TABLE model_prices ADD COLUMN max_output_tokens INTEGER DEFAULT 0")
 }
 
 // migrateProviderAPIKeys 将 providers 表中的 api_key 迁移到 provider_api_keys 表
@@ -171,6 +337,106 @@ func migrateProviderAPIKeys() {
 	}
 }
 
+// migrateGatewayAPIKeys 将 users 表中的 api_key 作为「默认密钥」迁移到 gateway_api_keys 表
+// 只执行一次，避免用户删除默认密钥后重启时被重新创建
+func migrateGatewayAPIKeys() {
+	var done string
+	db.QueryRow("SELECT value FROM settings WHERE key = 'gateway_api_keys_migrated'").Scan(&done)
+	if done == "true" {
+		return
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO gateway_api_keys (user_id, name, api_key, scopes, created_at)
+		SELECT u.id, '默认密钥', u.api_key, 'chat,embeddings', u.created_at
+		FROM users u
+		WHERE u.api_key != '' AND u.api_key IS NOT NULL
+		AND NOT EXISTS (SELECT 1 FROM gateway_api_keys g WHERE g.api_key = u.api_key)
+	`)
+	if err != nil {
+		return
+	}
+	db.Exec("INSERT INTO settings (key, value) VALUES ('gateway_api_keys_migrated', 'true') ON CONFLICT(key) DO UPDATE SET value = 'true'")
+}
+
+// APIKeyPrefixLength 网关密钥用于查找和展示的前缀长度
+const APIKeyPrefixLength = 8
+
+// HashAPIKey 计算网关密钥保存在数据库中的 SHA-256 哈希
+// 密钥本身是 256 位随机数，不需要加盐或慢哈希
+func HashAPIKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeyPrefix 返回网关密钥的查找前缀
+func APIKeyPrefix(apiKey string) string {
+	if len(apiKey) > APIKeyPrefixLength {
+		return apiKey[:APIKeyPrefixLength]
+	}
+	return apiKey
+}
+
+// migrateHashAPIKeys 将 gateway_api_keys 和 users 中明文保存的密钥替换为哈希
+// 哈希与明文密钥长度相同无法区分，因此只执行一次，并在同一事务中完成
+func migrateHashAPIKeys() {
+	var done string
+	db.QueryRow("SELECT value FROM settings WHERE key = 'api_keys_hashed'").Scan(&done)
+	if done == "true" {
+		return
+	}
+
+	type plainKey struct {
+		id     int
+		apiKey string
+	}
+	load := func(query string) ([]plainKey, error) {
+		rows, err := db.Query(query)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		var keys []plainKey
+		for rows.Next() {
+			var k plainKey
+			if err := rows.Scan(&k.id, &k.apiKey); err != nil {
+				return nil, err
+			}
+			keys = append(keys, k)
+		}
+		return keys, rows.Err()
+	}
+	gatewayKeys, err := load("SELECT id, api_key FROM gateway_api_keys")
+	if err != nil {
+		return
+	}
+	userKeys, err := load("SELECT id, api_key FROM users")
+	if err != nil {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	for _, k := range gatewayKeys {
+		if _, err := tx.Exec("UPDATE gateway_api_keys SET api_key = ?, key_prefix = ? WHERE id = ?",
+			HashAPIKey(k.apiKey), APIKeyPrefix(k.apiKey), k.id); err != nil {
+			return
+		}
+	}
+	for _, k := range userKeys {
+		if _, err := tx.Exec("UPDATE users SET api_key = ? WHERE id = ?", HashAPIKey(k.apiKey), k.id); err != nil {
+			return
+		}
+	}
+	if _, err := tx.Exec("INSERT INTO settings (key, value) VALUES ('api_keys_hashed', 'true') ON CONFLICT(key) DO UPDATE SET value = 'true'"); err != nil {
+		return
+	}
+	tx.Commit()
+}
+
 // GetOrCreateSecretKey 获取或创建持久化的 SecretKey
 func GetOrCreateSecretKey() string {
 	var key string
@@ -205,10 +471,19 @@ func EnsureAdmin(username, password string) error {
 		if err != nil {
 			return err
 		}
+		// 默认密钥只保存哈希，管理员登录后在仪表盘重新生成即可获得明文
 		apiKey := generateAPIKey()
-		_, err = db.Exec(
+		result, err := db.Exec(
 			"INSERT INTO users (username, hashed_password, api_key, is_admin) VALUES (?, ?, ?, 1)",
-			username, string(hashed), apiKey,
+			username, string(hashed), HashAPIKey(apiKey),
+		)
+		if err != nil {
+			return err
+		}
+		userID, _ := result.LastInsertId()
+		_, err = db.Exec(
+			"INSERT INTO gateway_api_keys (user_id, name, api_key, key_prefix) VALUES (?, '默认密钥', ?, ?)",
+			userID, HashAPIKey(apiKey), APIKeyPrefix(apiKey),
 		)
 		return err
 	}
@@ -0,0 +1,233 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"vte/internal/secret"
+)
+
+// encryptedKeyTables 保存加密的提供商密钥的表，hint 表示是否同时维护 key_hint 列
+var encryptedKeyTables = []struct {
+	table string
+	hint  bool
+}{
+	{"providers", false},
+	{"provider_api_keys", true},
+}
+
+type storedKey struct {
+	id     int
+	apiKey string
+}
+
+func loadStoredKeys(table string) ([]storedKey, error) {
+	rows, err := db.Query("SELECT id, api_key FROM " + table + " WHERE api_key != ''")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []storedKey
+	for rows.Next() {
+		var k storedKey
+		if err := rows.Scan(&k.id, &k.apiKey); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// encryptedSecret 提供商密钥以外用主密钥加密保存的值，save 在事务中写回新的密文
+type encryptedSecret struct {
+	name  string
+	value string
+	save  func(tx *sql.Tx, value string) error
+}
+
+// loadEncryptedSecrets 读取用户的 TOTP 密钥和单点登录的 client_secret
+func loadEncryptedSecrets() ([]encryptedSecret, error) {
+	rows, err := db.Query("SELECT id, totp_secret FROM users WHERE COALESCE(totp_secret, '') != ''")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var secrets []encryptedSecret
+	for rows.Next() {
+		var id int
+		var value string
+		if err := rows.Scan(&id, &value); err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, encryptedSecret{
+			name:  fmt.Sprintf("users #%d totp_secret", id),
+			value: value,
+			save: func(tx *sql.Tx, value string) error {
+				_, err := tx.Exec("UPDATE users SET totp_secret = ? WHERE id = ?", value, id)
+				return err
+			},
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	// client_secret 保存在 oidc_config 设置的 JSON 中，只替换该字段，其余字段原样保留
+	var config string
+	db.QueryRow("SELECT value FROM settings WHERE key = 'oidc_config'").Scan(&config)
+	if config == "" {
+		return secrets, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(config), &fields); err != nil {
+		return nil, fmt.Errorf("parse oidc_config: %w", err)
+	}
+	var clientSecret string
+	json.Unmarshal(fields["client_secret"], &clientSecret)
+	if clientSecret != "" {
+		secrets = append(secrets, encryptedSecret{
+			name:  "oidc_config client_secret",
+			value: clientSecret,
+			save: func(tx *sql.Tx, value string) error {
+				fields["client_secret"], _ = json.Marshal(value)
+				data, _ := json.Marshal(fields)
+				_, err := tx.Exec("UPDATE settings SET value = ? WHERE key = 'oidc_config'", string(data))
+				return err
+			},
+		})
+	}
+	return secrets, nil
+}
+
+// migrateEncryptProviderKeys 加密明文保存的提供商密钥
+// 已加密的值（包括 TOTP 密钥和 client_secret）必须由当前主密钥加密，否则说明主密钥配置错误，拒绝启动
+func migrateEncryptProviderKeys() error {
+	keyID := secret.KeyID()
+
+	secrets, err := loadEncryptedSecrets()
+	if err != nil {
+		return err
+	}
+	for _, s := range secrets {
+		if id := secret.KeyIDOf(s.value); id != "" && id != keyID {
+			return fmt.Errorf("%s is encrypted with master key %s, but the configured master key is %s", s.name, id, keyID)
+		}
+	}
+
+	type encrypted struct {
+		table string
+		id    int
+		value string
+		hint  *string
+	}
+	var updates []encrypted
+	for _, t := range encryptedKeyTables {
+		keys, err := loadStoredKeys(t.table)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if secret.IsEncrypted(k.apiKey) {
+				if id := secret.KeyIDOf(k.apiKey); id != keyID {
+					return fmt.Errorf("%s #%d is encrypted with master key %s, but the configured master key is %s", t.table, k.id, id, keyID)
+				}
+				continue
+			}
+
+			value, err := secret.Encrypt(k.apiKey)
+			if err != nil {
+				return err
+			}
+			u := encrypted{table: t.table, id: k.id, value: value}
+			if t.hint {
+				hint := secret.Hint(k.apiKey)
+				u.hint = &hint
+			}
+			updates = append(updates, u)
+		}
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+
+	// 查询完成后再开启事务，数据库只有一个连接
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, u := range updates {
+		if u.hint != nil {
+			_, err = tx.Exec("UPDATE "+u.table+" SET api_key = ?, key_hint = ? WHERE id = ?", u.value, *u.hint, u.id)
+		} else {
+			_, err = tx.Exec("UPDATE "+u.table+" SET api_key = ? WHERE id = ?", u.value, u.id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RotateMasterKey 用新主密钥重新加密所有提供商密钥、TOTP 密钥和 client_secret，返回处理的数量
+// 所有值在同一事务中更新，任何一个解密失败都不会修改数据库
+func RotateMasterKey(oldKey, newKey *secret.Keyring) (int, error) {
+	type rotated struct {
+		table string
+		id    int
+		value string
+	}
+	var updates []rotated
+	for _, t := range encryptedKeyTables {
+		keys, err := loadStoredKeys(t.table)
+		if err != nil {
+			return 0, err
+		}
+		for _, k := range keys {
+			plaintext, err := oldKey.Decrypt(k.apiKey)
+			if err != nil {
+				return 0, fmt.Errorf("decrypt %s #%d: %w", t.table, k.id, err)
+			}
+			encrypted, err := newKey.Encrypt(plaintext)
+			if err != nil {
+				return 0, err
+			}
+			updates = append(updates, rotated{t.table, k.id, encrypted})
+		}
+	}
+
+	secrets, err := loadEncryptedSecrets()
+	if err != nil {
+		return 0, err
+	}
+	for i, s := range secrets {
+		plaintext, err := oldKey.Decrypt(s.value)
+		if err != nil {
+			return 0, fmt.Errorf("decrypt %s: %w", s.name, err)
+		}
+		if secrets[i].value, err = newKey.Encrypt(plaintext); err != nil {
+			return 0, err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for _, u := range updates {
+		if _, err := tx.Exec("UPDATE "+u.table+" SET api_key = ? WHERE id = ?", u.value, u.id); err != nil {
+			return 0, err
+		}
+	}
+	for _, s := range secrets {
+		if err := s.save(tx, s.value); err != nil {
+			return 0, err
+		}
+	}
+	return len(updates) + len(secrets), tx.Commit()
+}
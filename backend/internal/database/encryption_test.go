@@ -0,0 +1,142 @@
+package database
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"vte/internal/secret"
+)
+
+func newKeyring(t *testing.T) (string, *secret.Keyring) {
+	t.Helper()
+	masterKey, err := secret.GenerateMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := secret.NewKeyring(masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return masterKey, k
+}
+
+// setupEncryptedDB 用 oldKey 初始化数据库，写入提供商密钥、TOTP 密钥和 client_secret
+func setupEncryptedDB(t *testing.T, oldMasterKey string, oldKey *secret.Keyring) {
+	t.Helper()
+	if err := secret.Init(oldMasterKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := Init(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(Close)
+
+	encrypt := func(plaintext string) string {
+		value, err := oldKey.Encrypt(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+	mustExec(t, "INSERT INTO providers (name, base_url, api_key) VALUES ('p', 'http://upstream', ?)", encrypt("sk-provider"))
+	mustExec(t, "INSERT INTO users (username, hashed_password, api_key, totp_secret) VALUES ('alice', '', 'k1', ?)", encrypt("TOTPALICE"))
+	mustExec(t, "INSERT INTO users (username, hashed_password, api_key, totp_secret) VALUES ('bob', '', 'k2', '')")
+	config, _ := json.Marshal(map[string]interface{}{
+		"enabled": true, "issuer": "https://idp.example.com", "client_id": "vte", "client_secret": encrypt("oidc-secret"),
+	})
+	mustExec(t, "INSERT INTO settings (key, value) VALUES ('oidc_config', ?)", string(config))
+}
+
+func mustExec(t *testing.T, query string, args ...interface{}) {
+	t.Helper()
+	if _, err := db.Exec(query, args...); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+}
+
+// storedSecrets 返回数据库中的提供商密钥、TOTP 密钥和 oidc_config
+func storedSecrets(t *testing.T) (providerKey, totpSecret string, oidc map[string]interface{}) {
+	t.Helper()
+	var config string
+	db.QueryRow("SELECT api_key FROM providers WHERE name = 'p'").Scan(&providerKey)
+	db.QueryRow("SELECT totp_secret FROM users WHERE username = 'alice'").Scan(&totpSecret)
+	db.QueryRow("SELECT value FROM settings WHERE key = 'oidc_config'").Scan(&config)
+	if err := json.Unmarshal([]byte(config), &oidc); err != nil {
+		t.Fatalf("parse oidc_config: %v", err)
+	}
+	return
+}
+
+func TestRotateMasterKeyReencryptsAllSecrets(t *testing.T) {
+	oldMasterKey, oldKey := newKeyring(t)
+	newMasterKey, newKey := newKeyring(t)
+	setupEncryptedDB(t, oldMasterKey, oldKey)
+
+	count, err := RotateMasterKey(oldKey, newKey)
+	if err != nil {
+		t.Fatalf("RotateMasterKey: %v", err)
+	}
+	if count != 3 {
+		t.Errorf("rotated %d values, want 3", count)
+	}
+
+	providerKey, totpSecret, oidc := storedSecrets(t)
+	clientSecret, _ := oidc["client_secret"].(string)
+	for value, want := range map[string]string{providerKey: "sk-provider", totpSecret: "TOTPALICE", clientSecret: "oidc-secret"} {
+		if secret.KeyIDOf(value) != newKey.ID() {
+			t.Errorf("%q is not encrypted with the new master key", value)
+			continue
+		}
+		if got, err := newKey.Decrypt(value); err != nil || got != want {
+			t.Errorf("Decrypt = %q, %v, want %q", got, err, want)
+		}
+	}
+	if oidc["issuer"] != "https://idp.example.com" || oidc["client_id"] != "vte" || oidc["enabled"] != true {
+		t.Errorf("other oidc_config fields changed: %v", oidc)
+	}
+
+	// 未切换主密钥时启动检查应拒绝，切换后通过
+	if err := migrateEncryptProviderKeys(); err == nil {
+		t.Error("startup check passed with the old master key")
+	}
+	secret.Init(newMasterKey)
+	if err := migrateEncryptProviderKeys(); err != nil {
+		t.Errorf("startup check with the new master key: %v", err)
+	}
+}
+
+func TestRotateMasterKeyIsAtomic(t *testing.T) {
+	oldMasterKey, oldKey := newKeyring(t)
+	_, newKey := newKeyring(t)
+	_, otherKey := newKeyring(t)
+	setupEncryptedDB(t, oldMasterKey, oldKey)
+
+	// client_secret 由其他主密钥加密，无法解密时不应修改任何值
+	bad, _ := otherKey.Encrypt("oidc-secret")
+	config, _ := json.Marshal(map[string]interface{}{"client_secret": bad})
+	mustExec(t, "UPDATE settings SET value = ? WHERE key = 'oidc_config'", string(config))
+
+	if _, err := RotateMasterKey(oldKey, newKey); err == nil || !strings.Contains(err.Error(), "client_secret") {
+		t.Fatalf("RotateMasterKey error = %v, want a client_secret decrypt error", err)
+	}
+	providerKey, totpSecret, _ := storedSecrets(t)
+	if secret.KeyIDOf(providerKey) != oldKey.ID() || secret.KeyIDOf(totpSecret) != oldKey.ID() {
+		t.Error("failed rotation modified stored secrets")
+	}
+}
+
+func TestStartupCheckRejectsForeignTOTPSecret(t *testing.T) {
+	oldMasterKey, oldKey := newKeyring(t)
+	_, otherKey := newKeyring(t)
+	setupEncryptedDB(t, oldMasterKey, oldKey)
+
+	foreign, _ := otherKey.Encrypt("TOTPBOB")
+	mustExec(t, "UPDATE users SET totp_secret = ? WHERE username = 'bob'", foreign)
+
+	err := migrateEncryptProviderKeys()
+	if err == nil || !strings.Contains(err.Error(), "totp_secret") {
+		t.Errorf("startup check error = %v, want a totp_secret master key mismatch", err)
+	}
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"vte/internal/auth"
+	"vte/internal/database"
+	"vte/internal/logger"
+	"vte/internal/models"
+)
+
+// ListAdminTokens 列出当前用户的管理令牌，管理员可以看到所有用户的令牌
+func ListAdminTokens(c *gin.Context) {
+	user := c.MustGet("user").(*models.User)
+	query := "SELECT " + auth.AdminTokenColumns + auth.AdminTokenFrom
+	args := []interface{}{}
+	if !user.IsAdmin {
+		query += " WHERE t.user_id = ?"
+		args = append(args, user.ID)
+	}
+	rows, err := database.DB().Query(query+" ORDER BY t.id", args...)
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "查询失败"})
+		return
+	}
+	defer rows.Close()
+
+	tokens := []*models.AdminToken{}
+	for rows.Next() {
+		token, err := auth.ScanAdminToken(rows)
+		if err != nil {
+			continue
+		}
+		tokens = append(tokens, token)
+	}
+	c.JSON(200, tokens)
+}
+
+// CreateAdminToken 为当前用户创建管理令牌，权限不能超出当前用户的角色
+// 只能在登录会话中创建，网关密钥和管理令牌都不能用来创建新的令牌
+func CreateAdminToken(c *gin.Context) {
+	user := c.MustGet("user").(*models.User)
+	if _, ok := c.Get("session_id"); !ok {
+		c.JSON(403, gin.H{"detail": "请登录后创建管理令牌"})
+		return
+	}
+	if !auth.IsStaff(user) {
+		c.JSON(403, gin.H{"detail": "只有管理角色可以创建管理令牌"})
+		return
+	}
+
+	var req models.AdminTokenCreate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"detail": "无效的请求"})
+		return
+	}
+	req.Permissions = auth.SplitList(auth.JoinList(req.Permissions))
+	if msg := auth.ValidateAdminTokenPermissions(req.Permissions, user); msg != "" {
+		c.JSON(400, gin.H{"detail": msg})
+		return
+	}
+
+	plain := auth.GenerateAdminToken()
+	id, err := auth.InsertAdminToken(user.ID, plain, &req)
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "创建失败"})
+		return
+	}
+
+	logger.Info(fmt.Sprintf("%s | 创建管理令牌 | %s | %s", c.ClientIP(), user.Username, req.Name))
+
+	token, err := auth.ScanAdminToken(database.DB().QueryRow(
+		"SELECT "+auth.AdminTokenColumns+auth.AdminTokenFrom+" WHERE t.id = ?", id,
+	))
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "创建失败"})
+		return
+	}
+	// 明文令牌只在创建时返回这一次
+	token.Token = plain
+	c.JSON(200, token)
+}
+
+// RevokeAdminToken 吊销管理令牌，吊销后立即失效但保留记录
+func RevokeAdminToken(c *gin.Context) {
+	token, ok := loadAdminToken(c)
+	if !ok {
+		return
+	}
+
+	if _, err := database.DB().Exec("UPDATE admin_tokens SET is_revoked = 1 WHERE id = ?", token.ID); err != nil {
+		c.JSON(500, gin.H{"detail": "吊销失败"})
+		return
+	}
+
+	logger.Info(fmt.Sprintf("%s | 吊销管理令牌 | %s | %s", c.ClientIP(), token.Username, token.Name))
+	c.JSON(200, gin.H{"message": "已吊销"})
+}
+
+// DeleteAdminToken 删除管理令牌
+func DeleteAdminToken(c *gin.Context) {
+	token, ok := loadAdminToken(c)
+	if !ok {
+		return
+	}
+
+	if _, err := database.DB().Exec("DELETE FROM admin_tokens WHERE id = ?", token.ID); err != nil {
+		c.JSON(500, gin.H{"detail": "删除失败"})
+		return
+	}
+
+	logger.Info(fmt.Sprintf("%s | 删除管理令牌 | %s | %s", c.ClientIP(), token.Username, token.Name))
+	c.JSON(200, gin.H{"message": "删除成功"})
+}
+
+// loadAdminToken 读取路径参数 id 对应的令牌，仅令牌所有者或管理员可操作
+func loadAdminToken(c *gin.Context) (*models.AdminToken, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"detail": "无效的令牌ID"})
+		return nil, false
+	}
+
+	token, err := auth.ScanAdminToken(database.DB().QueryRow(
+		"SELECT "+auth.AdminTokenColumns+auth.AdminTokenFrom+" WHERE t.id = ?", id,
+	))
+	user := c.MustGet("user").(*models.User)
+	if err != nil || (token.UserID != user.ID && !user.IsAdmin) {
+		c.JSON(404, gin.H{"detail": "令牌不存在"})
+		return nil, false
+	}
+	return token, true
+}
@@ -10,6 +10,7 @@ import (
 	"vte/internal/database"
 	"vte/internal/logger"
 	"vte/internal/models"
+	"vte/internal/secret"
 )
 
 // 轮询计数器，用于实现 Round-Robin
@@ -18,7 +19,7 @@ var (
 	keyIndexMu  sync.Mutex
 )
 
-// GetNextAPIKey 获取下一个可用的 API Key（轮询）
+// GetNextAPIKey 获取下一个可用的 API Key（轮询），返回的是加密后的值
 func GetNextAPIKey(providerID int) (string, int, error) {
 	db := database.DB()
 
@@ -111,7 +112,7 @@ func ListAPIKeys(c *gin.Context) {
 
 	// 获取所有密钥
 	rows, err := db.Query(`
-		SELECT id, provider_id, api_key, name, is_active, usage_count, last_used_at, created_at
+		SELECT id, provider_id, COALESCE(key_hint, ''), name, is_active, usage_count, last_used_at, created_at
 		FROM provider_api_keys
 		WHERE provider_id = ?
 		ORDER BY id
@@ -128,15 +129,13 @@ func ListAPIKeys(c *gin.Context) {
 		var k models.ProviderAPIKey
 		var isActive int
 		var lastUsedAt *time.Time
-		var apiKey string
-		err := rows.Scan(&k.ID, &k.ProviderID, &apiKey, &k.Name, &isActive, &k.UsageCount, &lastUsedAt, &k.CreatedAt)
+		err := rows.Scan(&k.ID, &k.ProviderID, &k.KeyHint, &k.Name, &isActive, &k.UsageCount, &lastUsedAt, &k.CreatedAt)
 		if err != nil {
 			logger.Error(fmt.Sprintf("ListAPIKeys: 扫描行失败: %v", err))
 			continue
 		}
 		k.IsActive = isActive == 1
 		k.LastUsedAt = lastUsedAt
-		k.APIKey = apiKey
 		keys = append(keys, k)
 	}
 
@@ -176,10 +175,16 @@ func AddAPIKey(c *gin.Context) {
 		name = fmt.Sprintf("密钥 %d", count+1)
 	}
 
+	encryptedKey, err := secret.Encrypt(req.APIKey)
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "加密密钥失败"})
+		return
+	}
+
 	result, err := db.Exec(`
-		INSERT INTO provider_api_keys (provider_id, api_key, name)
-		VALUES (?, ?, ?)
-	`, providerID, req.APIKey, name)
+		INSERT INTO provider_api_keys (provider_id, api_key, key_hint, name)
+		VALUES (?, ?, ?, ?)
+	`, providerID, encryptedKey, secret.Hint(req.APIKey), name)
 	if err != nil {
 		c.JSON(500, gin.H{"detail": "添加失败"})
 		return
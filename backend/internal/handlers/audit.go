@@ -0,0 +1,544 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"vte/internal/database"
+	"vte/internal/logger"
+	"vte/internal/models"
+)
+
+const (
+	auditRedacted       = "[REDACTED]"
+	auditMaxRequestSize = 16 * 1024
+	auditMaxBodySize    = 1 << 20
+	auditMaxExportRows  = 10000
+)
+
+// auditResource 路由对应的数据表，用于记录修改前后的差异
+// param 为空表示创建操作，记录 ID 从响应中读取
+type auditResource struct {
+	prefix string
+	name   string
+	table  string
+	param  string
+}
+
+// auditResources 按顺序匹配请求路由，前缀越具体越靠前
+var auditResources = []auditResource{
+	{"/api/providers/:id/api-keys/:keyId", "provider_api_key", "provider_api_keys", "keyId"},
+	{"/api/providers/:id/api-keys", "provider_api_key", "provider_api_keys", ""},
+	{"/api/providers/:id", "provider", "providers", "id"},
+	{"/api/providers", "provider", "providers", ""},
+	{"/api/users/:id/keys", "gateway_key", "gateway_api_keys", ""},
+	{"/api/users/:id", "user", "users", "id"},
+	{"/api/users", "user", "users", ""},
+	{"/api/keys/:keyId", "gateway_key", "gateway_api_keys", "keyId"},
+	{"/api/keys", "gateway_key", "gateway_api_keys", ""},
+	{"/api/admin-tokens/:id", "admin_token", "admin_tokens", "id"},
+	{"/api/admin-tokens", "admin_token", "admin_tokens", ""},
+	{"/api/models/:id", "model", "models", "id"},
+	{"/api/pricing/:id", "model_price", "model_prices", "id"},
+	{"/api/pricing", "model_price", "model_prices", ""},
+	{"/api/settings", "settings", "settings", ""},
+}
+
+// auditSensitiveKeys 需要脱敏的字段名
+var auditSensitiveKeys = map[string]bool{
+	"password":              true,
+	"hashed_password":       true,
+	"api_key":               true,
+	"key":                   true,
+	"secret":                true,
+	"totp_secret":           true,
+	"recovery_codes":        true,
+	"refresh_hash":          true,
+	"token_hash":            true,
+	"previous_refresh_hash": true,
+	"token":                 true,
+	"code":                  true,
+	"authorization":         true,
+	"master_key":            true,
+}
+
+func isAuditSensitiveKey(key string) bool {
+	k := strings.ToLower(key)
+	if auditSensitiveKeys[k] {
+		return true
+	}
+	for _, suffix := range []string{"_secret", "_password", "_token", "_key", "-key", "-token"} {
+		if strings.HasSuffix(k, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactAudit 递归替换敏感字段的值
+func redactAudit(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			if isAuditSensitiveKey(k) && item != nil && item != "" {
+				out[k] = auditRedacted
+			} else {
+				out[k] = redactAudit(item)
+			}
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			out[i] = redactAudit(item)
+		}
+		return out
+	case string:
+		// 以字符串保存的 JSON（如 extra_headers）也需要脱敏
+		decoded := decodeAuditValue(val)
+		if _, ok := decoded.(string); !ok {
+			return redactAudit(decoded)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// decodeAuditValue 把数据库中的值转换为可比较的形式，JSON 文本会被解析以便脱敏其中的字段
+func decodeAuditValue(v interface{}) interface{} {
+	if b, ok := v.([]byte); ok {
+		v = string(b)
+	}
+	if s, ok := v.(string); ok {
+		trimmed := strings.TrimSpace(s)
+		if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+			var parsed interface{}
+			if json.Unmarshal([]byte(trimmed), &parsed) == nil {
+				return parsed
+			}
+		}
+	}
+	return v
+}
+
+// auditSnapshot 读取资源的当前状态，不存在时返回 nil
+func auditSnapshot(res *auditResource, id string) map[string]interface{} {
+	db := database.DB()
+	if res.table == "settings" {
+		rows, err := db.Query("SELECT key, value FROM settings")
+		if err != nil {
+			return nil
+		}
+		defer rows.Close()
+		snapshot := map[string]interface{}{}
+		for rows.Next() {
+			var k, v string
+			if rows.Scan(&k, &v) == nil {
+				snapshot[k] = decodeAuditValue(v)
+			}
+		}
+		return snapshot
+	}
+
+	if id == "" {
+		return nil
+	}
+	rows, err := db.Query("SELECT * FROM "+res.table+" WHERE id = ?", id)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil
+	}
+	values := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	if rows.Scan(ptrs...) != nil {
+		return nil
+	}
+	snapshot := make(map[string]interface{}, len(columns))
+	for i, col := range columns {
+		snapshot[col] = decodeAuditValue(values[i])
+	}
+	return snapshot
+}
+
+// auditDiff 对比修改前后的字段，返回 {字段: {before, after}}，敏感字段只记录是否变化
+func auditDiff(before, after map[string]interface{}) map[string]interface{} {
+	diff := map[string]interface{}{}
+	keys := map[string]bool{}
+	for k := range before {
+		keys[k] = true
+	}
+	for k := range after {
+		keys[k] = true
+	}
+	for k := range keys {
+		b, a := before[k], after[k]
+		if reflect.DeepEqual(b, a) || (isAuditEmpty(b) && isAuditEmpty(a)) {
+			continue
+		}
+		if isAuditSensitiveKey(k) {
+			if b != nil && b != "" {
+				b = auditRedacted
+			}
+			if a != nil && a != "" {
+				a = auditRedacted
+			}
+		} else {
+			b, a = redactAudit(b), redactAudit(a)
+		}
+		diff[k] = gin.H{"before": b, "after": a}
+	}
+	return diff
+}
+
+func isAuditEmpty(v interface{}) bool {
+	return v == nil || v == ""
+}
+
+// auditRequestBody 返回脱敏后的请求体，非 JSON 请求体不记录
+func auditRequestBody(body []byte) string {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return ""
+	}
+	var parsed interface{}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return ""
+	}
+	data, _ := json.Marshal(redactAudit(parsed))
+	if len(data) > auditMaxRequestSize {
+		return string(data[:auditMaxRequestSize]) + "...(truncated)"
+	}
+	return string(data)
+}
+
+func matchAuditResource(fullPath string) *auditResource {
+	for i := range auditResources {
+		res := &auditResources[i]
+		if strings.HasPrefix(fullPath, res.prefix) &&
+			(len(fullPath) == len(res.prefix) || fullPath[len(res.prefix)] == '/') {
+			return res
+		}
+	}
+	return nil
+}
+
+// auditBody 读取时先返回已缓存的部分，关闭时关闭原始请求体
+type auditBody struct {
+	io.Reader
+	io.Closer
+}
+
+// auditResponseWriter 缓存响应体，用于从创建接口的响应中读取新记录的 ID
+type auditResponseWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if w.body.Len() < 64*1024 {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *auditResponseWriter) WriteString(s string) (int, error) {
+	if w.body.Len() < 64*1024 {
+		w.body.WriteString(s)
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+func responseID(body []byte) string {
+	var resp struct {
+		ID json.Number `json:"id"`
+	}
+	if json.Unmarshal(body, &resp) != nil {
+		return ""
+	}
+	return resp.ID.String()
+}
+
+// AuditLog 记录管理接口的修改操作：操作者、IP、路由、目标对象以及修改前后的差异
+// 需放在认证中间件之后，GET 请求不记录
+func AuditLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case "GET", "HEAD", "OPTIONS":
+			c.Next()
+			return
+		}
+
+		// 最多读取 auditMaxBodySize 字节用于记录，超出时不记录请求体，已读部分拼回原始请求体交给后续处理
+		var body []byte
+		if c.Request.Body != nil {
+			body, _ = io.ReadAll(io.LimitReader(c.Request.Body, auditMaxBodySize+1))
+			c.Request.Body = auditBody{io.MultiReader(bytes.NewReader(body), c.Request.Body), c.Request.Body}
+			if len(body) > auditMaxBodySize {
+				body = nil
+			}
+		}
+
+		res := matchAuditResource(c.FullPath())
+		var id string
+		var before map[string]interface{}
+		var writer *auditResponseWriter
+		if res != nil {
+			if res.param != "" {
+				id = c.Param(res.param)
+			}
+			before = auditSnapshot(res, id)
+			if res.param == "" && res.table != "settings" {
+				writer = &auditResponseWriter{ResponseWriter: c.Writer}
+				c.Writer = writer
+			}
+		}
+
+		c.Next()
+
+		status := c.Writer.Status()
+		target := ""
+		changes := ""
+		if res != nil {
+			if writer != nil && status < 400 {
+				id = responseID(writer.body.Bytes())
+			}
+			switch {
+			case res.table == "settings":
+				target = "settings"
+			case id != "":
+				target = res.name + ":" + id
+			}
+			if status < 400 && (id != "" || res.table == "settings") {
+				if diff := auditDiff(before, auditSnapshot(res, id)); len(diff) > 0 {
+					data, _ := json.Marshal(diff)
+					changes = string(data)
+				}
+			}
+		}
+
+		var actorID int
+		actor := ""
+		if u, ok := c.Get("user"); ok {
+			if user, ok := u.(*models.User); ok {
+				actorID, actor = user.ID, user.Username
+			}
+		}
+		if target == "" && actorID != 0 && strings.HasPrefix(c.FullPath(), "/api/auth/") {
+			// 账户自助操作的目标为会话或当前用户
+			if sid := c.Param("sid"); sid != "" {
+				target = "session:" + sid
+			} else {
+				target = "user:" + strconv.Itoa(actorID)
+			}
+		}
+		credential := ""
+		if t, ok := c.Get("admin_token"); ok {
+			if token, ok := t.(*models.AdminToken); ok {
+				credential = "admin_token:" + strconv.Itoa(token.ID)
+			}
+		}
+
+		_, err := database.DB().Exec(`INSERT INTO audit_log (actor_id, actor, ip, method, path, action, target, status, changes, request, credential)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			actorID, actor, c.ClientIP(), c.Request.Method, c.Request.URL.Path, c.Request.Method+" "+c.FullPath(),
+			target, status, changes, auditRequestBody(body), credential)
+		if err != nil {
+			logger.Error(fmt.Sprintf("写入审计日志失败: %v", err))
+		}
+	}
+}
+
+// auditQuery 根据查询参数构造过滤条件
+func auditQuery(c *gin.Context) (string, []interface{}, bool) {
+	where := "1 = 1"
+	var args []interface{}
+	if actor := strings.TrimSpace(c.Query("actor")); actor != "" {
+		where += " AND actor = ?"
+		args = append(args, actor)
+	}
+	if action := strings.TrimSpace(c.Query("action")); action != "" {
+		where += " AND action LIKE ?"
+		args = append(args, "%"+action+"%")
+	}
+	if target := strings.TrimSpace(c.Query("target")); target != "" {
+		where += " AND target LIKE ?"
+		args = append(args, target+"%")
+	}
+	if ip := strings.TrimSpace(c.Query("ip")); ip != "" {
+		where += " AND ip = ?"
+		args = append(args, ip)
+	}
+	if s := c.Query("start"); s != "" {
+		t, err := time.ParseInLocation("2006-01-02", s, beijingLoc)
+		if err != nil {
+			c.JSON(400, gin.H{"detail": "无效的开始日期"})
+			return "", nil, false
+		}
+		where += " AND created_at >= ?"
+		args = append(args, t.UTC().Format("2006-01-02 15:04:05"))
+	}
+	if e := c.Query("end"); e != "" {
+		t, err := time.ParseInLocation("2006-01-02", e, beijingLoc)
+		if err != nil {
+			c.JSON(400, gin.H{"detail": "无效的结束日期"})
+			return "", nil, false
+		}
+		where += " AND created_at < ?"
+		args = append(args, t.AddDate(0, 0, 1).UTC().Format("2006-01-02 15:04:05"))
+	}
+	return where, args, true
+}
+
+type auditEntry struct {
+	ID         int             `json:"id"`
+	ActorID    int             `json:"actor_id"`
+	Actor      string          `json:"actor"`
+	IP         string          `json:"ip"`
+	Method     string          `json:"method"`
+	Path       string          `json:"path"`
+	Action     string          `json:"action"`
+	Target     string          `json:"target"`
+	Status     int             `json:"status"`
+	Changes    json.RawMessage `json:"changes"`
+	Request    json.RawMessage `json:"request"`
+	Credential string          `json:"credential"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+func queryAuditEntries(where string, args []interface{}, limit, offset int) ([]auditEntry, error) {
+	rows, err := database.DB().Query(`SELECT id, actor_id, actor, ip, method, path, action, target, status, changes, request,
+		COALESCE(credential, ''), created_at
+		FROM audit_log WHERE `+where+` ORDER BY id DESC LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []auditEntry{}
+	for rows.Next() {
+		var e auditEntry
+		var changes, request string
+		if err := rows.Scan(&e.ID, &e.ActorID, &e.Actor, &e.IP, &e.Method, &e.Path, &e.Action, &e.Target, &e.Status,
+			&changes, &request, &e.Credential, &e.CreatedAt); err != nil {
+			continue
+		}
+		e.Changes = auditJSON(changes)
+		e.Request = auditJSON(request)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// auditJSON 把保存的 JSON 文本转换为响应中的原始 JSON，被截断的请求体作为字符串返回
+func auditJSON(s string) json.RawMessage {
+	if s == "" {
+		return json.RawMessage("null")
+	}
+	if json.Valid([]byte(s)) {
+		return json.RawMessage(s)
+	}
+	data, _ := json.Marshal(s)
+	return data
+}
+
+// ListAuditLog 分页查询审计日志，可按操作者、操作、目标、IP 和日期过滤
+func ListAuditLog(c *gin.Context) {
+	where, args, ok := auditQuery(c)
+	if !ok {
+		return
+	}
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "50"))
+	if pageSize < 1 || pageSize > 200 {
+		pageSize = 50
+	}
+
+	var total int
+	database.DB().QueryRow("SELECT COUNT(*) FROM audit_log WHERE "+where, args...).Scan(&total)
+
+	items, err := queryAuditEntries(where, args, pageSize, (page-1)*pageSize)
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "查询失败"})
+		return
+	}
+	c.JSON(200, gin.H{"total": total, "items": items})
+}
+
+// ExportAuditLog 按相同的过滤条件导出审计日志，支持 csv 和 json 格式
+func ExportAuditLog(c *gin.Context) {
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "json" {
+		c.JSON(400, gin.H{"detail": "format 只能是 csv 或 json"})
+		return
+	}
+	where, args, ok := auditQuery(c)
+	if !ok {
+		return
+	}
+
+	items, err := queryAuditEntries(where, args, auditMaxExportRows, 0)
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "查询失败"})
+		return
+	}
+
+	operator := c.MustGet("user").(*models.User)
+	logger.Info(fmt.Sprintf("%s | 导出审计日志 | %d 条 | 操作者: %s", c.ClientIP(), len(items), operator.Username))
+
+	filename := fmt.Sprintf("audit-%s.%s", GetBeijingTime().Format("20060102-150405"), format)
+	c.Header("Content-Disposition", "attachment; filename="+filename)
+	if format == "json" {
+		c.JSON(200, items)
+		return
+	}
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(200)
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"id", "created_at", "actor", "credential", "ip", "action", "path", "target", "status", "changes", "request"})
+	for _, e := range items {
+		w.Write([]string{
+			strconv.Itoa(e.ID),
+			e.CreatedAt.In(beijingLoc).Format("2006-01-02 15:04:05"),
+			e.Actor,
+			e.Credential,
+			e.IP,
+			e.Action,
+			e.Path,
+			e.Target,
+			strconv.Itoa(e.Status),
+			auditCSVValue(e.Changes),
+			auditCSVValue(e.Request),
+		})
+	}
+	w.Flush()
+}
+
+func auditCSVValue(raw json.RawMessage) string {
+	if string(raw) == "null" {
+		return ""
+	}
+	return string(raw)
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"vte/internal/database"
+	"vte/internal/models"
+)
+
+// auditRouter 注册一个经过审计中间件的路由，handler 读取完整请求体
+func auditRouter(user *models.User, path string, received *int) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST(path, func(c *gin.Context) { c.Set("user", user) }, AuditLog(), func(c *gin.Context) {
+		data, _ := io.ReadAll(c.Request.Body)
+		*received = len(data)
+		c.JSON(200, gin.H{"message": "ok"})
+	})
+	return r
+}
+
+func lastAuditEntry(t *testing.T, actorID int) (target, request string) {
+	t.Helper()
+	err := database.DB().QueryRow("SELECT target, request FROM audit_log WHERE actor_id = ? ORDER BY id DESC LIMIT 1", actorID).
+		Scan(&target, &request)
+	if err != nil {
+		t.Fatalf("audit entry not found: %v", err)
+	}
+	return
+}
+
+func TestAuditLogAccountRoutes(t *testing.T) {
+	user := &models.User{ID: 9001, Username: "audit-user"}
+	var received int
+	r := auditRouter(user, "/api/auth/change-password", &received)
+
+	body := `{"old_password":"old-secret","new_password":"new-secret"}`
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/auth/change-password", strings.NewReader(body)))
+	if received != len(body) {
+		t.Errorf("handler read %d bytes, want %d", received, len(body))
+	}
+	target, request := lastAuditEntry(t, user.ID)
+	if target != "user:"+strconv.Itoa(user.ID) {
+		t.Errorf("target = %q, want user:%d", target, user.ID)
+	}
+	if strings.Contains(request, "secret") || !strings.Contains(request, auditRedacted) {
+		t.Errorf("passwords were not redacted: %s", request)
+	}
+
+	r = auditRouter(user, "/api/auth/2fa/disable", &received)
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/auth/2fa/disable", strings.NewReader(`{"code":"123456"}`)))
+	if _, request := lastAuditEntry(t, user.ID); strings.Contains(request, "123456") {
+		t.Errorf("2FA code was not redacted: %s", request)
+	}
+}
+
+func TestAuditLogLargeBody(t *testing.T) {
+	user := &models.User{ID: 9002, Username: "audit-large"}
+	var received int
+	r := auditRouter(user, "/api/auth/change-username", &received)
+
+	body := `{"new_username":"` + strings.Repeat("a", auditMaxBodySize) + `"}`
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/auth/change-username", strings.NewReader(body)))
+	if received != len(body) {
+		t.Errorf("handler read %d bytes, want the full %d byte body", received, len(body))
+	}
+	if _, request := lastAuditEntry(t, user.ID); request != "" {
+		t.Errorf("oversized body was recorded (%d bytes)", len(request))
+	}
+}
@@ -17,8 +17,22 @@ func Login(c *gin.Context) {
 		return
 	}
 
+	release, ok := beginLoginAttempt(c, req.Username)
+	if !ok {
+		return
+	}
+	defer release()
+
 	user, err := auth.GetUserByUsername(req.Username)
+	if err != nil {
+		auth.CompareDummyPassword(req.Password)
+	}
 	if err != nil || !auth.CheckPassword(req.Password, user.HashedPassword) {
+		reason := "wrong_password"
+		if err != nil {
+			reason = "unknown_user"
+		}
+		recordLoginFailure(c, req.Username, reason)
 		logger.Warn(fmt.Sprintf("%s | 登录失败 | %s", c.ClientIP(), req.Username))
 		c.JSON(401, gin.H{"detail": "用户名或密码错误"})
 		return
@@ -30,27 +44,51 @@ func Login(c *gin.Context) {
 		return
 	}
 
-	token, err := auth.GenerateToken(user.Username)
+	// 启用两步验证的用户先返回临时令牌，提交验证码后再签发登录令牌
+	// 失败计数在验证码通过后才清除，否则知道密码即可无限次尝试验证码
+	if user.TOTPEnabled {
+		challenge, err := auth.GenerateChallengeToken(user.Username)
+		if err != nil {
+			c.JSON(500, gin.H{"detail": "生成令牌失败"})
+			return
+		}
+		c.JSON(200, models.TwoFactorChallenge{TwoFactorRequired: true, ChallengeToken: challenge})
+		return
+	}
+
+	tokens, err := issueSession(c, user)
 	if err != nil {
 		c.JSON(500, gin.H{"detail": "生成令牌失败"})
 		return
 	}
 
+	auth.ClearLoginFailures(auth.LoginScopeUser, auth.LoginUserKey(user.Username))
 	logger.Info(fmt.Sprintf("%s | 登录成功 | %s", c.ClientIP(), req.Username))
-	c.JSON(200, models.TokenResponse{
-		AccessToken: token,
-		TokenType:   "bearer",
-	})
+	c.JSON(200, tokens)
 }
 
+// GetMe 返回当前用户信息及剩余配额
 func GetMe(c *gin.Context) {
 	user := c.MustGet("user").(*models.User)
-	c.JSON(200, gin.H{
+	result := gin.H{
 		"id":       user.ID,
 		"username": user.Username,
-		"api_key":  user.APIKey,
 		"is_admin": user.IsAdmin,
-	})
+		"role":     user.Role,
+		"quota":    getQuotaStatus(loadUserQuota(user.ID), "user_id", user.ID),
+
+		"permissions": auth.RolePermissions(user.Role),
+
+		"totp_enabled":              user.TOTPEnabled,
+		"two_factor_setup_required": user.IsAdmin && !user.TOTPEnabled && auth.AdminTwoFactorRequired(),
+	}
+	var balance float64
+	var group string
+	database.DB().QueryRow("SELECT COALESCE(credit_balance, 0), COALESCE(group_name, '') FROM users WHERE id = ?", user.ID).
+		Scan(&balance, &group)
+	result["credit_balance"] = balance
+	result["group"] = group
+	c.JSON(200, result)
 }
 
 func ChangePassword(c *gin.Context) {
@@ -81,6 +119,8 @@ func ChangePassword(c *gin.Context) {
 		return
 	}
 
+	// 其他设备上的会话全部失效，当前会话保留
+	auth.RevokeUserSessions(user.ID, currentSessionID(c))
 	logger.Info(fmt.Sprintf("%s | 修改密码 | %s", c.ClientIP(), user.Username))
 	c.JSON(200, gin.H{"message": "密码修改成功"})
 }
@@ -109,6 +149,7 @@ func ChangeUsername(c *gin.Context) {
 		c.JSON(500, gin.H{"detail": "更新失败"})
 		return
 	}
+	auth.RevokeUserSessions(user.ID, currentSessionID(c))
 
 	logger.Info(fmt.Sprintf("%s | 修改用户名 | %s -> %s", c.ClientIP(), oldUsername, req.NewUsername))
 	c.JSON(200, gin.H{"message": "用户名修改成功"})
@@ -116,10 +157,8 @@ func ChangeUsername(c *gin.Context) {
 
 func RegenerateAPIKey(c *gin.Context) {
 	user := c.MustGet("user").(*models.User)
-	db := database.DB()
 
-	newKey := auth.GenerateAPIKey()
-	_, err := db.Exec("UPDATE users SET api_key = ? WHERE id = ?", newKey, user.ID)
+	newKey, err := replaceDefaultKey(user.ID)
 	if err != nil {
 		c.JSON(500, gin.H{"detail": "更新失败"})
 		return
@@ -0,0 +1,387 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"vte/internal/database"
+	"vte/internal/logger"
+	"vte/internal/models"
+)
+
+// defaultCreditMaxTokens 请求和模型价格都未指定输出上限时预扣的输出 token 数
+const defaultCreditMaxTokens = 4096
+
+// creditHold 一次请求预扣的余额，记录用量时按实际费用结算，请求失败时退还
+type creditHold struct {
+	amount     float64 // 预扣金额（已乘倍率）
+	multiplier float64 // 用户所在分组的费用倍率
+	settled    bool
+}
+
+// getCreditSettings 获取余额计费设置
+func getCreditSettings() models.CreditSettings {
+	db := database.DB()
+	var enabled, multipliers, maxTokens string
+	db.QueryRow("SELECT value FROM settings WHERE key = 'credit_billing_enabled'").Scan(&enabled)
+	db.QueryRow("SELECT value FROM settings WHERE key = 'credit_group_multipliers'").Scan(&multipliers)
+	db.QueryRow("SELECT value FROM settings WHERE key = 'credit_default_max_tokens'").Scan(&maxTokens)
+
+	settings := models.CreditSettings{Enabled: enabled == "true", GroupMultipliers: map[string]float64{}, DefaultMaxTokens: defaultCreditMaxTokens}
+	if multipliers != "" {
+		json.Unmarshal([]byte(multipliers), &settings.GroupMultipliers)
+	}
+	if n, err := strconv.Atoi(maxTokens); err == nil && n > 0 {
+		settings.DefaultMaxTokens = n
+	}
+	return settings
+}
+
+// userCreditMultiplier 获取用户所在分组的费用倍率，未分组或未配置的分组为 1
+func userCreditMultiplier(userID int, settings models.CreditSettings) float64 {
+	var group string
+	database.DB().QueryRow("SELECT COALESCE(group_name, '') FROM users WHERE id = ?", userID).Scan(&group)
+	if m, ok := settings.GroupMultipliers[group]; ok && group != "" && m > 0 {
+		return m
+	}
+	return 1
+}
+
+// loadCreditBalance 获取用户当前余额
+func loadCreditBalance(userID int) float64 {
+	var balance float64
+	database.DB().QueryRow("SELECT COALESCE(credit_balance, 0) FROM users WHERE id = ?", userID).Scan(&balance)
+	return balance
+}
+
+// applyCreditTransaction 在同一事务中变动余额并写入流水，成功后回填 t.ID 和 t.Balance
+// requireBalance 为 true 时，余额变动后会小于 0 则不执行并返回 false
+func applyCreditTransaction(t *models.CreditTransaction, requireBalance bool) (bool, error) {
+	tx, err := database.DB().Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	query := "UPDATE users SET credit_balance = COALESCE(credit_balance, 0) + ? WHERE id = ?"
+	args := []interface{}{t.Amount, t.UserID}
+	if requireBalance {
+		query += " AND COALESCE(credit_balance, 0) + ? >= 0"
+		args = append(args, t.Amount)
+	}
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	if err := tx.QueryRow("SELECT credit_balance FROM users WHERE id = ?", t.UserID).Scan(&t.Balance); err != nil {
+		return false, err
+	}
+
+	result, err = tx.Exec(`
+		INSERT INTO credit_transactions (user_id, type, amount, balance, model_name, token_usage_id, description, operator)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, t.UserID, t.Type, t.Amount, t.Balance, t.ModelName, t.TokenUsageID, t.Description, t.Operator)
+	if err != nil {
+		return false, err
+	}
+	id, _ := result.LastInsertId()
+	t.ID = int(id)
+	return true, tx.Commit()
+}
+
+// creditStage 启用余额计费时，按预估费用预扣余额，余额不足时拒绝请求
+// 预估费用 = 输入 token + 输出上限按模型价格计算，再乘以用户分组倍率
+func creditStage(req *chatRequest) *chatError {
+	settings := getCreditSettings()
+	if !settings.Enabled {
+		return nil
+	}
+
+	multiplier := userCreditMultiplier(req.User.ID, settings)
+	estimate := calculateCost(&models.TokenUsage{
+		ModelName:        req.DisplayName,
+		PromptTokens:     countPromptTokens(req),
+		CompletionTokens: creditMaxTokens(req, settings),
+		ImageCount:       countImages(req.Payload),
+	}) * multiplier
+
+	hold := &creditHold{multiplier: multiplier}
+	if estimate > 0 {
+		t := &models.CreditTransaction{
+			UserID:      req.User.ID,
+			Type:        models.CreditTypeDeduct,
+			Amount:      -estimate,
+			ModelName:   req.DisplayName,
+			Description: "预扣请求费用",
+		}
+		ok, err := applyCreditTransaction(t, true)
+		if err != nil {
+			logger.Error(fmt.Sprintf("%s | 预扣余额失败: %v", req.logPrefix(), err))
+			return &chatError{
+				Status:  500,
+				Body:    gin.H{"error": gin.H{"message": "扣费失败", "type": "server_error", "code": "credit_error"}},
+				Message: "扣费失败",
+				Reason:  "预扣余额失败",
+			}
+		}
+		if !ok {
+			return insufficientCreditError(loadCreditBalance(req.User.ID), estimate)
+		}
+		hold.amount = estimate
+		req.setHeader("X-Credit-Balance", strconv.FormatFloat(t.Balance, 'f', 4, 64))
+	} else if balance := loadCreditBalance(req.User.ID); balance < 0 {
+		return insufficientCreditError(balance, 0)
+	}
+
+	req.credit = hold
+	req.onFinish(func() { refundCreditHold(req) })
+	return nil
+}
+
+// insufficientCreditError 余额不足的错误响应
+func insufficientCreditError(balance, estimate float64) *chatError {
+	errMsg := fmt.Sprintf("余额不足：当前余额 $%.4f，本次请求预计费用 $%.4f", balance, estimate)
+	return &chatError{
+		Status: 402,
+		Body: gin.H{
+			"error": gin.H{
+				"message": errMsg,
+				"type":    "insufficient_quota",
+				"code":    "insufficient_balance",
+			},
+		},
+		Reason: "余额不足",
+	}
+}
+
+// requestedMaxTokens 读取请求中的 max_tokens / max_completion_tokens
+func requestedMaxTokens(payload map[string]interface{}) int {
+	for _, key := range []string{"max_completion_tokens", "max_tokens"} {
+		if v, ok := payload[key].(float64); ok && v > 0 {
+			return int(v)
+		}
+	}
+	return 0
+}
+
+// creditMaxTokens 预扣时计入的输出 token 数：请求的 max_tokens，未指定时使用模型价格中的输出上限，都没有时使用默认值
+// 只按输入预扣时长输出会使余额大幅透支
+func creditMaxTokens(req *chatRequest, settings models.CreditSettings) int {
+	if n := requestedMaxTokens(req.Payload); n > 0 {
+		return n
+	}
+	if n := findModelPrice(req.DisplayName).MaxOutputTokens; n > 0 {
+		return n
+	}
+	return settings.DefaultMaxTokens
+}
+
+// settleCredit 按实际费用结算预扣的余额：多退少补，实际费用超出余额时允许余额变为负数
+func settleCredit(req *chatRequest, usage *models.TokenUsage) {
+	hold := req.credit
+	if hold == nil || hold.settled {
+		return
+	}
+	hold.settled = true
+
+	diff := hold.amount - usage.Cost*hold.multiplier
+	if math.Abs(diff) < 1e-12 {
+		return
+	}
+	t := &models.CreditTransaction{
+		UserID:       req.User.ID,
+		Type:         models.CreditTypeDeduct,
+		Amount:       diff,
+		ModelName:    req.DisplayName,
+		TokenUsageID: usage.ID,
+		Description:  "按实际用量补扣",
+	}
+	if hold.amount == 0 {
+		t.Description = "请求扣费"
+	} else if diff > 0 {
+		t.Type = models.CreditTypeRefund
+		t.Description = "退还多预扣的费用"
+	}
+	if _, err := applyCreditTransaction(t, false); err != nil {
+		logger.Error(fmt.Sprintf("%s | 结算余额失败: %v", req.logPrefix(), err))
+	}
+}
+
+// refundCreditHold 请求未产生用量（失败或被拦截）时退还预扣的余额
+// 流式响应中途断开时已按部分用量结算，不会走到这里
+func refundCreditHold(req *chatRequest) {
+	hold := req.credit
+	if hold == nil || hold.settled || hold.amount == 0 {
+		return
+	}
+	hold.settled = true
+
+	t := &models.CreditTransaction{
+		UserID:      req.User.ID,
+		Type:        models.CreditTypeRefund,
+		Amount:      hold.amount,
+		ModelName:   req.DisplayName,
+		Description: "请求失败，退还预扣费用",
+	}
+	if _, err := applyCreditTransaction(t, false); err != nil {
+		logger.Error(fmt.Sprintf("%s | 退还余额失败: %v", req.logPrefix(), err))
+	}
+}
+
+// AdjustUserCredit 管理员为用户充值或扣减余额
+func AdjustUserCredit(c *gin.Context) {
+	target, ok := loadTargetUser(c)
+	if !ok {
+		return
+	}
+
+	var req models.CreditTopUpRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Amount == 0 || math.IsNaN(req.Amount) || math.IsInf(req.Amount, 0) {
+		c.JSON(400, gin.H{"detail": "无效的金额"})
+		return
+	}
+
+	operator := c.MustGet("user").(*models.User)
+	t := &models.CreditTransaction{
+		UserID:      target.ID,
+		Type:        models.CreditTypeTopUp,
+		Amount:      req.Amount,
+		Description: strings.TrimSpace(req.Description),
+		Operator:    operator.Username,
+	}
+	if req.Amount < 0 {
+		t.Type = models.CreditTypeAdjust
+	}
+	if t.Description == "" {
+		t.Description = "管理员充值"
+		if req.Amount < 0 {
+			t.Description = "管理员扣减"
+		}
+	}
+	if _, err := applyCreditTransaction(t, false); err != nil {
+		c.JSON(500, gin.H{"detail": "更新失败"})
+		return
+	}
+
+	logger.Info(fmt.Sprintf("%s | 调整余额 | %s | %+.4f | 余额: %.4f | 操作者: %s",
+		c.ClientIP(), target.Username, req.Amount, t.Balance, operator.Username))
+	c.JSON(200, gin.H{"message": "余额已更新", "balance": t.Balance})
+}
+
+// ListUserCreditTransactions 管理员查看用户的余额流水
+func ListUserCreditTransactions(c *gin.Context) {
+	target, ok := loadTargetUser(c)
+	if !ok {
+		return
+	}
+	writeCreditTransactions(c, target.ID)
+}
+
+// GetMyCredits 获取当前用户的余额和流水
+func GetMyCredits(c *gin.Context) {
+	user := c.MustGet("user").(*models.User)
+	writeCreditTransactions(c, user.ID)
+}
+
+// writeCreditTransactions 分页返回用户的余额和流水（按时间倒序），支持 limit / offset / type 参数
+func writeCreditTransactions(c *gin.Context, userID int) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	offset, _ := strconv.Atoi(c.Query("offset"))
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	where := "user_id = ?"
+	args := []interface{}{userID}
+	if txType := c.Query("type"); txType != "" {
+		where += " AND type = ?"
+		args = append(args, txType)
+	}
+
+	db := database.DB()
+	var total int
+	db.QueryRow("SELECT COUNT(*) FROM credit_transactions WHERE "+where, args...).Scan(&total)
+
+	rows, err := db.Query(`
+		SELECT id, user_id, type, amount, balance, COALESCE(model_name, ''), COALESCE(token_usage_id, 0),
+			COALESCE(description, ''), COALESCE(operator, ''), created_at
+		FROM credit_transactions
+		WHERE `+where+`
+		ORDER BY id DESC
+		LIMIT ? OFFSET ?
+	`, append(args, limit, offset)...)
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "查询失败"})
+		return
+	}
+	defer rows.Close()
+
+	transactions := []models.CreditTransaction{}
+	for rows.Next() {
+		var t models.CreditTransaction
+		rows.Scan(&t.ID, &t.UserID, &t.Type, &t.Amount, &t.Balance, &t.ModelName, &t.TokenUsageID,
+			&t.Description, &t.Operator, &t.CreatedAt)
+		transactions = append(transactions, t)
+	}
+
+	c.JSON(200, gin.H{
+		"balance":      loadCreditBalance(userID),
+		"total":        total,
+		"transactions": transactions,
+	})
+}
+
+// GetCreditSettings 获取余额计费设置
+func GetCreditSettings(c *gin.Context) {
+	c.JSON(200, getCreditSettings())
+}
+
+// SetCreditSettings 设置余额计费开关和分组费用倍率
+func SetCreditSettings(c *gin.Context) {
+	var req models.CreditSettings
+	if err := c.ShouldBindJSON(&req); err != nil || req.DefaultMaxTokens < 0 {
+		c.JSON(400, gin.H{"detail": "无效的请求"})
+		return
+	}
+	if req.DefaultMaxTokens == 0 {
+		req.DefaultMaxTokens = defaultCreditMaxTokens
+	}
+
+	multipliers := map[string]float64{}
+	for group, m := range req.GroupMultipliers {
+		group = strings.TrimSpace(group)
+		if group == "" || m <= 0 {
+			c.JSON(400, gin.H{"detail": "分组名称不能为空，倍率必须大于 0"})
+			return
+		}
+		multipliers[group] = m
+	}
+	multipliersJSON, _ := json.Marshal(multipliers)
+
+	db := database.DB()
+	enabled := "false"
+	if req.Enabled {
+		enabled = "true"
+	}
+	db.Exec(`INSERT INTO settings (key, value) VALUES ('credit_billing_enabled', ?) ON CONFLICT(key) DO UPDATE SET value = ?`, enabled, enabled)
+	db.Exec(`INSERT INTO settings (key, value) VALUES ('credit_group_multipliers', ?) ON CONFLICT(key) DO UPDATE SET value = ?`, string(multipliersJSON), string(multipliersJSON))
+	maxTokens := strconv.Itoa(req.DefaultMaxTokens)
+	db.Exec(`INSERT INTO settings (key, value) VALUES ('credit_default_max_tokens', ?) ON CONFLICT(key) DO UPDATE SET value = ?`, maxTokens, maxTokens)
+
+	status := "关闭"
+	if req.Enabled {
+		status = "开启"
+	}
+	logger.Info(fmt.Sprintf("%s | 余额计费: %s | 分组倍率: %s", c.ClientIP(), status, multipliersJSON))
+	c.JSON(200, gin.H{"message": "设置已更新"})
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"vte/internal/database"
+	"vte/internal/proxy"
+)
+
+// setupCreditTest 开启余额计费，创建有余额的用户和指定输出上限的模型价格
+func setupCreditTest(t *testing.T, balance float64, maxOutputTokens int) (userID int, model string) {
+	t.Helper()
+	db := database.DB()
+	db.Exec("INSERT INTO settings (key, value) VALUES ('credit_billing_enabled', 'true') ON CONFLICT(key) DO UPDATE SET value = 'true'")
+	t.Cleanup(func() { db.Exec("DELETE FROM settings WHERE key = 'credit_billing_enabled'") })
+
+	name := strings.ReplaceAll(t.Name(), "/", "-")
+	result, err := db.Exec("INSERT INTO users (username, hashed_password, api_key, credit_balance) VALUES (?, '', ?, ?)",
+		name, "key-"+name, balance)
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	id, _ := result.LastInsertId()
+
+	// 每个输出 token $0.001，便于区分预扣的输出 token 数
+	model = "credit-" + name
+	if _, err := db.Exec("INSERT INTO model_prices (model_name, input_price, output_price, max_output_tokens) VALUES (?, 1, 1000, ?)",
+		model, maxOutputTokens); err != nil {
+		t.Fatalf("create price: %v", err)
+	}
+	return int(id), model
+}
+
+func newCreditChatRequest(userID int, model string, mock *proxy.MockConfig, upstreamStream bool) *chatRequest {
+	req := newTestChatRequest(mock, upstreamStream, upstreamStream, false)
+	req.User.ID = userID
+	req.DisplayName = model
+	return req
+}
+
+func TestCreditHoldWithoutMaxTokens(t *testing.T) {
+	tests := []struct {
+		name            string
+		maxOutputTokens int
+		maxTokens       float64
+		want            int
+	}{
+		{"default", 0, 0, defaultCreditMaxTokens},
+		{"model", 200, 0, 200},
+		{"request", 200, 50, 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userID, model := setupCreditTest(t, 100, tt.maxOutputTokens)
+			req := newCreditChatRequest(userID, model, nil, false)
+			if tt.maxTokens > 0 {
+				req.Payload["max_tokens"] = tt.maxTokens
+			}
+			if e := creditStage(req); e != nil {
+				t.Fatalf("creditStage: %v", e.Message)
+			}
+
+			prompt := float64(countPromptTokens(req)) / 1e6
+			want := prompt + float64(tt.want)*0.001
+			if math.Abs(req.credit.amount-want) > 1e-9 {
+				t.Errorf("hold = %.6f, want %.6f (%d output tokens)", req.credit.amount, want, tt.want)
+			}
+			if balance := loadCreditBalance(userID); math.Abs(balance-(100-want)) > 1e-9 {
+				t.Errorf("balance after hold = %.6f, want %.6f", balance, 100-want)
+			}
+
+			req.finish()
+			if balance := loadCreditBalance(userID); math.Abs(balance-100) > 1e-9 {
+				t.Errorf("balance after refund = %.6f, want 100", balance)
+			}
+		})
+	}
+}
+
+func TestCreditSettlesPartialUsageOnDisconnect(t *testing.T) {
+	userID, model := setupCreditTest(t, 100, 0)
+	mock := &proxy.MockConfig{Mode: "fixed", Text: strings.Repeat("billed output ", 500)}
+	req := newCreditChatRequest(userID, model, mock, true)
+	if e := creditStage(req); e != nil {
+		t.Fatalf("creditStage: %v", e.Message)
+	}
+	hold := req.credit.amount
+
+	dispatch(req, &recordResponder{maxLines: 10})
+	req.finish()
+
+	var requests int
+	var cost float64
+	database.DB().QueryRow("SELECT COUNT(*), COALESCE(SUM(cost), 0) FROM token_usage WHERE user_id = ?", userID).Scan(&requests, &cost)
+	if requests != 1 || cost <= 0 || cost >= hold {
+		t.Fatalf("recorded %d requests costing $%.6f, want the partial cost below the $%.6f hold", requests, cost, hold)
+	}
+	if balance := loadCreditBalance(userID); math.Abs(balance-(100-cost)) > 1e-9 {
+		t.Errorf("balance = %.6f, want %.6f: charge the partial usage and refund the rest", balance, 100-cost)
+	}
+
+	var refunds int
+	database.DB().QueryRow("SELECT COUNT(*) FROM credit_transactions WHERE user_id = ? AND description = ?",
+		userID, "请求失败，退还预扣费用").Scan(&refunds)
+	if refunds != 0 {
+		t.Errorf("interrupted request was refunded in full %d times", refunds)
+	}
+}
@@ -0,0 +1,267 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"vte/internal/auth"
+	"vte/internal/database"
+	"vte/internal/logger"
+	"vte/internal/models"
+)
+
+// ListGatewayKeys 列出当前用户的网关密钥
+func ListGatewayKeys(c *gin.Context) {
+	user := c.MustGet("user").(*models.User)
+	writeGatewayKeys(c, user.ID)
+}
+
+// ListUserGatewayKeys 管理员查看指定用户的网关密钥
+func ListUserGatewayKeys(c *gin.Context) {
+	target, ok := loadTargetUser(c)
+	if !ok {
+		return
+	}
+	writeGatewayKeys(c, target.ID)
+}
+
+func writeGatewayKeys(c *gin.Context, userID int) {
+	rows, err := database.DB().Query(
+		"SELECT "+auth.GatewayKeyColumns+" FROM gateway_api_keys g WHERE g.user_id = ? ORDER BY g.id", userID,
+	)
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "查询失败"})
+		return
+	}
+	defer rows.Close()
+
+	keys := []*models.GatewayAPIKey{}
+	for rows.Next() {
+		key, err := auth.ScanGatewayKey(rows)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	c.JSON(200, keys)
+}
+
+// CreateGatewayKey 为当前用户创建网关密钥
+func CreateGatewayKey(c *gin.Context) {
+	user := c.MustGet("user").(*models.User)
+	createGatewayKey(c, user)
+}
+
+// CreateUserGatewayKey 管理员为指定用户创建网关密钥
+func CreateUserGatewayKey(c *gin.Context) {
+	target, ok := loadTargetUser(c)
+	if !ok {
+		return
+	}
+	createGatewayKey(c, target)
+}
+
+func createGatewayKey(c *gin.Context, owner *models.User) {
+	var req models.GatewayAPIKeyCreate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"detail": "无效的请求"})
+		return
+	}
+	if msg := validateScopes(req.Scopes, owner); msg != "" {
+		c.JSON(400, gin.H{"detail": msg})
+		return
+	}
+	if msg := validateKeyIPRules(req.AllowedIPs, req.DeniedIPs); msg != "" {
+		c.JSON(400, gin.H{"detail": msg})
+		return
+	}
+
+	apiKey := auth.GenerateAPIKey()
+	id, err := auth.InsertGatewayKey(owner.ID, apiKey, &req)
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "创建失败"})
+		return
+	}
+
+	logger.Info(fmt.Sprintf("%s | 创建网关密钥 | %s | %s", c.ClientIP(), owner.Username, req.Name))
+
+	key, err := auth.ScanGatewayKey(database.DB().QueryRow(
+		"SELECT "+auth.GatewayKeyColumns+" FROM gateway_api_keys g WHERE g.id = ?", id,
+	))
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "创建失败"})
+		return
+	}
+	// 明文密钥只在创建时返回这一次
+	key.APIKey = apiKey
+	c.JSON(200, key)
+}
+
+// UpdateGatewayKey 修改网关密钥的名称、权限范围、模型限制、IP 限制或配额
+func UpdateGatewayKey(c *gin.Context) {
+	key, owner, ok := loadGatewayKey(c)
+	if !ok {
+		return
+	}
+
+	var req models.GatewayAPIKeyUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"detail": "无效的请求"})
+		return
+	}
+
+	if msg := validateKeyIPRules(req.AllowedIPs, req.DeniedIPs); msg != "" {
+		c.JSON(400, gin.H{"detail": msg})
+		return
+	}
+
+	db := database.DB()
+	if req.Name != nil && *req.Name != "" {
+		db.Exec("UPDATE gateway_api_keys SET name = ? WHERE id = ?", *req.Name, key.ID)
+	}
+	if req.Scopes != nil {
+		if msg := validateScopes(req.Scopes, owner); msg != "" {
+			c.JSON(400, gin.H{"detail": msg})
+			return
+		}
+		if len(req.Scopes) == 0 {
+			c.JSON(400, gin.H{"detail": "至少需要一个权限"})
+			return
+		}
+		db.Exec("UPDATE gateway_api_keys SET scopes = ? WHERE id = ?", strings.Join(req.Scopes, ","), key.ID)
+	}
+	if req.AllowedModels != nil {
+		db.Exec("UPDATE gateway_api_keys SET allowed_models = ? WHERE id = ?", auth.JoinList(req.AllowedModels), key.ID)
+	}
+	if req.DeniedModels != nil {
+		db.Exec("UPDATE gateway_api_keys SET denied_models = ? WHERE id = ?", auth.JoinList(req.DeniedModels), key.ID)
+	}
+	if req.AllowedIPs != nil {
+		db.Exec("UPDATE gateway_api_keys SET allowed_ips = ? WHERE id = ?", auth.JoinList(req.AllowedIPs), key.ID)
+	}
+	if req.DeniedIPs != nil {
+		db.Exec("UPDATE gateway_api_keys SET denied_ips = ? WHERE id = ?", auth.JoinList(req.DeniedIPs), key.ID)
+	}
+	if req.Quota != nil {
+		db.Exec("UPDATE gateway_api_keys SET quota = ? WHERE id = ?", auth.FormatQuota(req.Quota), key.ID)
+	}
+
+	logger.Info(fmt.Sprintf("%s | 更新网关密钥 | %s | %s", c.ClientIP(), owner.Username, key.Name))
+	c.JSON(200, gin.H{"message": "更新成功"})
+}
+
+// RevokeGatewayKey 吊销网关密钥，吊销后立即失效但保留记录
+func RevokeGatewayKey(c *gin.Context) {
+	key, owner, ok := loadGatewayKey(c)
+	if !ok {
+		return
+	}
+
+	if _, err := database.DB().Exec("UPDATE gateway_api_keys SET is_revoked = 1 WHERE id = ?", key.ID); err != nil {
+		c.JSON(500, gin.H{"detail": "吊销失败"})
+		return
+	}
+
+	logger.Info(fmt.Sprintf("%s | 吊销网关密钥 | %s | %s", c.ClientIP(), owner.Username, key.Name))
+	c.JSON(200, gin.H{"message": "已吊销"})
+}
+
+// DeleteGatewayKey 删除网关密钥
+func DeleteGatewayKey(c *gin.Context) {
+	key, owner, ok := loadGatewayKey(c)
+	if !ok {
+		return
+	}
+
+	if _, err := database.DB().Exec("DELETE FROM gateway_api_keys WHERE id = ?", key.ID); err != nil {
+		c.JSON(500, gin.H{"detail": "删除失败"})
+		return
+	}
+
+	logger.Info(fmt.Sprintf("%s | 删除网关密钥 | %s | %s", c.ClientIP(), owner.Username, key.Name))
+	c.JSON(200, gin.H{"message": "删除成功"})
+}
+
+// loadGatewayKey 读取路径参数 keyId 对应的密钥，仅密钥所有者或管理员可操作
+func loadGatewayKey(c *gin.Context) (*models.GatewayAPIKey, *models.User, bool) {
+	id, err := strconv.Atoi(c.Param("keyId"))
+	if err != nil {
+		c.JSON(400, gin.H{"detail": "无效的密钥ID"})
+		return nil, nil, false
+	}
+
+	key, err := auth.ScanGatewayKey(database.DB().QueryRow(
+		"SELECT "+auth.GatewayKeyColumns+" FROM gateway_api_keys g WHERE g.id = ?", id,
+	))
+	user := c.MustGet("user").(*models.User)
+	if err != nil || (key.UserID != user.ID && !user.IsAdmin) {
+		c.JSON(404, gin.H{"detail": "密钥不存在"})
+		return nil, nil, false
+	}
+
+	owner := user
+	if key.UserID != user.ID {
+		if owner, err = auth.GetUserByID(key.UserID); err != nil {
+			c.JSON(404, gin.H{"detail": "密钥不存在"})
+			return nil, nil, false
+		}
+	}
+	return key, owner, true
+}
+
+// validateScopes 校验权限范围，admin-read 仅可授予管理员的密钥
+// validateKeyIPRules 检查网关密钥的 IP 白名单和黑名单
+func validateKeyIPRules(allowed, denied []string) string {
+	if msg := auth.ValidateIPRules(allowed); msg != "" {
+		return msg
+	}
+	return auth.ValidateIPRules(denied)
+}
+
+func validateScopes(scopes []string, owner *models.User) string {
+	for _, scope := range scopes {
+		valid := false
+		for _, s := range auth.ValidScopes {
+			if scope == s {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Sprintf("未知的权限: %s", scope)
+		}
+		if scope == models.ScopeAdminRead && !auth.IsStaff(owner) {
+			return "只有管理角色的密钥可以授予 admin-read 权限"
+		}
+	}
+	return ""
+}
+
+// replaceDefaultKey 重新生成用户的默认密钥（users.api_key 保存其哈希），同步替换对应的网关密钥
+// 默认密钥已被删除时重新创建，其他密钥不受影响
+func replaceDefaultKey(userID int) (string, error) {
+	db := database.DB()
+
+	var oldHash string
+	db.QueryRow("SELECT api_key FROM users WHERE id = ?", userID).Scan(&oldHash)
+
+	newKey := auth.GenerateAPIKey()
+	newHash := database.HashAPIKey(newKey)
+	if _, err := db.Exec("UPDATE users SET api_key = ? WHERE id = ?", newHash, userID); err != nil {
+		return "", err
+	}
+
+	result, err := db.Exec("UPDATE gateway_api_keys SET api_key = ?, key_prefix = ?, is_revoked = 0 WHERE api_key = ?",
+		newHash, database.APIKeyPrefix(newKey), oldHash)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		if _, err := auth.InsertGatewayKey(userID, newKey, nil); err != nil {
+			return "", err
+		}
+	}
+	return newKey, nil
+}
@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"vte/internal/auth"
+	"vte/internal/database"
+	"vte/internal/logger"
+	"vte/internal/models"
+)
+
+// GetIPAccessSettings 获取全局 IP 访问控制设置，同时返回当前请求识别到的客户端 IP，便于检查反向代理配置
+func GetIPAccessSettings(c *gin.Context) {
+	settings := auth.GetIPAccess()
+	c.JSON(200, gin.H{
+		"allowed_ips": settings.AllowedIPs,
+		"denied_ips":  settings.DeniedIPs,
+		"client_ip":   c.ClientIP(),
+		"remote_ip":   c.RemoteIP(),
+	})
+}
+
+// SetIPAccessSettings 设置全局 IP 白名单和黑名单，对所有网关密钥生效
+func SetIPAccessSettings(c *gin.Context) {
+	var req models.IPAccessSettings
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"detail": "无效的请求"})
+		return
+	}
+	if msg := validateKeyIPRules(req.AllowedIPs, req.DeniedIPs); msg != "" {
+		c.JSON(400, gin.H{"detail": msg})
+		return
+	}
+
+	req.AllowedIPs = auth.SplitList(auth.JoinList(req.AllowedIPs))
+	req.DeniedIPs = auth.SplitList(auth.JoinList(req.DeniedIPs))
+	data, _ := json.Marshal(req)
+	database.DB().Exec(`INSERT INTO settings (key, value) VALUES ('ip_access', ?) ON CONFLICT(key) DO UPDATE SET value = ?`, string(data), string(data))
+
+	logger.Info(fmt.Sprintf("%s | IP 访问控制设置: %s", c.ClientIP(), data))
+	c.JSON(200, gin.H{"message": "设置已更新"})
+}
@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"vte/internal/auth"
+	"vte/internal/database"
+	"vte/internal/logger"
+	"vte/internal/models"
+)
+
+// loginFailureRetentionDays 登录失败记录的保留天数
+const loginFailureRetentionDays = 90
+
+// formatWait 把等待时间格式化为提示文字
+func formatWait(d time.Duration) string {
+	seconds := int(math.Ceil(d.Seconds()))
+	if seconds < 60 {
+		return fmt.Sprintf("%d 秒", seconds)
+	}
+	return fmt.Sprintf("%d 分钟", (seconds+59)/60)
+}
+
+// beginLoginAttempt 登录前检查失败锁定和并发，被拒绝时已写入响应
+// 返回的函数需在登录处理完成后调用
+func beginLoginAttempt(c *gin.Context, username string) (func(), bool) {
+	if !auth.GetLoginProtection().Enabled {
+		return func() {}, true
+	}
+
+	release, ok := auth.BeginLoginAttempt(username, c.ClientIP())
+	if !ok {
+		c.Header("Retry-After", "1")
+		c.JSON(429, gin.H{"detail": "登录请求过于频繁，请稍后再试"})
+		return nil, false
+	}
+
+	if wait := auth.LoginRetryAfter(username, c.ClientIP()); wait > 0 {
+		release()
+		logger.Warn(fmt.Sprintf("%s | 登录被拒绝（锁定中） | %s", c.ClientIP(), username))
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.JSON(429, gin.H{"detail": fmt.Sprintf("登录失败次数过多，请在 %s后重试", formatWait(wait))})
+		return nil, false
+	}
+	return release, true
+}
+
+// recordLoginFailure 记录登录失败，计数达到阈值时锁定用户名或 IP
+func recordLoginFailure(c *gin.Context, username, reason string) {
+	wait, locked := auth.RecordLoginFailure(auth.GetLoginProtection(), username, c.ClientIP(), c.Request.UserAgent(), reason)
+	if locked {
+		logger.Warn(fmt.Sprintf("%s | 登录已锁定 | %s | 等待 %s", c.ClientIP(), username, formatWait(wait)))
+	}
+}
+
+// CleanOldLoginFailures 清理过期的登录失败记录和失败计数
+func CleanOldLoginFailures() error {
+	db := database.DB()
+	cutoff := time.Now().UTC().AddDate(0, 0, -loginFailureRetentionDays)
+	if _, err := db.Exec("DELETE FROM login_failures WHERE created_at < ?", cutoff.Format("2006-01-02 15:04:05")); err != nil {
+		return err
+	}
+
+	// 失败计数只保留最近 24 小时内有失败且未过锁定期的记录
+	rows, err := db.Query("SELECT scope, key, last_failure_at, locked_until FROM login_throttle")
+	if err != nil {
+		return err
+	}
+	var expired [][2]string
+	for rows.Next() {
+		var scope, key string
+		var last, locked sql.NullTime
+		if err := rows.Scan(&scope, &key, &last, &locked); err != nil {
+			continue
+		}
+		if time.Since(last.Time) > 24*time.Hour && time.Now().After(locked.Time) {
+			expired = append(expired, [2]string{scope, key})
+		}
+	}
+	rows.Close()
+
+	for _, e := range expired {
+		auth.ClearLoginFailures(e[0], e[1])
+	}
+	return nil
+}
+
+// GetLoginProtectionSettings 获取登录防暴力破解设置
+func GetLoginProtectionSettings(c *gin.Context) {
+	c.JSON(200, auth.GetLoginProtection())
+}
+
+// SetLoginProtectionSettings 设置登录防暴力破解参数
+func SetLoginProtectionSettings(c *gin.Context) {
+	var req models.LoginProtectionSettings
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"detail": "无效的请求"})
+		return
+	}
+	if req.MaxUserFailures < 1 || req.MaxIPFailures < 1 || req.LockoutMinutes < 1 {
+		c.JSON(400, gin.H{"detail": "失败次数和锁定时长必须大于 0"})
+		return
+	}
+
+	data, _ := json.Marshal(req)
+	database.DB().Exec(`INSERT INTO settings (key, value) VALUES ('login_protection', ?) ON CONFLICT(key) DO UPDATE SET value = ?`, string(data), string(data))
+
+	logger.Info(fmt.Sprintf("%s | 登录保护设置: %s", c.ClientIP(), data))
+	c.JSON(200, gin.H{"message": "设置已更新"})
+}
+
+// ListLoginLockouts 列出最近 24 小时内有登录失败的用户名和 IP
+func ListLoginLockouts(c *gin.Context) {
+	rows, err := database.DB().Query("SELECT scope, key, failures, last_failure_at, locked_until FROM login_throttle ORDER BY last_failure_at DESC")
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "查询失败"})
+		return
+	}
+	defer rows.Close()
+
+	items := []gin.H{}
+	for rows.Next() {
+		var t auth.LoginThrottle
+		var last, locked sql.NullTime
+		if err := rows.Scan(&t.Scope, &t.Key, &t.Failures, &last, &locked); err != nil {
+			continue
+		}
+		if time.Since(last.Time) > 24*time.Hour {
+			continue
+		}
+		item := gin.H{
+			"scope":           t.Scope,
+			"key":             t.Key,
+			"failures":        t.Failures,
+			"last_failure_at": last.Time,
+			"locked":          time.Now().Before(locked.Time),
+		}
+		if time.Now().Before(locked.Time) {
+			item["locked_until"] = locked.Time
+		}
+		items = append(items, item)
+	}
+	c.JSON(200, items)
+}
+
+// UnlockLogin 清除指定用户名或 IP 的失败计数和锁定
+func UnlockLogin(c *gin.Context) {
+	var req struct {
+		Scope string `json:"scope" binding:"required"`
+		Key   string `json:"key" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"detail": "无效的请求"})
+		return
+	}
+	if req.Scope != auth.LoginScopeUser && req.Scope != auth.LoginScopeIP {
+		c.JSON(400, gin.H{"detail": "scope 只能是 user 或 ip"})
+		return
+	}
+	key := strings.TrimSpace(req.Key)
+	if req.Scope == auth.LoginScopeUser {
+		key = auth.LoginUserKey(key)
+	}
+
+	if !auth.ClearLoginFailures(req.Scope, key) {
+		c.JSON(404, gin.H{"detail": "没有该记录"})
+		return
+	}
+
+	operator := c.MustGet("user").(*models.User)
+	logger.Info(fmt.Sprintf("%s | 解除登录锁定 | %s %s | 操作者: %s", c.ClientIP(), req.Scope, key, operator.Username))
+	c.JSON(200, gin.H{"message": "已解除锁定"})
+}
+
+// UnlockUser 解除用户的登录锁定
+func UnlockUser(c *gin.Context) {
+	target, ok := loadTargetUser(c)
+	if !ok {
+		return
+	}
+
+	auth.ClearLoginFailures(auth.LoginScopeUser, auth.LoginUserKey(target.Username))
+
+	operator := c.MustGet("user").(*models.User)
+	logger.Info(fmt.Sprintf("%s | 解除登录锁定 | %s | 操作者: %s", c.ClientIP(), target.Username, operator.Username))
+	c.JSON(200, gin.H{"message": "已解除锁定"})
+}
+
+// ListLoginFailures 查询登录失败记录，可按用户名和 IP 过滤
+func ListLoginFailures(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	query := "SELECT id, username, ip, user_agent, reason, created_at FROM login_failures WHERE 1 = 1"
+	var args []interface{}
+	if username := strings.TrimSpace(c.Query("username")); username != "" {
+		query += " AND username = ?"
+		args = append(args, username)
+	}
+	if ip := strings.TrimSpace(c.Query("ip")); ip != "" {
+		query += " AND ip = ?"
+		args = append(args, ip)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := database.DB().Query(query, args...)
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "查询失败"})
+		return
+	}
+	defer rows.Close()
+
+	items := []gin.H{}
+	for rows.Next() {
+		var id int
+		var username, ip, userAgent, reason string
+		var createdAt time.Time
+		if err := rows.Scan(&id, &username, &ip, &userAgent, &reason, &createdAt); err != nil {
+			continue
+		}
+		items = append(items, gin.H{
+			"id":         id,
+			"username":   username,
+			"ip":         ip,
+			"user_agent": userAgent,
+			"reason":     reason,
+			"created_at": createdAt,
+		})
+	}
+	c.JSON(200, items)
+}
@@ -0,0 +1,675 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"vte/internal/auth"
+	"vte/internal/database"
+	"vte/internal/logger"
+	"vte/internal/models"
+	"vte/internal/secret"
+)
+
+const (
+	oidcDefaultScopes = "openid profile email"
+	oidcStateTTL      = 10 * time.Minute // 发起登录到回调的最长时间
+	oidcDiscoveryTTL  = time.Hour
+	oidcMaxPending    = 1000 // 同时等待回调的登录请求上限，登录接口无需认证，防止被刷满内存
+	oidcStateCookie   = "vte_oidc_state"
+	oidcCookiePath    = "/api/auth/oidc"
+)
+
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcPending 等待回调的登录请求
+type oidcPending struct {
+	verifier    string // PKCE code_verifier
+	nonce       string
+	redirectURI string
+	browser     [32]byte // 发起登录的浏览器 Cookie 的哈希，回调必须来自同一浏览器
+	expires     time.Time
+}
+
+// oidcDiscovery 身份提供商的元数据和签名公钥
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	keys    map[string]interface{} // kid -> 公钥
+	fetched time.Time
+}
+
+var (
+	oidcStates   = make(map[string]oidcPending) // state -> 登录请求
+	oidcStatesMu sync.Mutex
+
+	oidcCache   *oidcDiscovery
+	oidcCacheMu sync.Mutex
+)
+
+// getOIDCSettings 获取单点登录设置，client_secret 保持加密
+func getOIDCSettings() models.OIDCSettings {
+	var value string
+	database.DB().QueryRow("SELECT value FROM settings WHERE key = 'oidc_config'").Scan(&value)
+
+	settings := models.OIDCSettings{Scopes: oidcDefaultScopes}
+	if value != "" {
+		json.Unmarshal([]byte(value), &settings)
+	}
+	settings.ClientSecretSet = settings.ClientSecret != ""
+	return settings
+}
+
+// GetOIDCSettings 获取单点登录设置，不返回 client_secret
+func GetOIDCSettings(c *gin.Context) {
+	settings := getOIDCSettings()
+	settings.ClientSecret = ""
+	c.JSON(200, settings)
+}
+
+// SetOIDCSettings 设置单点登录，client_secret 留空表示保留原值
+func SetOIDCSettings(c *gin.Context) {
+	var req models.OIDCSettings
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"detail": "无效的请求"})
+		return
+	}
+
+	req.Issuer = strings.TrimRight(strings.TrimSpace(req.Issuer), "/")
+	req.ClientID = strings.TrimSpace(req.ClientID)
+	req.RedirectURL = strings.TrimSpace(req.RedirectURL)
+	req.AdminClaim = strings.TrimSpace(req.AdminClaim)
+	req.Scopes = strings.Join(strings.Fields(req.Scopes), " ")
+	if req.Scopes == "" {
+		req.Scopes = oidcDefaultScopes
+	}
+	if !strings.Contains(" "+req.Scopes+" ", " openid ") {
+		req.Scopes = "openid " + req.Scopes
+	}
+	values := []string{}
+	for _, v := range req.AdminValues {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	req.AdminValues = values
+	if req.Enabled && (req.Issuer == "" || req.ClientID == "") {
+		c.JSON(400, gin.H{"detail": "启用单点登录需要填写 Issuer 和 Client ID"})
+		return
+	}
+
+	if req.ClientSecret != "" {
+		encrypted, err := secret.Encrypt(req.ClientSecret)
+		if err != nil {
+			c.JSON(500, gin.H{"detail": "加密密钥失败"})
+			return
+		}
+		req.ClientSecret = encrypted
+	} else {
+		req.ClientSecret = getOIDCSettings().ClientSecret
+	}
+	req.ClientSecretSet = false
+
+	value, _ := json.Marshal(req)
+	database.DB().Exec(`INSERT INTO settings (key, value) VALUES ('oidc_config', ?) ON CONFLICT(key) DO UPDATE SET value = ?`, string(value), string(value))
+
+	// Issuer 可能已修改，下次登录时重新获取元数据
+	oidcCacheMu.Lock()
+	oidcCache = nil
+	oidcCacheMu.Unlock()
+
+	status := "关闭"
+	if req.Enabled {
+		status = "开启"
+	}
+	logger.Info(fmt.Sprintf("%s | 单点登录: %s | %s", c.ClientIP(), status, req.Issuer))
+	c.JSON(200, gin.H{"message": "设置已更新"})
+}
+
+// GetOIDCStatus 登录页查询是否启用单点登录（无需认证）
+func GetOIDCStatus(c *gin.Context) {
+	settings := getOIDCSettings()
+	buttonText := settings.ButtonText
+	if buttonText == "" {
+		buttonText = "使用单点登录"
+	}
+	c.JSON(200, gin.H{"enabled": settings.Enabled, "button_text": buttonText})
+}
+
+// OIDCLogin 生成 state、nonce 和 PKCE 参数后跳转到身份提供商
+func OIDCLogin(c *gin.Context) {
+	settings := getOIDCSettings()
+	if !settings.Enabled {
+		c.JSON(404, gin.H{"detail": "未启用单点登录"})
+		return
+	}
+
+	provider, err := discoverOIDC(settings.Issuer, false)
+	if err != nil {
+		logger.Error(fmt.Sprintf("%s | 单点登录失败 | 获取身份提供商元数据失败: %v", c.ClientIP(), err))
+		redirectOIDCError(c, "无法连接身份提供商")
+		return
+	}
+
+	binding := randomURLString(32)
+	pending := oidcPending{
+		verifier:    randomURLString(32),
+		nonce:       randomURLString(16),
+		redirectURI: oidcRedirectURI(c, settings),
+		browser:     sha256.Sum256([]byte(binding)),
+		expires:     time.Now().Add(oidcStateTTL),
+	}
+	state := randomURLString(16)
+
+	oidcStatesMu.Lock()
+	for k, p := range oidcStates {
+		if time.Now().After(p.expires) {
+			delete(oidcStates, k)
+		}
+	}
+	full := len(oidcStates) >= oidcMaxPending
+	if !full {
+		oidcStates[state] = pending
+	}
+	oidcStatesMu.Unlock()
+	if full {
+		logger.Warn(fmt.Sprintf("%s | 单点登录失败 | 等待回调的登录请求过多", c.ClientIP()))
+		redirectOIDCError(c, "登录请求过多，请稍后重试")
+		return
+	}
+
+	// state 与发起登录的浏览器绑定，防止攻击者把自己的回调地址发给他人完成登录（登录 CSRF）
+	setOIDCStateCookie(c, binding, int(oidcStateTTL.Seconds()), strings.HasPrefix(pending.redirectURI, "https://"))
+
+	challenge := sha256.Sum256([]byte(pending.verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {settings.ClientID},
+		"redirect_uri":          {pending.redirectURI},
+		"scope":                 {settings.Scopes},
+		"state":                 {state},
+		"nonce":                 {pending.nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	c.Redirect(http.StatusFound, provider.AuthorizationEndpoint+sep+query.Encode())
+}
+
+// OIDCCallback 用授权码换取 ID Token，验证后匹配或创建本地账户并签发登录令牌
+// 结果通过 /login#token=...、/login#challenge=...（需两步验证）或 /login#sso_error=... 交给前端
+func OIDCCallback(c *gin.Context) {
+	settings := getOIDCSettings()
+	if !settings.Enabled {
+		redirectOIDCError(c, "未启用单点登录")
+		return
+	}
+	if errCode := c.Query("error"); errCode != "" {
+		logger.Warn(fmt.Sprintf("%s | 单点登录失败 | %s %s", c.ClientIP(), errCode, c.Query("error_description")))
+		redirectOIDCError(c, "身份提供商拒绝了登录请求")
+		return
+	}
+
+	binding, _ := c.Cookie(oidcStateCookie)
+	setOIDCStateCookie(c, "", -1, false)
+
+	oidcStatesMu.Lock()
+	pending, ok := oidcStates[c.Query("state")]
+	delete(oidcStates, c.Query("state"))
+	oidcStatesMu.Unlock()
+	if !ok || time.Now().After(pending.expires) {
+		redirectOIDCError(c, "登录请求已过期，请重试")
+		return
+	}
+	if hash := sha256.Sum256([]byte(binding)); binding == "" || subtle.ConstantTimeCompare(hash[:], pending.browser[:]) != 1 {
+		logger.Warn(fmt.Sprintf("%s | 单点登录失败 | 回调与发起登录的浏览器不一致", c.ClientIP()))
+		redirectOIDCError(c, "登录请求无效，请在同一浏览器中重新登录")
+		return
+	}
+
+	claims, err := exchangeOIDCCode(settings, pending, c.Query("code"))
+	if err != nil {
+		logger.Warn(fmt.Sprintf("%s | 单点登录失败 | %v", c.ClientIP(), err))
+		redirectOIDCError(c, "身份验证失败")
+		return
+	}
+
+	user, err := resolveOIDCUser(settings, claims, c.ClientIP())
+	if err != nil {
+		logger.Warn(fmt.Sprintf("%s | 单点登录失败 | %v", c.ClientIP(), err))
+		redirectOIDCError(c, err.Error())
+		return
+	}
+
+	// 启用两步验证的用户仍需在登录页提交验证码
+	if user.TOTPEnabled {
+		challenge, err := auth.GenerateChallengeToken(user.Username)
+		if err != nil {
+			redirectOIDCError(c, "生成令牌失败")
+			return
+		}
+		c.Redirect(http.StatusFound, "/login#challenge="+url.QueryEscape(challenge))
+		return
+	}
+
+	tokens, err := issueSession(c, user)
+	if err != nil {
+		redirectOIDCError(c, "生成令牌失败")
+		return
+	}
+
+	logger.Info(fmt.Sprintf("%s | 单点登录成功 | %s", c.ClientIP(), user.Username))
+	c.Redirect(http.StatusFound, "/login#token="+url.QueryEscape(tokens.AccessToken)+"&refresh_token="+url.QueryEscape(tokens.RefreshToken))
+}
+
+// setOIDCStateCookie 设置或清除（maxAge < 0）绑定登录请求的 Cookie
+// SameSite=Lax 时身份提供商跳转回来的顶层 GET 请求仍会携带该 Cookie
+func setOIDCStateCookie(c *gin.Context, value string, maxAge int, secure bool) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value,
+		Path:     oidcCookiePath,
+		MaxAge:   maxAge,
+		Secure:   secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func redirectOIDCError(c *gin.Context, message string) {
+	c.Redirect(http.StatusFound, "/login#sso_error="+url.QueryEscape(message))
+}
+
+// oidcRedirectURI 回调地址，未配置时根据请求地址生成
+// X-Forwarded-Proto 只在请求来自可信的反向代理时采用，直接连接的客户端不能借此修改回调地址
+func oidcRedirectURI(c *gin.Context, settings models.OIDCSettings) string {
+	if settings.RedirectURL != "" {
+		return settings.RedirectURL
+	}
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if auth.FromTrustedProxy(c) {
+		if proto := strings.ToLower(c.GetHeader("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+	}
+	return scheme + "://" + c.Request.Host + "/api/auth/oidc/callback"
+}
+
+// exchangeOIDCCode 用授权码换取令牌，验证 ID Token 并返回合并了 userinfo 的声明
+func exchangeOIDCCode(settings models.OIDCSettings, pending oidcPending, code string) (jwt.MapClaims, error) {
+	if code == "" {
+		return nil, errors.New("missing authorization code")
+	}
+	provider, err := discoverOIDC(settings.Issuer, false)
+	if err != nil {
+		return nil, err
+	}
+	clientSecret, err := secret.Decrypt(settings.ClientSecret)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt client secret: %w", err)
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {pending.redirectURI},
+		"client_id":     {settings.ClientID},
+		"code_verifier": {pending.verifier},
+	}
+	req, _ := http.NewRequest("POST", provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(settings.ClientID), url.QueryEscape(clientSecret))
+	}
+
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+	}
+	if err := doOIDCRequest(req, &tokens); err != nil {
+		return nil, fmt.Errorf("token endpoint: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+
+	claims, err := verifyIDToken(settings, provider, tokens.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims["nonce"] != pending.nonce {
+		return nil, errors.New("id_token nonce mismatch")
+	}
+
+	// 部分身份提供商只在 userinfo 中返回邮箱和分组
+	if provider.UserinfoEndpoint != "" && tokens.AccessToken != "" {
+		req, _ := http.NewRequest("GET", provider.UserinfoEndpoint, nil)
+		req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+		req.Header.Set("Accept", "application/json")
+		var info map[string]interface{}
+		if err := doOIDCRequest(req, &info); err == nil && info["sub"] == claims["sub"] {
+			for k, v := range info {
+				if _, exists := claims[k]; !exists {
+					claims[k] = v
+				}
+			}
+		}
+	}
+	return claims, nil
+}
+
+// verifyIDToken 验证 ID Token 的签名、issuer、audience 和有效期
+func verifyIDToken(settings models.OIDCSettings, provider *oidcDiscovery, idToken string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return oidcSigningKey(settings.Issuer, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(provider.Issuer),
+		jwt.WithAudience(settings.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id_token: %w", err)
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("id_token has no sub")
+	}
+	return claims, nil
+}
+
+// oidcSigningKey 按 kid 查找签名公钥，找不到时刷新一次公钥（身份提供商可能已轮换密钥）
+func oidcSigningKey(issuer, kid string) (interface{}, error) {
+	for _, refresh := range []bool{false, true} {
+		provider, err := discoverOIDC(issuer, refresh)
+		if err != nil {
+			return nil, err
+		}
+		if key, ok := provider.keys[kid]; ok {
+			return key, nil
+		}
+		// 没有 kid 且只有一个公钥时直接使用
+		if kid == "" && len(provider.keys) == 1 {
+			for _, key := range provider.keys {
+				return key, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// discoverOIDC 获取并缓存身份提供商元数据和公钥
+func discoverOIDC(issuer string, refresh bool) (*oidcDiscovery, error) {
+	oidcCacheMu.Lock()
+	defer oidcCacheMu.Unlock()
+	if !refresh && oidcCache != nil && oidcCache.Issuer == issuer && time.Since(oidcCache.fetched) < oidcDiscoveryTTL {
+		return oidcCache, nil
+	}
+
+	req, _ := http.NewRequest("GET", issuer+"/.well-known/openid-configuration", nil)
+	var provider oidcDiscovery
+	if err := doOIDCRequest(req, &provider); err != nil {
+		return nil, err
+	}
+	if provider.Issuer != issuer {
+		return nil, fmt.Errorf("issuer mismatch: configured %s, discovered %s", issuer, provider.Issuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, errors.New("incomplete discovery document")
+	}
+
+	req, _ = http.NewRequest("GET", provider.JWKSURI, nil)
+	var jwks struct {
+		Keys []map[string]interface{} `json:"keys"`
+	}
+	if err := doOIDCRequest(req, &jwks); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+	provider.keys = make(map[string]interface{})
+	for _, jwk := range jwks.Keys {
+		if use, _ := jwk["use"].(string); use != "" && use != "sig" {
+			continue
+		}
+		key, err := parseJWK(jwk)
+		if err != nil {
+			continue
+		}
+		kid, _ := jwk["kid"].(string)
+		provider.keys[kid] = key
+	}
+	provider.fetched = time.Now()
+	oidcCache = &provider
+	return oidcCache, nil
+}
+
+// parseJWK 解析 RSA 或 EC 公钥
+func parseJWK(jwk map[string]interface{}) (interface{}, error) {
+	field := func(name string) (*big.Int, error) {
+		s, _ := jwk[name].(string)
+		b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("invalid jwk field %s", name)
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch jwk["kty"] {
+	case "RSA":
+		n, err := field("n")
+		if err != nil {
+			return nil, err
+		}
+		e, err := field("e")
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk["crv"] {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("unsupported curve")
+		}
+		x, err := field("x")
+		if err != nil {
+			return nil, err
+		}
+		y, err := field("y")
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errors.New("unsupported key type")
+}
+
+func doOIDCRequest(req *http.Request, out interface{}) error {
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s returned %d: %s", req.URL, resp.StatusCode, truncate(string(body), 200))
+	}
+	return json.Unmarshal(body, out)
+}
+
+// resolveOIDCUser 按 OIDC 主体、已验证的邮箱依次匹配本地账户，都没有时按设置自动创建；
+// 配置了管理员声明时同步管理员权限
+func resolveOIDCUser(settings models.OIDCSettings, claims jwt.MapClaims, clientIP string) (*models.User, error) {
+	db := database.DB()
+	sub, _ := claims["sub"].(string)
+	subject := settings.Issuer + "|" + sub
+	email, _ := claims["email"].(string)
+	email = strings.TrimSpace(email)
+	// 只有身份提供商确认过的邮箱才能用于关联已有账户，否则任何人都可以声明他人的邮箱接管账户
+	if !oidcEmailVerified(claims) {
+		email = ""
+	}
+
+	var userID int
+	err := db.QueryRow("SELECT id FROM users WHERE oidc_subject = ?", subject).Scan(&userID)
+	if err != nil && email != "" {
+		if db.QueryRow("SELECT id FROM users WHERE email = ? COLLATE NOCASE ORDER BY id LIMIT 1", email).Scan(&userID) == nil {
+			db.Exec("UPDATE users SET oidc_subject = ? WHERE id = ?", subject, userID)
+			err = nil
+		}
+	}
+
+	isAdmin, hasAdminClaim := oidcClaimIsAdmin(settings, claims)
+	if err != nil {
+		if !settings.AutoProvision {
+			return nil, errors.New("没有与该身份关联的账户，请联系管理员")
+		}
+		username := oidcUsername(claims)
+		role := models.RoleUser
+		if hasAdminClaim && isAdmin {
+			role = models.RoleAdmin
+		}
+		userID, _, err = createUser(username, randomURLString(32), email, subject, role)
+		if err != nil {
+			return nil, fmt.Errorf("创建账户失败: %v", err)
+		}
+		logger.Info(fmt.Sprintf("%s | 单点登录创建用户 | %s", clientIP, username))
+	}
+
+	user, err := auth.GetUserByID(userID)
+	if err != nil {
+		return nil, errors.New("账户不存在")
+	}
+	if !user.IsActive {
+		return nil, errors.New("账户已禁用")
+	}
+
+	if hasAdminClaim && isAdmin != user.IsAdmin {
+		// 不因身份提供商的声明移除最后一个启用的管理员
+		if !isAdmin && countOtherActiveAdmins(user.ID) == 0 {
+			logger.Warn(fmt.Sprintf("%s | 单点登录 | %s 是唯一的管理员，保留管理员权限", clientIP, user.Username))
+		} else {
+			role := models.RoleUser
+			if isAdmin {
+				role = models.RoleAdmin
+			}
+			db.Exec("UPDATE users SET is_admin = ?, role = ? WHERE id = ?", boolToInt(isAdmin), role, user.ID)
+			user.IsAdmin, user.Role = isAdmin, role
+			logger.Info(fmt.Sprintf("%s | 单点登录同步管理员权限 | %s | %v", clientIP, user.Username, isAdmin))
+		}
+	}
+	return user, nil
+}
+
+// oidcEmailVerified 判断 email_verified 声明是否为 true，部分身份提供商以字符串返回
+func oidcEmailVerified(claims jwt.MapClaims) bool {
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		return v
+	case string:
+		return strings.EqualFold(v, "true")
+	}
+	return false
+}
+
+// oidcClaimIsAdmin 根据管理员声明判断是否为管理员，第二个返回值表示是否配置了管理员声明
+// 声明可以是字符串、字符串数组或布尔值；未配置 admin_values 时布尔值 true 表示管理员
+func oidcClaimIsAdmin(settings models.OIDCSettings, claims jwt.MapClaims) (bool, bool) {
+	if settings.AdminClaim == "" {
+		return false, false
+	}
+
+	var values []string
+	switch v := claims[settings.AdminClaim].(type) {
+	case bool:
+		return v && len(settings.AdminValues) == 0, true
+	case string:
+		values = strings.Fields(strings.ReplaceAll(v, ",", " "))
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	for _, v := range values {
+		for _, want := range settings.AdminValues {
+			if v == want {
+				return true, true
+			}
+		}
+	}
+	return false, true
+}
+
+// oidcUsername 为自动创建的账户选择不重复的用户名
+func oidcUsername(claims jwt.MapClaims) string {
+	base, _ := claims["preferred_username"].(string)
+	if base == "" {
+		if email, _ := claims["email"].(string); email != "" {
+			base, _, _ = strings.Cut(email, "@")
+		}
+	}
+	if base == "" {
+		sub, _ := claims["sub"].(string)
+		base = "sso-" + truncate(sub, 12)
+	}
+
+	username := base
+	for i := 2; ; i++ {
+		var count int
+		database.DB().QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", username).Scan(&count)
+		if count == 0 {
+			return username
+		}
+		username = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+func randomURLString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -0,0 +1,374 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+
+	"vte/internal/auth"
+	"vte/internal/database"
+	"vte/internal/models"
+)
+
+const testOIDCClientID = "vte-test"
+
+// testIdP 用 httptest 模拟的身份提供商，令牌端点按 claims 签发 ID Token
+type testIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu     sync.Mutex
+	claims jwt.MapClaims
+	method jwt.SigningMethod
+	signer interface{}
+}
+
+func newTestIdP(t *testing.T, autoProvision bool) *testIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &testIdP{key: key, method: jwt.SigningMethodRS256, signer: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"kid": "test-key",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "authorization_code" || r.Form.Get("code") == "" || r.Form.Get("code_verifier") == "" {
+			http.Error(w, `{"error":"invalid_request"}`, 400)
+			return
+		}
+		idp.mu.Lock()
+		token := jwt.NewWithClaims(idp.method, idp.claims)
+		token.Header["kid"] = "test-key"
+		signed, err := token.SignedString(idp.signer)
+		idp.mu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": signed, "token_type": "Bearer"})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	config, _ := json.Marshal(models.OIDCSettings{
+		Enabled:       true,
+		Issuer:        idp.server.URL,
+		ClientID:      testOIDCClientID,
+		Scopes:        oidcDefaultScopes,
+		AutoProvision: autoProvision,
+	})
+	database.DB().Exec(`INSERT INTO settings (key, value) VALUES ('oidc_config', ?) ON CONFLICT(key) DO UPDATE SET value = ?`, string(config), string(config))
+	t.Cleanup(func() { database.DB().Exec("DELETE FROM settings WHERE key = 'oidc_config'") })
+	return idp
+}
+
+// issue 设置下一次令牌端点返回的 ID Token：合法的声明加上 overrides，值为 nil 的声明会被删除
+func (idp *testIdP) issue(nonce, sub string, overrides jwt.MapClaims) {
+	claims := jwt.MapClaims{
+		"iss":   idp.server.URL,
+		"aud":   testOIDCClientID,
+		"sub":   sub,
+		"nonce": nonce,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(5 * time.Minute).Unix(),
+	}
+	for k, v := range overrides {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+	idp.mu.Lock()
+	idp.claims = claims
+	idp.mu.Unlock()
+}
+
+func (idp *testIdP) signWith(method jwt.SigningMethod, signer interface{}) {
+	idp.mu.Lock()
+	idp.method, idp.signer = method, signer
+	idp.mu.Unlock()
+}
+
+// oidcTestLogin 发起登录后浏览器持有的 state 和绑定 Cookie
+type oidcTestLogin struct {
+	state  string
+	cookie *http.Cookie
+}
+
+// startOIDCLogin 发起登录，返回 state 和 Cookie、nonce 以及回调地址
+func startOIDCLogin(t *testing.T, remoteAddr string, headers map[string]string) (login oidcTestLogin, nonce, redirectURI string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "http://vte.example.com/api/auth/oidc/login", nil)
+	c.Request.RemoteAddr = remoteAddr
+	for k, v := range headers {
+		c.Request.Header.Set(k, v)
+	}
+	OIDCLogin(c)
+
+	if w.Code != http.StatusFound {
+		t.Fatalf("login status = %d, want a redirect to the IdP", w.Code)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := location.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Errorf("authorization request without PKCE: %s", location)
+	}
+	login.state = q.Get("state")
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == oidcStateCookie {
+			login.cookie = cookie
+		}
+	}
+	if login.cookie == nil || !login.cookie.HttpOnly || login.cookie.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("state cookie = %+v, want an HttpOnly SameSite=Lax cookie", login.cookie)
+	}
+	return login, q.Get("nonce"), q.Get("redirect_uri")
+}
+
+// finishOIDCLogin 模拟浏览器带着 Cookie 回调，返回交给前端的结果（/login# 之后的部分）
+func finishOIDCLogin(t *testing.T, login oidcTestLogin) url.Values {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "http://vte.example.com/api/auth/oidc/callback?code=test-code&state="+url.QueryEscape(login.state), nil)
+	if login.cookie != nil {
+		c.Request.AddCookie(&http.Cookie{Name: login.cookie.Name, Value: login.cookie.Value})
+	}
+	OIDCCallback(c)
+
+	location := w.Header().Get("Location")
+	fragment, ok := strings.CutPrefix(location, "/login#")
+	if w.Code != http.StatusFound || !ok {
+		t.Fatalf("callback status = %d, location = %q, want a redirect to /login", w.Code, location)
+	}
+	result, err := url.ParseQuery(fragment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestOIDCLoginSuccess(t *testing.T) {
+	idp := newTestIdP(t, true)
+	login, nonce, _ := startOIDCLogin(t, "192.0.2.1:1234", nil)
+	idp.issue(nonce, "success-sub", jwt.MapClaims{"preferred_username": "oidc-success"})
+
+	result := finishOIDCLogin(t, login)
+	if result.Get("token") == "" || result.Get("refresh_token") == "" {
+		t.Fatalf("callback result = %v, want login tokens", result)
+	}
+	var subject string
+	database.DB().QueryRow("SELECT oidc_subject FROM users WHERE username = 'oidc-success'").Scan(&subject)
+	if subject != idp.server.URL+"|success-sub" {
+		t.Errorf("auto-provisioned user subject = %q", subject)
+	}
+
+	// state 只能使用一次
+	if result := finishOIDCLogin(t, login); result.Get("sso_error") == "" || result.Get("token") != "" {
+		t.Errorf("replayed state result = %v, want an error", result)
+	}
+}
+
+func TestOIDCCallbackRejectsUnknownState(t *testing.T) {
+	newTestIdP(t, true)
+	if result := finishOIDCLogin(t, oidcTestLogin{state: "forged-state"}); result.Get("sso_error") == "" {
+		t.Errorf("forged state result = %v, want an error", result)
+	}
+}
+
+func TestOIDCRejectsInvalidIDToken(t *testing.T) {
+	hsSecret := []byte("shared-secret")
+	tests := []struct {
+		name      string
+		overrides func(idp *testIdP) jwt.MapClaims
+		method    jwt.SigningMethod
+		signer    func(idp *testIdP) interface{}
+	}{
+		{name: "nonce mismatch", overrides: func(*testIdP) jwt.MapClaims { return jwt.MapClaims{"nonce": "replayed-nonce"} }},
+		{name: "missing nonce", overrides: func(*testIdP) jwt.MapClaims { return jwt.MapClaims{"nonce": nil} }},
+		{name: "wrong issuer", overrides: func(*testIdP) jwt.MapClaims { return jwt.MapClaims{"iss": "https://evil.example.com"} }},
+		{name: "wrong audience", overrides: func(*testIdP) jwt.MapClaims { return jwt.MapClaims{"aud": "another-client"} }},
+		{name: "expired", overrides: func(*testIdP) jwt.MapClaims {
+			return jwt.MapClaims{"exp": time.Now().Add(-10 * time.Minute).Unix()}
+		}},
+		{name: "missing exp", overrides: func(*testIdP) jwt.MapClaims { return jwt.MapClaims{"exp": nil} }},
+		{name: "missing sub", overrides: func(*testIdP) jwt.MapClaims { return jwt.MapClaims{"sub": ""} }},
+		{name: "HS256", method: jwt.SigningMethodHS256, signer: func(*testIdP) interface{} { return hsSecret }},
+		{name: "alg none", method: jwt.SigningMethodNone, signer: func(*testIdP) interface{} { return jwt.UnsafeAllowNoneSignatureType }},
+		{name: "unknown key", method: jwt.SigningMethodRS256, signer: func(*testIdP) interface{} {
+			other, _ := rsa.GenerateKey(rand.Reader, 2048)
+			return other
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newTestIdP(t, true)
+			if tt.method != nil {
+				idp.signWith(tt.method, tt.signer(idp))
+			}
+			var overrides jwt.MapClaims
+			if tt.overrides != nil {
+				overrides = tt.overrides(idp)
+			}
+			login, nonce, _ := startOIDCLogin(t, "192.0.2.1:1234", nil)
+			idp.issue(nonce, "invalid-"+strings.ReplaceAll(tt.name, " ", "-"), overrides)
+
+			if result := finishOIDCLogin(t, login); result.Get("sso_error") == "" || result.Get("token") != "" {
+				t.Errorf("callback result = %v, want the ID token to be rejected", result)
+			}
+		})
+	}
+}
+
+func TestOIDCEmailLinkingRequiresVerifiedEmail(t *testing.T) {
+	userID, _, err := createUser("oidc-email-owner", "password123", "owner@example.com", "", models.RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linkedSubject := func() string {
+		var subject string
+		database.DB().QueryRow("SELECT COALESCE(oidc_subject, '') FROM users WHERE id = ?", userID).Scan(&subject)
+		return subject
+	}
+
+	for _, verified := range []interface{}{nil, false, "false"} {
+		idp := newTestIdP(t, false)
+		login, nonce, _ := startOIDCLogin(t, "192.0.2.1:1234", nil)
+		idp.issue(nonce, "attacker", jwt.MapClaims{"email": "owner@example.com", "email_verified": verified})
+
+		if result := finishOIDCLogin(t, login); result.Get("sso_error") == "" {
+			t.Errorf("email_verified=%v: result = %v, want login refused", verified, result)
+		}
+		if subject := linkedSubject(); subject != "" {
+			t.Fatalf("email_verified=%v linked the account to %q", verified, subject)
+		}
+	}
+
+	idp := newTestIdP(t, false)
+	login, nonce, _ := startOIDCLogin(t, "192.0.2.1:1234", nil)
+	idp.issue(nonce, "owner", jwt.MapClaims{"email": "Owner@Example.com", "email_verified": true})
+	if result := finishOIDCLogin(t, login); result.Get("token") == "" {
+		t.Fatalf("verified email result = %v, want login", result)
+	}
+	if subject := linkedSubject(); subject != idp.server.URL+"|owner" {
+		t.Errorf("linked subject = %q, want the verified identity", subject)
+	}
+}
+
+func TestOIDCRedirectURIIgnoresUntrustedForwardedProto(t *testing.T) {
+	newTestIdP(t, true)
+	auth.SetTrustedProxies([]string{"10.0.0.0/8"})
+	t.Cleanup(func() { auth.SetTrustedProxies(nil) })
+	forwarded := map[string]string{"X-Forwarded-Proto": "https"}
+
+	if _, _, uri := startOIDCLogin(t, "192.0.2.1:1234", forwarded); uri != "http://vte.example.com/api/auth/oidc/callback" {
+		t.Errorf("direct client redirect_uri = %q, want X-Forwarded-Proto ignored", uri)
+	}
+	if _, _, uri := startOIDCLogin(t, "10.1.2.3:1234", forwarded); uri != "https://vte.example.com/api/auth/oidc/callback" {
+		t.Errorf("trusted proxy redirect_uri = %q, want X-Forwarded-Proto honoured", uri)
+	}
+	if _, _, uri := startOIDCLogin(t, "10.1.2.3:1234", map[string]string{"X-Forwarded-Proto": "javascript"}); uri != "http://vte.example.com/api/auth/oidc/callback" {
+		t.Errorf("invalid forwarded scheme redirect_uri = %q, want it ignored", uri)
+	}
+}
+
+func TestOIDCRedirectURIUsesConfiguredURL(t *testing.T) {
+	idp := newTestIdP(t, true)
+	settings := getOIDCSettings()
+	settings.RedirectURL = "https://sso.example.com/api/auth/oidc/callback"
+	config, _ := json.Marshal(settings)
+	database.DB().Exec("UPDATE settings SET value = ? WHERE key = 'oidc_config'", string(config))
+
+	login, nonce, uri := startOIDCLogin(t, "192.0.2.1:1234", map[string]string{"X-Forwarded-Proto": "http"})
+	if uri != settings.RedirectURL {
+		t.Errorf("redirect_uri = %q, want the configured callback URL", uri)
+	}
+	idp.issue(nonce, "configured-redirect", nil)
+	if result := finishOIDCLogin(t, login); result.Get("token") == "" {
+		t.Errorf("callback result = %v, want login", result)
+	}
+}
+
+func TestOIDCCallbackRequiresLoginBrowser(t *testing.T) {
+	idp := newTestIdP(t, true)
+
+	// 攻击者发起登录后把回调地址发给受害者，受害者的浏览器没有对应的 Cookie
+	attacker, nonce, _ := startOIDCLogin(t, "192.0.2.1:1234", nil)
+	idp.issue(nonce, "csrf-attacker", nil)
+	if result := finishOIDCLogin(t, oidcTestLogin{state: attacker.state}); result.Get("sso_error") == "" || result.Get("token") != "" {
+		t.Errorf("callback without the state cookie = %v, want an error", result)
+	}
+
+	// 受害者自己发起过登录时，其 Cookie 也不能用于攻击者的 state
+	attacker, nonce, _ = startOIDCLogin(t, "192.0.2.1:1234", nil)
+	victim, _, _ := startOIDCLogin(t, "198.51.100.1:1234", nil)
+	idp.issue(nonce, "csrf-attacker", nil)
+	if result := finishOIDCLogin(t, oidcTestLogin{state: attacker.state, cookie: victim.cookie}); result.Get("sso_error") == "" || result.Get("token") != "" {
+		t.Errorf("callback with another browser's cookie = %v, want an error", result)
+	}
+}
+
+func TestOIDCLoginCapsPendingStates(t *testing.T) {
+	newTestIdP(t, true)
+	oidcStatesMu.Lock()
+	saved := oidcStates
+	oidcStates = make(map[string]oidcPending)
+	for i := 0; i < oidcMaxPending; i++ {
+		oidcStates[strconv.Itoa(i)] = oidcPending{expires: time.Now().Add(time.Minute)}
+	}
+	oidcStatesMu.Unlock()
+	t.Cleanup(func() {
+		oidcStatesMu.Lock()
+		oidcStates = saved
+		oidcStatesMu.Unlock()
+	})
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "http://vte.example.com/api/auth/oidc/login", nil)
+	OIDCLogin(c)
+	if location := w.Header().Get("Location"); !strings.HasPrefix(location, "/login#sso_error=") {
+		t.Errorf("login with a full state table redirected to %q, want an error", location)
+	}
+	if len(oidcStates) != oidcMaxPending {
+		t.Errorf("pending states = %d, want the cap %d", len(oidcStates), oidcMaxPending)
+	}
+}
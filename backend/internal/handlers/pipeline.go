@@ -0,0 +1,839 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"vte/internal/database"
+	"vte/internal/logger"
+	"vte/internal/models"
+	"vte/internal/proxy"
+	"vte/internal/ratelimit"
+	"vte/internal/secret"
+	"vte/internal/tokenizer"
+)
+
+// chatRequest 一次聊天请求在管道中的上下文（HTTP 与 WebSocket 共用）
+type chatRequest struct {
+	Ctx       context.Context // 客户端断开或取消时结束，用于中止上游请求
+	ClientIP  string
+	WebSocket bool
+	User      *models.User
+	APIKey    *models.GatewayAPIKey // 本次请求使用的网关密钥
+	Payload   map[string]interface{}
+	ModelName string // 客户端请求的模型名
+	Stream    bool   // 客户端是否要求流式响应
+	// 客户端是否通过 stream_options.include_usage 要求 usage chunk
+	IncludeUsage bool
+
+	// 以下字段由管道阶段填充
+	UpstreamStream bool // 向上游发起流式请求，与 Stream 不同时由网关转换
+	Model          *modelInfo
+	Provider       *providerInfo
+	DisplayName    string
+	Config         *proxy.ProviderConfig
+	StartTime      time.Time
+
+	headers           map[string]string
+	tokenReservations []ratelimit.Check // 按 token 限流的规则预占的额度，记录用量时修正
+	credit            *creditHold       // 启用余额计费时预扣的余额，记录用量时结算
+	cleanups          []func()
+}
+
+// onFinish 注册请求结束时需要执行的清理函数（如释放并发槽）
+func (req *chatRequest) onFinish(fn func()) {
+	req.cleanups = append(req.cleanups, fn)
+}
+
+// setHeader 设置返回给客户端的响应头，在写入响应前统一应用
+func (req *chatRequest) setHeader(key, value string) {
+	if req.headers == nil {
+		req.headers = map[string]string{}
+	}
+	req.headers[key] = value
+}
+
+func (req *chatRequest) finish() {
+	for i := len(req.cleanups) - 1; i >= 0; i-- {
+		req.cleanups[i]()
+	}
+	req.cleanups = nil
+}
+
+// logPrefix 日志前缀：来源 | 模型
+func (req *chatRequest) logPrefix() string {
+	if req.WebSocket {
+		return fmt.Sprintf("WebSocket | %s | %s", req.ClientIP, req.ModelName)
+	}
+	return fmt.Sprintf("%s | %s", req.ClientIP, req.ModelName)
+}
+
+// newChatRequest 解析请求体并创建管道上下文
+func newChatRequest(ctx context.Context, payload map[string]interface{}, user *models.User, clientIP string) (*chatRequest, *chatError) {
+	modelName, ok := payload["model"].(string)
+	if !ok || modelName == "" {
+		return nil, &chatError{Status: 400, Body: gin.H{"detail": "缺少 model 参数"}}
+	}
+
+	stream := false
+	if s, ok := payload["stream"].(bool); ok {
+		stream = s
+	}
+
+	includeUsage := false
+	if opts, ok := payload["stream_options"].(map[string]interface{}); ok {
+		includeUsage, _ = opts["include_usage"].(bool)
+	}
+
+	return &chatRequest{
+		Ctx:       ctx,
+		ClientIP:  clientIP,
+		User:      user,
+		Payload:   payload,
+		ModelName: modelName,
+		Stream:    stream,
+
+		IncludeUsage: stream && includeUsage,
+	}, nil
+}
+
+// chatError 管道阶段产生的错误
+type chatError struct {
+	Status  int    // HTTP 状态码
+	Body    gin.H  // 默认错误响应体
+	Message string // 用于匹配自定义错误响应规则，为空则不匹配；权限、配额和余额拒绝必须留空，不能被改写为正常响应
+	Reason  string // 使用自定义响应时日志中显示的原错误
+}
+
+// detail 提取错误的可读描述
+func (e *chatError) detail() string {
+	if d, ok := e.Body["detail"].(string); ok {
+		return d
+	}
+	if inner, ok := e.Body["error"].(gin.H); ok {
+		if msg, ok := inner["message"].(string); ok {
+			return msg
+		}
+	}
+	return fmt.Sprintf("status %d", e.Status)
+}
+
+// chatResponder 不同传输方式的响应写入器
+type chatResponder interface {
+	// Error 写入错误响应
+	Error(status int, body gin.H)
+	// JSON 写入非流式响应
+	JSON(result map[string]interface{})
+	// StreamStart 在第一行流式数据之前调用
+	StreamStart()
+	// StreamLine 写入一行 SSE 数据（不含换行符），返回 false 表示客户端已断开
+	StreamLine(line string) bool
+	// Header 设置响应头，在写入响应之前调用
+	Header(key, value string)
+}
+
+// chatStage 管道中的一个处理阶段，返回非 nil 表示终止请求
+type chatStage func(req *chatRequest) *chatError
+
+// chatStages 按顺序执行：认证 → 限制 → 转换 → 路由
+// 所有传输方式都必须经过这些阶段，新增策略请在此注册
+var chatStages = []chatStage{
+	authStage,
+	quotaStage,
+	globalRateLimitStage,
+	concurrencyStage,
+	streamModeStage,
+	systemPromptStage,
+	routeStage,
+	modelAccessStage,
+	customRateLimitStage,
+	creditStage,
+	upstreamStage,
+}
+
+// runChatPipeline 执行完整的聊天请求管道：各阶段 → 分发 → 记账
+func runChatPipeline(req *chatRequest, resp chatResponder) {
+	defer req.finish()
+
+	for _, stage := range chatStages {
+		if e := stage(req); e != nil {
+			applyHeaders(req, resp)
+			writeChatError(req, resp, e)
+			return
+		}
+	}
+	applyHeaders(req, resp)
+
+	req.StartTime = time.Now()
+	logger.RequestStart()
+
+	dispatch(req, resp)
+}
+
+func applyHeaders(req *chatRequest, resp chatResponder) {
+	for key, value := range req.headers {
+		resp.Header(key, value)
+	}
+}
+
+// writeChatError 写入管道错误，命中自定义错误规则时返回伪造的正常响应
+func writeChatError(req *chatRequest, resp chatResponder, e *chatError) {
+	if e.Message != "" {
+		if matched, customResponse := checkCustomErrorResponse(database.DB(), e.Message); matched {
+			logger.Error(fmt.Sprintf("%s | 自定义响应(原错误: %s)", req.logPrefix(), e.Reason))
+			writeFakeResponse(req, resp, customResponse)
+			return
+		}
+	}
+	resp.Error(e.Status, e.Body)
+}
+
+// writeFakeResponse 按客户端请求的模式写入伪造的正常响应
+func writeFakeResponse(req *chatRequest, resp chatResponder, content string) {
+	if !req.Stream {
+		resp.JSON(buildFakeResponse(content, req.ModelName))
+		return
+	}
+	resp.StreamStart()
+	for _, line := range strings.Split(buildFakeStreamResponse(content, req.ModelName), "\n") {
+		if !resp.StreamLine(line) {
+			return
+		}
+	}
+}
+
+// authStage 确认请求已通过认证
+func authStage(req *chatRequest) *chatError {
+	if req.User == nil || !req.User.IsActive {
+		return &chatError{Status: 401, Body: gin.H{"detail": "无效的 API Key"}}
+	}
+	return nil
+}
+
+// globalRateLimitStage 全局速率限制
+func globalRateLimitStage(req *chatRequest) *chatError {
+	decision := checkRateLimit()
+	if decision == nil {
+		return nil
+	}
+	setRateLimitHeaders(req, "requests", decision.Result)
+	if decision.Result.Allowed {
+		return nil
+	}
+	return &chatError{
+		Status: 429,
+		Body: gin.H{
+			"error": gin.H{
+				"message": "请求过于频繁，请稍后重试",
+				"type":    "rate_limit_error",
+				"code":    "rate_limit_exceeded",
+			},
+		},
+		Message: "请求过于频繁，请稍后重试 rate_limit_exceeded",
+		Reason:  "全局速率限制",
+	}
+}
+
+// setRateLimitHeaders 设置 x-ratelimit-*-{requests|tokens} 响应头，被拒绝时附带 Retry-After
+// 全局限制与自定义规则都生效时，后执行的自定义规则覆盖全局限制的值
+func setRateLimitHeaders(req *chatRequest, kind string, r ratelimit.Result) {
+	req.setHeader("x-ratelimit-limit-"+kind, strconv.Itoa(r.Limit))
+	req.setHeader("x-ratelimit-remaining-"+kind, strconv.Itoa(r.Remaining))
+	req.setHeader("x-ratelimit-reset-"+kind, formatResetDuration(r.ResetAfter))
+	if !r.Allowed {
+		req.setHeader("Retry-After", strconv.Itoa(int(math.Ceil(r.RetryAfter.Seconds()))))
+	}
+}
+
+// formatResetDuration 按 OpenAI 的格式输出重置时间，如 6m0s、1.5s、20ms
+func formatResetDuration(d time.Duration) string {
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(100 * time.Millisecond).String()
+}
+
+// concurrencyStage 全局并发限制，请求结束时释放并发槽
+func concurrencyStage(req *chatRequest) *chatError {
+	if !acquireConcurrency() {
+		return &chatError{
+			Status: 503,
+			Body: gin.H{
+				"error": gin.H{
+					"message": "服务器繁忙，请稍后重试",
+					"type":    "concurrency_limit_error",
+					"code":    "concurrency_limit_exceeded",
+				},
+			},
+			Message: "服务器繁忙，请稍后重试 concurrency_limit_exceeded",
+			Reason:  "并发限制",
+		}
+	}
+	req.onFinish(releaseConcurrency)
+	return nil
+}
+
+// streamModeStage 应用流式模式设置，只影响上游请求方式，客户端仍按原模式收到响应
+func streamModeStage(req *chatRequest) *chatError {
+	var streamMode string
+	database.DB().QueryRow("SELECT value FROM settings WHERE key = 'stream_mode'").Scan(&streamMode)
+
+	req.UpstreamStream = req.Stream
+	if streamMode == "force_stream" {
+		req.UpstreamStream = true
+	} else if streamMode == "force_non_stream" {
+		req.UpstreamStream = false
+	}
+	req.Payload["stream"] = req.UpstreamStream
+
+	// 流式请求总是向上游要求 usage 用于统计，是否转发给客户端由 IncludeUsage 决定
+	if req.UpstreamStream {
+		opts, _ := req.Payload["stream_options"].(map[string]interface{})
+		if opts == nil {
+			opts = map[string]interface{}{}
+		}
+		opts["include_usage"] = true
+		req.Payload["stream_options"] = opts
+	} else {
+		delete(req.Payload, "stream_options")
+	}
+	return nil
+}
+
+// systemPromptStage 注入系统前置提示词
+func systemPromptStage(req *chatRequest) *chatError {
+	injectSystemPrompt(database.DB(), req.Payload)
+	return nil
+}
+
+// routeStage 查找模型和提供商
+func routeStage(req *chatRequest) *chatError {
+	model, provider, err := findModel(req.ModelName)
+	if err != nil {
+		errMsg := fmt.Sprintf("模型不存在: %s", req.ModelName)
+		return &chatError{Status: 404, Body: gin.H{"detail": errMsg}, Message: errMsg, Reason: "模型不存在"}
+	}
+
+	if !provider.IsActive {
+		errMsg := fmt.Sprintf("提供商已禁用: %s", provider.Name)
+		return &chatError{Status: 503, Body: gin.H{"detail": errMsg}, Message: errMsg, Reason: "提供商禁用"}
+	}
+
+	req.Model = model
+	req.Provider = provider
+	req.DisplayName = req.ModelName
+	if model.DisplayName != "" {
+		req.DisplayName = model.DisplayName
+	}
+	return nil
+}
+
+// modelAccessStage 校验网关密钥的模型白名单和黑名单
+func modelAccessStage(req *chatRequest) *chatError {
+	if req.APIKey.AllowsModel(req.ModelName, req.DisplayName, req.Model.OriginalID) {
+		return nil
+	}
+	errMsg := fmt.Sprintf("当前 API Key 无权使用模型: %s", req.ModelName)
+	return &chatError{
+		Status: 403,
+		Body: gin.H{
+			"error": gin.H{
+				"message": errMsg,
+				"type":    "invalid_request_error",
+				"param":   "model",
+				"code":    "model_not_allowed",
+			},
+		},
+		Reason: "模型不在密钥允许范围内",
+	}
+}
+
+// customRateLimitStage 自定义速率限制（按提供商/模型，可按用户/密钥/IP 分别计数，可限制请求数和 token 数）
+func customRateLimitStage(req *chatRequest) *chatError {
+	requests, tokens := checkCustomRateLimit(req)
+	if requests != nil {
+		setRateLimitHeaders(req, "requests", requests.Result)
+	}
+	if tokens != nil {
+		setRateLimitHeaders(req, "tokens", tokens.Result)
+	}
+
+	if tokens != nil && !tokens.Result.Allowed && (requests == nil || requests.Result.Allowed) {
+		ruleName := tokens.Rule
+		return &chatError{
+			Status: 429,
+			Body: gin.H{
+				"error": gin.H{
+					"message": fmt.Sprintf("触发自定义 Token 速率限制规则 [%s]，请稍后重试", ruleName),
+					"type":    "rate_limit_error",
+					"code":    "custom_token_rate_limit_exceeded",
+				},
+			},
+			Message: fmt.Sprintf("触发自定义 Token 速率限制规则 [%s]，请稍后重试 custom_token_rate_limit_exceeded", ruleName),
+			Reason:  fmt.Sprintf("自定义 Token 速率限制 %s", ruleName),
+		}
+	}
+	if requests == nil || requests.Result.Allowed {
+		return nil
+	}
+	ruleName := requests.Rule
+	return &chatError{
+		Status: 429,
+		Body: gin.H{
+			"error": gin.H{
+				"message": fmt.Sprintf("触发自定义速率限制规则 [%s]，请稍后重试", ruleName),
+				"type":    "rate_limit_error",
+				"code":    "custom_rate_limit_exceeded",
+			},
+		},
+		Message: fmt.Sprintf("触发自定义速率限制规则 [%s]，请稍后重试 custom_rate_limit_exceeded", ruleName),
+		Reason:  fmt.Sprintf("自定义速率限制 %s", ruleName),
+	}
+}
+
+// upstreamStage 替换模型名为原始 ID 并构建上游客户端配置
+func upstreamStage(req *chatRequest) *chatError {
+	provider := req.Provider
+
+	originalID := req.Model.OriginalID
+	if provider.ProviderType == "vertex_express" && len(originalID) > 0 {
+		if len(originalID) < 7 || originalID[:7] != "google/" {
+			originalID = "google/" + originalID
+		}
+	}
+	req.Payload["model"] = originalID
+
+	// 密钥在数据库中加密保存，只在构建上游配置时解密
+	apiKey, err := secret.Decrypt(provider.APIKey)
+	if err != nil {
+		logger.Error(fmt.Sprintf("解密提供商密钥失败 | %s | %v", provider.Name, err))
+		return &chatError{Status: 500, Body: gin.H{"detail": "提供商密钥不可用"}}
+	}
+
+	cfg := &proxy.ProviderConfig{
+		BaseURL:        provider.BaseURL,
+		APIKey:         apiKey,
+		ProviderType:   provider.ProviderType,
+		VertexProject:  provider.VertexProject,
+		VertexLocation: provider.VertexLocation,
+		ProxyURL:       provider.ProxyURL,
+	}
+
+	if provider.ExtraHeaders != "" {
+		json.Unmarshal([]byte(provider.ExtraHeaders), &cfg.ExtraHeaders)
+	}
+	if provider.ProviderType == proxy.ProviderTypeMock {
+		cfg.Mock = proxy.ParseMockConfig(provider.MockConfig)
+	}
+
+	req.Config = cfg
+	return nil
+}
+
+// dispatch 根据客户端与上游的流式模式分发请求，两者不一致时自动转换
+func dispatch(req *chatRequest, resp chatResponder) {
+	switch {
+	case req.Stream && req.UpstreamStream:
+		dispatchStream(req, resp)
+	case req.Stream:
+		dispatchNonStreamAsStream(req, resp)
+	case req.UpstreamStream:
+		dispatchStreamAsNonStream(req, resp)
+	default:
+		dispatchNonStream(req, resp)
+	}
+}
+
+// dispatchNonStream 非流式上游 → 非流式客户端
+func dispatchNonStream(req *chatRequest, resp chatResponder) {
+	result := requestNonStream(req, resp)
+	if result == nil {
+		return
+	}
+
+	var usage usageCounter
+	usage.observeCompletion(result)
+	usage.record(req)
+	logger.RequestSuccess()
+	resp.JSON(result)
+}
+
+// dispatchNonStreamAsStream 非流式上游 → 流式客户端：由完整响应合成 SSE chunk
+func dispatchNonStreamAsStream(req *chatRequest, resp chatResponder) {
+	result := requestNonStream(req, resp)
+	if result == nil {
+		return
+	}
+
+	var usage usageCounter
+	usage.observeCompletion(result)
+	usage.record(req)
+	logger.RequestSuccess()
+
+	resp.StreamStart()
+	chunks := completionToChunks(result)
+	if req.IncludeUsage {
+		chunks = append(chunks, usage.chunk(req, result))
+	}
+	for _, chunk := range chunks {
+		if !writeSSEChunk(resp, chunk) {
+			return
+		}
+	}
+	resp.StreamLine("data: [DONE]")
+	resp.StreamLine("")
+}
+
+// dispatchStream 流式上游 → 流式客户端：逐行转发
+// 客户端未要求 usage 时去掉 usage chunk；要求了但上游未返回时在 [DONE] 之前补发
+func dispatchStream(req *chatRequest, resp chatResponder) {
+	upstream := requestStream(req, resp)
+	if upstream == nil {
+		return
+	}
+	defer upstream.Body.Close()
+
+	resp.StreamStart()
+
+	var usage usageCounter
+	var lastChunk map[string]interface{}
+	usageSent := false
+	completed := readStream(req, upstream.Body, func(line string, chunk map[string]interface{}) bool {
+		if chunk != nil {
+			usage.observeChunk(chunk)
+			lastChunk = chunk
+			if _, ok := chunk["usage"].(map[string]interface{}); ok {
+				if !req.IncludeUsage {
+					return writeChunkWithoutUsage(resp, chunk)
+				}
+				usageSent = true
+			}
+		}
+		if req.IncludeUsage && !usageSent && isSSEDone(line) {
+			usageSent = true
+			if !writeSSEChunk(resp, usage.chunk(req, lastChunk)) {
+				return false
+			}
+		}
+		return resp.StreamLine(line)
+	})
+	if !completed {
+		// 客户端断开或上游中断：按输入和已转发的输出记录部分用量，Token 限流与计费据此修正
+		usage.record(req)
+		return
+	}
+
+	// 上游没有发送 [DONE] 时在结尾补发 usage
+	if req.IncludeUsage && !usageSent {
+		writeSSEChunk(resp, usage.chunk(req, lastChunk))
+	}
+
+	usage.record(req)
+	logger.RequestSuccess()
+}
+
+// dispatchStreamAsNonStream 流式上游 → 非流式客户端：将 chunk 聚合为完整的 chat.completion
+func dispatchStreamAsNonStream(req *chatRequest, resp chatResponder) {
+	upstream := requestStream(req, resp)
+	if upstream == nil {
+		return
+	}
+	defer upstream.Body.Close()
+
+	agg := newCompletionAggregator(req.ModelName)
+	completed := readStream(req, upstream.Body, func(line string, chunk map[string]interface{}) bool {
+		if chunk != nil {
+			agg.add(chunk)
+		}
+		return true
+	})
+
+	// 中断时同样按已聚合的部分记录用量
+	result := agg.result()
+	var usage usageCounter
+	usage.observeCompletion(result)
+	usage.record(req)
+	if !completed {
+		return
+	}
+	if _, ok := result["usage"]; !ok {
+		result["usage"] = usage.usageMap(req)
+	}
+	logger.RequestSuccess()
+	resp.JSON(result)
+}
+
+// requestNonStream 发起非流式上游请求，失败时写入错误响应并返回 nil
+func requestNonStream(req *chatRequest, resp chatResponder) map[string]interface{} {
+	result, err := req.Config.ChatCompletionWithContext(req.Ctx, req.Payload, getMaxRetries())
+	if err == nil {
+		return result
+	}
+
+	duration := time.Since(req.StartTime).Seconds()
+	if req.Ctx.Err() != nil {
+		logger.Info(fmt.Sprintf("%s | %.2fs | 请求已取消", req.logPrefix(), duration))
+		logger.RequestSuccess()
+		return nil
+	}
+	handleUpstreamError(req, resp, err.Error(), err.Error(), duration, 500, gin.H{"detail": fmt.Sprintf("请求失败: %v", err)})
+	return nil
+}
+
+// requestStream 发起流式上游请求，失败时写入错误响应并返回 nil
+func requestStream(req *chatRequest, resp chatResponder) *http.Response {
+	upstream, err := req.Config.ChatCompletionStreamWithContext(req.Ctx, req.Payload, getMaxRetries())
+	if err != nil {
+		duration := time.Since(req.StartTime).Seconds()
+		if req.Ctx.Err() != nil {
+			logger.Info(fmt.Sprintf("%s | %.2fs | 请求已取消", req.logPrefix(), duration))
+			logger.RequestSuccess()
+			return nil
+		}
+		handleUpstreamError(req, resp, err.Error(), err.Error(), duration, 500, gin.H{"detail": fmt.Sprintf("请求失败: %v", err)})
+		return nil
+	}
+
+	if upstream.StatusCode != 200 {
+		body, _ := io.ReadAll(upstream.Body)
+		upstream.Body.Close()
+		bodyStr := string(body)
+		duration := time.Since(req.StartTime).Seconds()
+		handleUpstreamError(req, resp, bodyStr, fmt.Sprintf("status %d: %s", upstream.StatusCode, bodyStr), duration, upstream.StatusCode, gin.H{"detail": bodyStr})
+		return nil
+	}
+	return upstream
+}
+
+// readStream 逐行读取上游 SSE 数据，onLine 返回 false 表示客户端已断开
+// 返回 true 表示完整读取到结尾；否则已记录中断或错误日志
+func readStream(req *chatRequest, body io.Reader, onLine func(line string, chunk map[string]interface{}) bool) bool {
+	reader := bufio.NewReader(body)
+	for {
+		line, readErr := reader.ReadString('\n')
+		if line != "" {
+			line = strings.TrimRight(line, "\r\n")
+			if !onLine(line, parseSSEData(line)) {
+				duration := time.Since(req.StartTime).Seconds()
+				logger.Info(fmt.Sprintf("%s | %.2fs | 流被中断", req.logPrefix(), duration))
+				logger.RequestSuccess()
+				return false
+			}
+		}
+
+		if readErr != nil {
+			duration := time.Since(req.StartTime).Seconds()
+			if req.Ctx.Err() != nil {
+				logger.Info(fmt.Sprintf("%s | %.2fs | 流被中断", req.logPrefix(), duration))
+				logger.RequestSuccess()
+				return false
+			}
+			if readErr != io.EOF {
+				logger.Error(fmt.Sprintf("%s | %.2fs | %v", req.logPrefix(), duration, readErr))
+				logger.RequestError()
+				return false
+			}
+			return true
+		}
+	}
+}
+
+// handleUpstreamError 处理上游错误，命中自定义错误规则时返回伪造的正常响应
+func handleUpstreamError(req *chatRequest, resp chatResponder, matchText, logText string, duration float64, status int, body gin.H) {
+	if matched, customResponse := checkCustomErrorResponse(database.DB(), matchText); matched {
+		logger.Info(fmt.Sprintf("%s | %.2fs | 自定义响应(原错误: %s)", req.logPrefix(), duration, logText))
+		logger.RequestSuccess()
+		writeFakeResponse(req, resp, customResponse)
+		return
+	}
+
+	logger.Error(fmt.Sprintf("%s | %.2fs | %s", req.logPrefix(), duration, logText))
+	logger.RequestError()
+	resp.Error(status, body)
+}
+
+// usageCounter 统计一次请求的 token 使用：优先使用上游返回的 usage，缺失时用 tiktoken 计算
+type usageCounter struct {
+	usage  map[string]interface{}
+	output strings.Builder
+}
+
+// observeChunk 记录流式 chunk 中的 usage 和输出内容
+func (u *usageCounter) observeChunk(chunk map[string]interface{}) {
+	if usage, ok := chunk["usage"].(map[string]interface{}); ok {
+		u.usage = usage
+	}
+	u.output.WriteString(extractDeltaContent(chunk))
+}
+
+// observeCompletion 记录完整响应中的 usage 和输出内容
+func (u *usageCounter) observeCompletion(result map[string]interface{}) {
+	if usage, ok := result["usage"].(map[string]interface{}); ok {
+		u.usage = usage
+	}
+	u.output.WriteString(extractMessageContent(result))
+}
+
+// tokens 返回 (输入, 输出, 总计) token 数
+func (u *usageCounter) tokens(req *chatRequest) (int, int, int) {
+	if u.usage != nil {
+		promptTokens, completionTokens, totalTokens := parseUsage(u.usage)
+		if totalTokens > 0 {
+			return promptTokens, completionTokens, totalTokens
+		}
+	}
+	inputTokens := countPromptTokens(req)
+	outputTokens := tokenizer.CountTokens(u.output.String(), req.ModelName)
+	return inputTokens, outputTokens, inputTokens + outputTokens
+}
+
+// usageMap 生成 OpenAI 格式的 usage 字段
+func (u *usageCounter) usageMap(req *chatRequest) map[string]interface{} {
+	promptTokens, completionTokens, totalTokens := u.tokens(req)
+	return map[string]interface{}{
+		"prompt_tokens":     promptTokens,
+		"completion_tokens": completionTokens,
+		"total_tokens":      totalTokens,
+	}
+}
+
+// chunk 生成 usage chunk，id/model/created 取自 template（最近一个 chunk 或完整响应）
+func (u *usageCounter) chunk(req *chatRequest, template map[string]interface{}) map[string]interface{} {
+	usageChunk := map[string]interface{}{
+		"id":      fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano()),
+		"object":  "chat.completion.chunk",
+		"created": time.Now().Unix(),
+		"model":   req.ModelName,
+		"choices": []interface{}{},
+	}
+	for _, key := range []string{"id", "created", "model", "system_fingerprint"} {
+		if v, ok := template[key]; ok && v != nil && v != "" {
+			usageChunk[key] = v
+		}
+	}
+	if u.usage != nil {
+		if _, _, totalTokens := parseUsage(u.usage); totalTokens > 0 {
+			usageChunk["usage"] = u.usage
+			return usageChunk
+		}
+	}
+	usageChunk["usage"] = u.usageMap(req)
+	return usageChunk
+}
+
+// record 记录 token 使用情况并打印日志
+// 没有 token 的请求也会记录一条 0 token 的记录，请求数配额与统计依赖每个请求都有记录
+func (u *usageCounter) record(req *chatRequest) {
+	duration := time.Since(req.StartTime).Seconds()
+
+	// usage 全为 0 且没有输出，说明是被上游拦截的空响应，按 0 token 记录
+	if u.usage != nil && u.output.Len() == 0 {
+		if _, _, totalTokens := parseUsage(u.usage); totalTokens == 0 {
+			recordChatUsage(req, 0, 0, 0, 0, duration)
+			return
+		}
+	}
+
+	promptTokens, completionTokens, totalTokens := u.tokens(req)
+	recordChatUsage(req, promptTokens, completionTokens, totalTokens, parseCachedTokens(u.usage), duration)
+}
+
+// recordChatUsage 记录 token 使用情况并打印日志
+func recordChatUsage(req *chatRequest, promptTokens, completionTokens, totalTokens, cachedTokens int, duration float64) {
+	providerName := "unknown"
+	if req.Provider != nil {
+		providerName = req.Provider.Name
+	}
+	apiKeyID := 0
+	if req.APIKey != nil {
+		apiKeyID = req.APIKey.ID
+	}
+	usage := &models.TokenUsage{
+		UserID:           req.User.ID,
+		APIKeyID:         apiKeyID,
+		ModelName:        req.DisplayName,
+		ProviderName:     providerName,
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      totalTokens,
+		CachedTokens:     cachedTokens,
+		ImageCount:       countImages(req.Payload),
+		Duration:         duration,
+	}
+	RecordTokenUsage(usage)
+	settleCredit(req, usage)
+	reconcileTokenReservations(req, totalTokens)
+	logger.Info(fmt.Sprintf("%s | %.2fs | Token: %d (in=%d, out=%d) | $%.6f", req.logPrefix(), duration, totalTokens, promptTokens, completionTokens, usage.Cost))
+}
+
+// countPromptTokens 使用 tiktoken 计算输入 token 数
+func countPromptTokens(req *chatRequest) int {
+	if messages, ok := req.Payload["messages"].([]interface{}); ok {
+		return tokenizer.CountMessagesTokens(messages, req.ModelName)
+	}
+	return 0
+}
+
+// parseUsage 解析 usage 字段
+func parseUsage(usage map[string]interface{}) (promptTokens, completionTokens, totalTokens int) {
+	if pt, ok := usage["prompt_tokens"].(float64); ok {
+		promptTokens = int(pt)
+	}
+	if ct, ok := usage["completion_tokens"].(float64); ok {
+		completionTokens = int(ct)
+	}
+	if tt, ok := usage["total_tokens"].(float64); ok {
+		totalTokens = int(tt)
+	}
+	return
+}
+
+// parseSSEData 解析一行 SSE 数据，非数据行或 [DONE] 返回 nil
+func parseSSEData(line string) map[string]interface{} {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "data: ") || strings.Contains(line, "[DONE]") {
+		return nil
+	}
+	var chunk map[string]interface{}
+	if json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &chunk) != nil {
+		return nil
+	}
+	return chunk
+}
+
+// extractDeltaContent 提取流式 chunk 中的文本内容
+func extractDeltaContent(chunk map[string]interface{}) string {
+	if choices, ok := chunk["choices"].([]interface{}); ok && len(choices) > 0 {
+		if choice, ok := choices[0].(map[string]interface{}); ok {
+			if delta, ok := choice["delta"].(map[string]interface{}); ok {
+				if content, ok := delta["content"].(string); ok {
+					return content
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// extractMessageContent 提取非流式响应中的文本内容
+func extractMessageContent(result map[string]interface{}) string {
+	if choices, ok := result["choices"].([]interface{}); ok && len(choices) > 0 {
+		if choice, ok := choices[0].(map[string]interface{}); ok {
+			if message, ok := choice["message"].(map[string]interface{}); ok {
+				if content, ok := message["content"].(string); ok {
+					return content
+				}
+			}
+		}
+	}
+	return ""
+}
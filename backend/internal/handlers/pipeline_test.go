@@ -0,0 +1,486 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"vte/internal/auth"
+	"vte/internal/database"
+	"vte/internal/models"
+	"vte/internal/proxy"
+	"vte/internal/ratelimit"
+	"vte/internal/secret"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "vte-handlers-test")
+	if err != nil {
+		panic(err)
+	}
+	masterKey, err := secret.GenerateMasterKey()
+	if err != nil {
+		panic(err)
+	}
+	if err := secret.Init(masterKey); err != nil {
+		panic(err)
+	}
+	auth.SetSecretKey("test-secret-key")
+	if err := database.Init(filepath.Join(dir, "test.db")); err != nil {
+		panic(err)
+	}
+	database.DB().Exec("INSERT INTO settings (key, value) VALUES ('max_retries', '0')")
+
+	code := m.Run()
+	database.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// recordResponder 记录管道写出的响应，maxLines 大于 0 时写满后模拟客户端断开
+type recordResponder struct {
+	status   int
+	errBody  gin.H
+	result   map[string]interface{}
+	started  bool
+	lines    []string
+	headers  map[string]string
+	maxLines int
+}
+
+func (r *recordResponder) Error(status int, body gin.H) {
+	r.status = status
+	r.errBody = body
+}
+
+func (r *recordResponder) JSON(result map[string]interface{}) {
+	// 经过一次序列化，与客户端实际收到的内容保持一致
+	data, _ := json.Marshal(result)
+	json.Unmarshal(data, &r.result)
+	r.status = 200
+}
+
+func (r *recordResponder) StreamStart() {
+	r.started = true
+	r.status = 200
+}
+
+func (r *recordResponder) StreamLine(line string) bool {
+	if r.maxLines > 0 && len(r.lines) >= r.maxLines {
+		return false
+	}
+	r.lines = append(r.lines, line)
+	return true
+}
+
+func (r *recordResponder) Header(key, value string) {
+	if r.headers == nil {
+		r.headers = map[string]string{}
+	}
+	r.headers[key] = value
+}
+
+// chunks 解析写出的 SSE 数据行，done 表示是否以 [DONE] 结尾
+func (r *recordResponder) chunks(t *testing.T) (chunks []map[string]interface{}, done bool) {
+	t.Helper()
+	for _, line := range r.lines {
+		if line == "" {
+			continue
+		}
+		if isSSEDone(line) {
+			done = true
+			continue
+		}
+		if done {
+			t.Errorf("data after [DONE]: %s", line)
+		}
+		var chunk map[string]interface{}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &chunk); err != nil {
+			t.Fatalf("invalid SSE line %q: %v", line, err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, done
+}
+
+var testUserID = 1000
+
+// newTestChatRequest 构造已通过前置阶段、指向模拟提供商的请求，每次使用新的用户以便统计用量
+func newTestChatRequest(mock *proxy.MockConfig, stream, upstreamStream, includeUsage bool) *chatRequest {
+	testUserID++
+	payload := map[string]interface{}{
+		"model": "mock-echo",
+		"messages": []interface{}{
+			map[string]interface{}{"role": "user", "content": "hello"},
+		},
+		"stream": upstreamStream,
+	}
+	if upstreamStream {
+		payload["stream_options"] = map[string]interface{}{"include_usage": true}
+	}
+	return &chatRequest{
+		Ctx:            context.Background(),
+		ClientIP:       "127.0.0.1",
+		User:           &models.User{ID: testUserID},
+		Payload:        payload,
+		ModelName:      "mock-echo",
+		Stream:         stream,
+		IncludeUsage:   includeUsage,
+		UpstreamStream: upstreamStream,
+		DisplayName:    "mock-echo",
+		Config:         &proxy.ProviderConfig{ProviderType: proxy.ProviderTypeMock, Mock: mock},
+		StartTime:      time.Now(),
+	}
+}
+
+// recordedUsage 返回该用户记录的请求数与 token 总数
+func recordedUsage(t *testing.T, userID int) (requests, prompt, completion, total int) {
+	t.Helper()
+	err := database.DB().QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(prompt_tokens), 0), COALESCE(SUM(completion_tokens), 0), COALESCE(SUM(total_tokens), 0)
+		FROM token_usage WHERE user_id = ?
+	`, userID).Scan(&requests, &prompt, &completion, &total)
+	if err != nil {
+		t.Fatalf("query token_usage: %v", err)
+	}
+	return
+}
+
+func usageTokens(t *testing.T, usage interface{}) (prompt, completion, total int) {
+	t.Helper()
+	u, ok := usage.(map[string]interface{})
+	if !ok {
+		t.Fatalf("usage = %v, want an object", usage)
+	}
+	return parseUsage(u)
+}
+
+func TestDispatchStreamAsNonStream(t *testing.T) {
+	req := newTestChatRequest(&proxy.MockConfig{Mode: "fixed", Text: "Hello there, world"}, false, true, false)
+	resp := &recordResponder{}
+	dispatch(req, resp)
+
+	if resp.status != 200 || resp.result == nil {
+		t.Fatalf("status = %d, error = %v, want a JSON completion", resp.status, resp.errBody)
+	}
+	if resp.result["object"] != "chat.completion" {
+		t.Errorf("object = %v, want chat.completion", resp.result["object"])
+	}
+	choices := resp.result["choices"].([]interface{})
+	if len(choices) != 1 {
+		t.Fatalf("got %d choices, want 1", len(choices))
+	}
+	choice := choices[0].(map[string]interface{})
+	message := choice["message"].(map[string]interface{})
+	if message["role"] != "assistant" || message["content"] != "Hello there, world" {
+		t.Errorf("message = %v, want the aggregated assistant text", message)
+	}
+	if choice["finish_reason"] != "stop" {
+		t.Errorf("finish_reason = %v, want stop", choice["finish_reason"])
+	}
+
+	prompt, completion, total := usageTokens(t, resp.result["usage"])
+	if prompt <= 0 || completion <= 0 || total != prompt+completion {
+		t.Errorf("usage = %v, want upstream usage", resp.result["usage"])
+	}
+	requests, _, _, recorded := recordedUsage(t, req.User.ID)
+	if requests != 1 || recorded != total {
+		t.Errorf("recorded %d requests / %d tokens, want 1 / %d", requests, recorded, total)
+	}
+}
+
+func TestDispatchStreamAsNonStreamToolCalls(t *testing.T) {
+	mock := &proxy.MockConfig{Mode: "tool_call", ToolCalls: []proxy.MockToolCall{
+		{Name: "get_weather", Arguments: `{"city":"Paris"}`},
+		{Name: "get_time", Arguments: `{"tz":"UTC"}`},
+	}}
+	req := newTestChatRequest(mock, false, true, false)
+	resp := &recordResponder{}
+	dispatch(req, resp)
+
+	if resp.result == nil {
+		t.Fatalf("status = %d, error = %v, want a JSON completion", resp.status, resp.errBody)
+	}
+	choice := resp.result["choices"].([]interface{})[0].(map[string]interface{})
+	if choice["finish_reason"] != "tool_calls" {
+		t.Errorf("finish_reason = %v, want tool_calls", choice["finish_reason"])
+	}
+	calls, _ := choice["message"].(map[string]interface{})["tool_calls"].([]interface{})
+	if len(calls) != 2 {
+		t.Fatalf("got %d tool calls, want 2", len(calls))
+	}
+	for i, want := range mock.ToolCalls {
+		call := calls[i].(map[string]interface{})
+		fn := call["function"].(map[string]interface{})
+		if fn["name"] != want.Name || fn["arguments"] != want.Arguments {
+			t.Errorf("tool call %d = %v, want %s(%s)", i, fn, want.Name, want.Arguments)
+		}
+		if call["id"] == "" || call["type"] != "function" {
+			t.Errorf("tool call %d is missing id/type: %v", i, call)
+		}
+		if _, ok := call["index"]; ok {
+			t.Errorf("tool call %d keeps the stream-only index field", i)
+		}
+	}
+}
+
+func TestDispatchNonStreamAsStream(t *testing.T) {
+	req := newTestChatRequest(&proxy.MockConfig{Mode: "fixed", Text: "Streaming from a full response"}, true, false, true)
+	resp := &recordResponder{}
+	dispatch(req, resp)
+
+	if !resp.started {
+		t.Fatalf("status = %d, error = %v, want a stream", resp.status, resp.errBody)
+	}
+	chunks, done := resp.chunks(t)
+	if !done {
+		t.Error("stream did not end with [DONE]")
+	}
+	if len(chunks) < 2 {
+		t.Fatalf("got %d chunks, want content and usage chunks", len(chunks))
+	}
+
+	var content strings.Builder
+	var finishReason interface{}
+	for _, chunk := range chunks[:len(chunks)-1] {
+		if chunk["object"] != "chat.completion.chunk" {
+			t.Errorf("object = %v, want chat.completion.chunk", chunk["object"])
+		}
+		if _, ok := chunk["usage"]; ok {
+			t.Errorf("usage must only be sent in the final chunk: %v", chunk)
+		}
+		for _, c := range chunk["choices"].([]interface{}) {
+			choice := c.(map[string]interface{})
+			if text, ok := choice["delta"].(map[string]interface{})["content"].(string); ok {
+				content.WriteString(text)
+			}
+			if reason := choice["finish_reason"]; reason != nil {
+				finishReason = reason
+			}
+		}
+	}
+	if content.String() != "Streaming from a full response" {
+		t.Errorf("content = %q, want the full response text", content.String())
+	}
+	if finishReason != "stop" {
+		t.Errorf("finish_reason = %v, want stop", finishReason)
+	}
+
+	last := chunks[len(chunks)-1]
+	if choices := last["choices"].([]interface{}); len(choices) != 0 {
+		t.Errorf("usage chunk has choices: %v", choices)
+	}
+	_, _, total := usageTokens(t, last["usage"])
+	if last["id"] != chunks[0]["id"] {
+		t.Errorf("usage chunk id = %v, want %v", last["id"], chunks[0]["id"])
+	}
+	if requests, _, _, recorded := recordedUsage(t, req.User.ID); requests != 1 || recorded != total {
+		t.Errorf("recorded %d requests / %d tokens, want 1 / %d", requests, recorded, total)
+	}
+}
+
+func TestDispatchStreamSynthesizesUsage(t *testing.T) {
+	req := newTestChatRequest(&proxy.MockConfig{Mode: "fixed", Text: "no usage from upstream"}, true, true, true)
+	// 上游不返回 usage chunk 时由网关按 tiktoken 计算并补发
+	delete(req.Payload, "stream_options")
+	resp := &recordResponder{}
+	dispatch(req, resp)
+
+	chunks, done := resp.chunks(t)
+	if !done {
+		t.Fatal("stream did not end with [DONE]")
+	}
+	usageChunks := 0
+	for i, chunk := range chunks {
+		if _, ok := chunk["usage"]; !ok {
+			continue
+		}
+		usageChunks++
+		if i != len(chunks)-1 {
+			t.Errorf("usage chunk at %d, want it right before [DONE]", i)
+		}
+		if chunk["id"] != chunks[0]["id"] || chunk["model"] != chunks[0]["model"] {
+			t.Errorf("usage chunk id/model = %v/%v, want %v/%v", chunk["id"], chunk["model"], chunks[0]["id"], chunks[0]["model"])
+		}
+		prompt, completion, total := usageTokens(t, chunk["usage"])
+		if prompt <= 0 || completion <= 0 || total != prompt+completion {
+			t.Errorf("synthesized usage = %v, want counted prompt and completion tokens", chunk["usage"])
+		}
+	}
+	if usageChunks != 1 {
+		t.Errorf("got %d usage chunks, want exactly 1", usageChunks)
+	}
+}
+
+func TestDispatchStreamForwardsUpstreamUsageOnce(t *testing.T) {
+	req := newTestChatRequest(&proxy.MockConfig{Mode: "fixed", Text: "upstream usage"}, true, true, true)
+	resp := &recordResponder{}
+	dispatch(req, resp)
+
+	chunks, done := resp.chunks(t)
+	if !done {
+		t.Fatal("stream did not end with [DONE]")
+	}
+	usageChunks := 0
+	for _, chunk := range chunks {
+		if _, ok := chunk["usage"]; ok {
+			usageChunks++
+		}
+	}
+	if usageChunks != 1 {
+		t.Errorf("got %d usage chunks, want only the upstream one", usageChunks)
+	}
+}
+
+func TestDispatchStreamStripsUsage(t *testing.T) {
+	req := newTestChatRequest(&proxy.MockConfig{Mode: "fixed", Text: "client did not ask for usage"}, true, true, false)
+	resp := &recordResponder{}
+	dispatch(req, resp)
+
+	chunks, done := resp.chunks(t)
+	if !done {
+		t.Fatal("stream did not end with [DONE]")
+	}
+	for _, chunk := range chunks {
+		if _, ok := chunk["usage"]; ok {
+			t.Errorf("usage chunk forwarded without include_usage: %v", chunk)
+		}
+	}
+	// 去掉 usage 后仍按上游 usage 记录用量
+	if requests, _, _, total := recordedUsage(t, req.User.ID); requests != 1 || total <= 0 {
+		t.Errorf("recorded %d requests / %d tokens, want 1 request with tokens", requests, total)
+	}
+}
+
+func TestDispatchUpstreamError(t *testing.T) {
+	req := newTestChatRequest(&proxy.MockConfig{Mode: "echo", ErrorStatus: 400, ErrorMessage: "bad request"}, true, true, true)
+	resp := &recordResponder{}
+	dispatch(req, resp)
+
+	if resp.started || resp.status < 400 {
+		t.Errorf("status = %d, started = %v, want an error before streaming", resp.status, resp.started)
+	}
+	if detail, _ := resp.errBody["detail"].(string); !strings.Contains(detail, "bad request") {
+		t.Errorf("detail = %v, want the upstream error", resp.errBody["detail"])
+	}
+	if requests, _, _, _ := recordedUsage(t, req.User.ID); requests != 0 {
+		t.Errorf("recorded %d requests for a failed upstream call, want 0", requests)
+	}
+}
+
+func TestDispatchStreamDisconnectRecordsPartialUsage(t *testing.T) {
+	text := strings.Repeat("partial output ", 200)
+	req := newTestChatRequest(&proxy.MockConfig{Mode: "fixed", Text: text}, true, true, true)
+	// Token 限流按预估值预占，断开后应按部分用量修正而不是全部归还
+	reservation := ratelimit.Check{Key: "test:disconnect:tokens", Limit: 100000, Window: time.Hour, Cost: 50000}
+	rateLimiter.Allow([]ratelimit.Check{reservation})
+	req.tokenReservations = []ratelimit.Check{reservation}
+
+	// 每个 chunk 占两行（数据行 + 空行），转发 3 个 chunk 后断开
+	resp := &recordResponder{maxLines: 6}
+	dispatch(req, resp)
+
+	if _, done := resp.chunks(t); done {
+		t.Fatal("stream completed, want a client disconnect")
+	}
+	requests, prompt, completion, total := recordedUsage(t, req.User.ID)
+	if requests != 1 {
+		t.Fatalf("recorded %d requests, want the interrupted request", requests)
+	}
+	if prompt <= 0 || completion <= 0 || completion >= countTextTokens(text) {
+		t.Errorf("recorded in=%d out=%d, want the prompt and only the output generated before the disconnect", prompt, completion)
+	}
+	if req.tokenReservations != nil {
+		t.Error("token reservation was not reconciled")
+	}
+	results, _ := rateLimiter.Allow([]ratelimit.Check{{Key: reservation.Key, Limit: reservation.Limit, Window: reservation.Window}})
+	if want := reservation.Limit - total - 1; results[0].Remaining < want-1 || results[0].Remaining > want {
+		t.Errorf("remaining = %d, want about %d after reconciling %d tokens", results[0].Remaining, want, total)
+	}
+}
+
+func TestDispatchStreamAsNonStreamCancelRecordsPartialUsage(t *testing.T) {
+	req := newTestChatRequest(&proxy.MockConfig{Mode: "fixed", Text: strings.Repeat("slow ", 100), ChunkDelayMs: 5}, false, true, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req.Ctx = ctx
+	resp := &recordResponder{}
+	dispatch(req, resp)
+
+	if resp.result != nil {
+		t.Fatal("wrote a completion for a cancelled request")
+	}
+	if requests, prompt, completion, _ := recordedUsage(t, req.User.ID); requests != 1 || prompt <= 0 || completion <= 0 {
+		t.Errorf("recorded %d requests (in=%d out=%d), want the partial usage of the cancelled request", requests, prompt, completion)
+	}
+}
+
+func countTextTokens(text string) int {
+	var u usageCounter
+	u.output.WriteString(text)
+	_, completion, _ := u.tokens(&chatRequest{ModelName: "mock-echo"})
+	return completion
+}
+
+func TestRecordZeroTokenRequest(t *testing.T) {
+	req := newTestChatRequest(nil, false, false, false)
+	// 被上游拦截的空响应：usage 全为 0 且没有输出，仍需计入请求数
+	u := usageCounter{usage: map[string]interface{}{"prompt_tokens": 0.0, "completion_tokens": 0.0, "total_tokens": 0.0}}
+	u.record(req)
+
+	if requests, _, _, total := recordedUsage(t, req.User.ID); requests != 1 || total != 0 {
+		t.Errorf("recorded %d requests / %d tokens, want 1 request with 0 tokens", requests, total)
+	}
+}
+
+// setCustomErrorRule 启用一条自定义错误响应规则
+func setCustomErrorRule(t *testing.T, keyword string) {
+	t.Helper()
+	db := database.DB()
+	rules, _ := json.Marshal([]CustomErrorRule{{Keyword: keyword, Response: "custom reply"}})
+	db.Exec("INSERT INTO settings (key, value) VALUES ('custom_error_enabled', 'true') ON CONFLICT(key) DO UPDATE SET value = 'true'")
+	db.Exec("INSERT INTO settings (key, value) VALUES ('custom_error_rules', ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value", string(rules))
+	t.Cleanup(func() { db.Exec("DELETE FROM settings WHERE key IN ('custom_error_enabled', 'custom_error_rules')") })
+}
+
+func TestCustomErrorRuleCannotOverrideDenials(t *testing.T) {
+	req := newTestChatRequest(nil, false, false, false)
+	req.Model = &modelInfo{}
+	req.APIKey = &models.GatewayAPIKey{AllowedModels: []string{"other-model"}}
+
+	tests := []struct {
+		keyword string
+		err     *chatError
+		status  int
+	}{
+		{"model_not_allowed", modelAccessStage(req), 403},
+		{"insufficient_balance", insufficientCreditError(0, 1), 402},
+	}
+	for _, tt := range tests {
+		t.Run(tt.keyword, func(t *testing.T) {
+			setCustomErrorRule(t, tt.keyword)
+			if tt.err == nil {
+				t.Fatal("expected a denial")
+			}
+			resp := &recordResponder{}
+			writeChatError(req, resp, tt.err)
+			if resp.status != tt.status || resp.result != nil {
+				t.Errorf("status = %d, result = %v, want the %d denial", resp.status, resp.result, tt.status)
+			}
+		})
+	}
+
+	// 上游和限流错误仍可使用自定义响应
+	setCustomErrorRule(t, "rate_limit_exceeded")
+	resp := &recordResponder{}
+	writeChatError(req, resp, &chatError{Status: 429, Body: gin.H{"detail": "limited"}, Message: "rate_limit_exceeded"})
+	if resp.result == nil {
+		t.Errorf("rate limit error was not replaced by the custom response (status %d)", resp.status)
+	}
+}
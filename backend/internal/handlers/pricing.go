@@ -0,0 +1,340 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"vte/internal/database"
+	"vte/internal/logger"
+	"vte/internal/models"
+)
+
+// defaultTokenRetentionDays token_usage 记录默认保留天数
+const defaultTokenRetentionDays = 90
+
+// modelPriceColumns model_prices 的查询列，与 scanModelPrice 对应
+const modelPriceColumns = `id, model_name, input_price, cached_input_price, output_price, image_price, second_price,
+	COALESCE(max_output_tokens, 0), updated_at`
+
+func scanModelPrice(row interface{ Scan(...interface{}) error }) (models.ModelPrice, error) {
+	var p models.ModelPrice
+	err := row.Scan(&p.ID, &p.ModelName, &p.InputPrice, &p.CachedInputPrice, &p.OutputPrice,
+		&p.ImagePrice, &p.SecondPrice, &p.MaxOutputTokens, &p.UpdatedAt)
+	return p, err
+}
+
+// queryModelPrices 按条件读取模型价格
+func queryModelPrices(where string, args ...interface{}) ([]models.ModelPrice, error) {
+	rows, err := database.DB().Query("SELECT "+modelPriceColumns+" FROM model_prices "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prices := []models.ModelPrice{}
+	for rows.Next() {
+		if p, err := scanModelPrice(rows); err == nil {
+			prices = append(prices, p)
+		}
+	}
+	return prices, nil
+}
+
+// loadModelPrices 读取所有模型价格
+func loadModelPrices() ([]models.ModelPrice, error) {
+	return queryModelPrices("ORDER BY model_name")
+}
+
+// findModelPrice 查找模型的价格：精确匹配优先，其次是最长的通配符模式，都没有时使用默认单价
+// 每次请求都会调用，只按索引查询精确匹配和通配符模式，不读取整张价格表
+func findModelPrice(modelName string) models.ModelPrice {
+	row := database.DB().QueryRow("SELECT "+modelPriceColumns+" FROM model_prices WHERE model_name = ? COLLATE NOCASE LIMIT 1", modelName)
+	if p, err := scanModelPrice(row); err == nil {
+		return p
+	}
+
+	patterns, _ := queryModelPrices("WHERE instr(model_name, '*') > 0")
+	var best *models.ModelPrice
+	for i := range patterns {
+		p := &patterns[i]
+		if !models.MatchModelPattern(p.ModelName, modelName) {
+			continue
+		}
+		if best == nil || len(p.ModelName) > len(best.ModelName) {
+			best = p
+		}
+	}
+	if best != nil {
+		return *best
+	}
+
+	inputPrice, outputPrice := getQuotaPrices()
+	return models.ModelPrice{InputPrice: inputPrice, OutputPrice: outputPrice}
+}
+
+// calculateCost 按模型价格计算一次请求的费用（美元）
+func calculateCost(usage *models.TokenUsage) float64 {
+	price := findModelPrice(usage.ModelName)
+
+	cachedTokens := min(usage.CachedTokens, usage.PromptTokens)
+	cachedPrice := price.CachedInputPrice
+	if cachedPrice <= 0 {
+		cachedPrice = price.InputPrice
+	}
+
+	cost := (float64(usage.PromptTokens-cachedTokens)*price.InputPrice +
+		float64(cachedTokens)*cachedPrice +
+		float64(usage.CompletionTokens)*price.OutputPrice) / 1e6
+	cost += float64(usage.ImageCount) * price.ImagePrice
+	cost += usage.Duration * price.SecondPrice
+	return cost
+}
+
+// parseCachedTokens 从 usage 中读取命中缓存的输入 token 数
+func parseCachedTokens(usage map[string]interface{}) int {
+	if details, ok := usage["prompt_tokens_details"].(map[string]interface{}); ok {
+		if cached, ok := details["cached_tokens"].(float64); ok {
+			return int(cached)
+		}
+	}
+	return 0
+}
+
+// countImages 统计请求消息中的图片数
+func countImages(payload map[string]interface{}) int {
+	messages, _ := payload["messages"].([]interface{})
+	count := 0
+	for _, msg := range messages {
+		m, _ := msg.(map[string]interface{})
+		parts, _ := m["content"].([]interface{})
+		for _, part := range parts {
+			if p, ok := part.(map[string]interface{}); ok && p["type"] == "image_url" {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func validModelPrice(req *models.ModelPriceRequest) bool {
+	return strings.TrimSpace(req.ModelName) != "" &&
+		req.InputPrice >= 0 && req.CachedInputPrice >= 0 && req.OutputPrice >= 0 &&
+		req.ImagePrice >= 0 && req.SecondPrice >= 0 && req.MaxOutputTokens >= 0
+}
+
+// ListModelPrices 获取模型价格列表
+func ListModelPrices(c *gin.Context) {
+	prices, err := loadModelPrices()
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "查询失败"})
+		return
+	}
+	inputPrice, outputPrice := getQuotaPrices()
+	c.JSON(200, gin.H{
+		"prices": prices,
+		"default": gin.H{
+			"input_price":  inputPrice,
+			"output_price": outputPrice,
+		},
+	})
+}
+
+// CreateModelPrice 添加模型价格
+func CreateModelPrice(c *gin.Context) {
+	var req models.ModelPriceRequest
+	if err := c.ShouldBindJSON(&req); err != nil || !validModelPrice(&req) {
+		c.JSON(400, gin.H{"detail": "无效的请求"})
+		return
+	}
+	req.ModelName = strings.TrimSpace(req.ModelName)
+
+	result, err := database.DB().Exec(`
+		INSERT INTO model_prices (model_name, input_price, cached_input_price, output_price, image_price, second_price, max_output_tokens)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, req.ModelName, req.InputPrice, req.CachedInputPrice, req.OutputPrice, req.ImagePrice, req.SecondPrice, req.MaxOutputTokens)
+	if err != nil {
+		c.JSON(400, gin.H{"detail": "该模型的价格已存在"})
+		return
+	}
+
+	id, _ := result.LastInsertId()
+	logger.Info(fmt.Sprintf("%s | 添加模型价格 | %s", c.ClientIP(), req.ModelName))
+	c.JSON(200, gin.H{"message": "价格已添加", "id": id})
+}
+
+// UpdateModelPrice 更新模型价格
+func UpdateModelPrice(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"detail": "无效的价格ID"})
+		return
+	}
+
+	var req models.ModelPriceRequest
+	if err := c.ShouldBindJSON(&req); err != nil || !validModelPrice(&req) {
+		c.JSON(400, gin.H{"detail": "无效的请求"})
+		return
+	}
+	req.ModelName = strings.TrimSpace(req.ModelName)
+
+	result, err := database.DB().Exec(`
+		UPDATE model_prices SET model_name = ?, input_price = ?, cached_input_price = ?, output_price = ?,
+			image_price = ?, second_price = ?, max_output_tokens = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, req.ModelName, req.InputPrice, req.CachedInputPrice, req.OutputPrice, req.ImagePrice, req.SecondPrice, req.MaxOutputTokens, id)
+	if err != nil {
+		c.JSON(400, gin.H{"detail": "该模型的价格已存在"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(404, gin.H{"detail": "价格不存在"})
+		return
+	}
+
+	logger.Info(fmt.Sprintf("%s | 更新模型价格 | %s", c.ClientIP(), req.ModelName))
+	c.JSON(200, gin.H{"message": "价格已更新"})
+}
+
+// DeleteModelPrice 删除模型价格
+func DeleteModelPrice(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"detail": "无效的价格ID"})
+		return
+	}
+
+	db := database.DB()
+	var modelName string
+	if err := db.QueryRow("SELECT model_name FROM model_prices WHERE id = ?", id).Scan(&modelName); err != nil {
+		c.JSON(404, gin.H{"detail": "价格不存在"})
+		return
+	}
+	db.Exec("DELETE FROM model_prices WHERE id = ?", id)
+
+	logger.Info(fmt.Sprintf("%s | 删除模型价格 | %s", c.ClientIP(), modelName))
+	c.JSON(200, gin.H{"message": "价格已删除"})
+}
+
+// GetSpendStats 按模型、提供商和用户统计费用
+// start / end 为北京时间日期（YYYY-MM-DD，包含 end 当天），默认最近 7 天
+func GetSpendStats(c *gin.Context) {
+	now := GetBeijingTime()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, beijingLoc)
+	start := today.AddDate(0, 0, -6)
+	end := today
+	if s := c.Query("start"); s != "" {
+		t, err := time.ParseInLocation("2006-01-02", s, beijingLoc)
+		if err != nil {
+			c.JSON(400, gin.H{"detail": "无效的开始日期"})
+			return
+		}
+		start = t
+	}
+	if e := c.Query("end"); e != "" {
+		t, err := time.ParseInLocation("2006-01-02", e, beijingLoc)
+		if err != nil {
+			c.JSON(400, gin.H{"detail": "无效的结束日期"})
+			return
+		}
+		end = t
+	}
+	if end.Before(start) {
+		c.JSON(400, gin.H{"detail": "结束日期不能早于开始日期"})
+		return
+	}
+
+	where := "t.created_at >= ? AND t.created_at < ?"
+	args := []interface{}{
+		start.UTC().Format("2006-01-02 15:04:05"),
+		end.AddDate(0, 0, 1).UTC().Format("2006-01-02 15:04:05"),
+	}
+	if userID, _ := strconv.Atoi(c.Query("user_id")); userID > 0 {
+		where += " AND t.user_id = ?"
+		args = append(args, userID)
+	}
+
+	byModel, err := querySpendStats("t.model_name", where, args)
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "查询统计失败"})
+		return
+	}
+	byProvider, _ := querySpendStats("t.provider_name", where, args)
+	byUser, _ := querySpendStats("COALESCE(u.username, '未知用户')", where, args)
+
+	var total models.SpendStats
+	for _, s := range byModel {
+		total.RequestCount += s.RequestCount
+		total.TotalTokens += s.TotalTokens
+		total.Cost += s.Cost
+	}
+
+	c.JSON(200, gin.H{
+		"start":         start.Format("2006-01-02"),
+		"end":           end.Format("2006-01-02"),
+		"total_cost":    total.Cost,
+		"total_tokens":  total.TotalTokens,
+		"request_count": total.RequestCount,
+		"by_model":      byModel,
+		"by_provider":   byProvider,
+		"by_user":       byUser,
+	})
+}
+
+// querySpendStats 按 groupBy 汇总 token_usage，按费用降序
+func querySpendStats(groupBy, where string, args []interface{}) ([]models.SpendStats, error) {
+	rows, err := database.DB().Query(`
+		SELECT `+groupBy+` AS name, COUNT(*), COALESCE(SUM(t.total_tokens), 0), COALESCE(SUM(t.cost), 0)
+		FROM token_usage t
+		LEFT JOIN users u ON t.user_id = u.id
+		WHERE `+where+`
+		GROUP BY name
+		ORDER BY 4 DESC, 3 DESC
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []models.SpendStats{}
+	for rows.Next() {
+		var s models.SpendStats
+		rows.Scan(&s.Name, &s.RequestCount, &s.TotalTokens, &s.Cost)
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+// getTokenRetentionDays 获取 token 使用记录的保留天数
+func getTokenRetentionDays() int {
+	var value string
+	database.DB().QueryRow("SELECT value FROM settings WHERE key = 'token_usage_retention_days'").Scan(&value)
+	if days, err := strconv.Atoi(value); err == nil && days > 0 {
+		return days
+	}
+	return defaultTokenRetentionDays
+}
+
+// GetTokenRetentionSettings 获取 token 使用记录的保留天数
+func GetTokenRetentionSettings(c *gin.Context) {
+	c.JSON(200, gin.H{"days": getTokenRetentionDays()})
+}
+
+// SetTokenRetentionSettings 设置 token 使用记录的保留天数，费用统计和每月配额依赖这些记录
+func SetTokenRetentionSettings(c *gin.Context) {
+	var req struct {
+		Days int `json:"days"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Days < 32 {
+		c.JSON(400, gin.H{"detail": "保留天数不能少于 32 天"})
+		return
+	}
+
+	value := strconv.Itoa(req.Days)
+	database.DB().Exec(`INSERT INTO settings (key, value) VALUES ('token_usage_retention_days', ?) ON CONFLICT(key) DO UPDATE SET value = ?`, value, value)
+
+	logger.Info(fmt.Sprintf("%s | 更新记录保留天数 | %d", c.ClientIP(), req.Days))
+	c.JSON(200, gin.H{"message": "设置已更新"})
+}
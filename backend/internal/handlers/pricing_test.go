@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+
+	"vte/internal/database"
+)
+
+func TestFindModelPrice(t *testing.T) {
+	db := database.DB()
+	for name, price := range map[string]float64{"price-gpt-4o": 1, "price-gpt-*": 2, "price-gpt-4*": 3} {
+		if _, err := db.Exec("INSERT INTO model_prices (model_name, input_price) VALUES (?, ?)", name, price); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() { db.Exec("DELETE FROM model_prices WHERE model_name LIKE 'price-%'") })
+
+	defaultPrice, _ := getQuotaPrices()
+	for model, want := range map[string]float64{
+		"price-gpt-4o":   1,
+		"PRICE-GPT-4O":   1,
+		"price-gpt-4.1":  3,
+		"price-gpt-3.5":  2,
+		"price-claude-3": defaultPrice,
+	} {
+		if got := findModelPrice(model).InputPrice; got != want {
+			t.Errorf("findModelPrice(%q).InputPrice = %v, want %v", model, got, want)
+		}
+	}
+}
+
+func TestFindModelPriceUsesIndexes(t *testing.T) {
+	for query, index := range map[string]string{
+		"SELECT id FROM model_prices WHERE model_name = 'x' COLLATE NOCASE LIMIT 1": "idx_model_prices_name_nocase",
+		"SELECT id FROM model_prices WHERE instr(model_name, '*') > 0":              "idx_model_prices_pattern",
+	} {
+		rows, err := database.DB().Query("EXPLAIN QUERY PLAN " + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var plan []string
+		for rows.Next() {
+			var id, parent, unused int
+			var detail string
+			rows.Scan(&id, &parent, &unused, &detail)
+			plan = append(plan, detail)
+		}
+		rows.Close()
+		if !strings.Contains(strings.Join(plan, "; "), index) {
+			t.Errorf("%s: plan %v does not use %s", query, plan, index)
+		}
+	}
+}
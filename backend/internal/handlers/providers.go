@@ -11,13 +11,14 @@ import (
 	"vte/internal/logger"
 	"vte/internal/models"
 	"vte/internal/proxy"
+	"vte/internal/secret"
 )
 
 func ListProviders(c *gin.Context) {
 	db := database.DB()
 	rows, err := db.Query(`
 		SELECT id, name, base_url, model_prefix, provider_type, 
-		       vertex_project, vertex_location, is_active, created_at 
+		       vertex_project, vertex_location, COALESCE(mock_config, ''), is_active, created_at 
 		FROM providers
 	`)
 	if err != nil {
@@ -32,7 +33,7 @@ func ListProviders(c *gin.Context) {
 		var isActive int
 		var vertexProject, vertexLocation *string
 		err := rows.Scan(&p.ID, &p.Name, &p.BaseURL, &p.ModelPrefix, &p.ProviderType,
-			&vertexProject, &vertexLocation, &isActive, &p.CreatedAt)
+			&vertexProject, &vertexLocation, &p.MockConfig, &isActive, &p.CreatedAt)
 		if err != nil {
 			continue
 		}
@@ -59,17 +60,27 @@ func CreateProvider(c *gin.Context) {
 	if req.ProviderType == "" {
 		req.ProviderType = "standard"
 	}
+	if req.APIKey == "" && req.ProviderType != proxy.ProviderTypeMock {
+		c.JSON(400, gin.H{"detail": "请填写 API Key"})
+		return
+	}
 	if req.VertexLocation == "" {
 		req.VertexLocation = "global"
 	}
 
+	encryptedKey, err := secret.Encrypt(req.APIKey)
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "加密密钥失败"})
+		return
+	}
+
 	db := database.DB()
 	result, err := db.Exec(`
 		INSERT INTO providers (name, base_url, api_key, model_prefix, provider_type, 
-		                       vertex_project, vertex_location, extra_headers, proxy_url)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		                       vertex_project, vertex_location, extra_headers, proxy_url, mock_config)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`, req.Name, req.BaseURL, "", req.ModelPrefix, req.ProviderType,
-		req.VertexProject, req.VertexLocation, req.ExtraHeaders, req.ProxyURL)
+		req.VertexProject, req.VertexLocation, req.ExtraHeaders, req.ProxyURL, req.MockConfig)
 
 	if err != nil {
 		c.JSON(500, gin.H{"detail": "创建失败"})
@@ -81,9 +92,9 @@ func CreateProvider(c *gin.Context) {
 	// 将 API Key 添加到 provider_api_keys 表
 	if req.APIKey != "" {
 		db.Exec(`
-			INSERT INTO provider_api_keys (provider_id, api_key, name)
-			VALUES (?, ?, ?)
-		`, id, req.APIKey, "密钥 1")
+			INSERT INTO provider_api_keys (provider_id, api_key, key_hint, name)
+			VALUES (?, ?, ?, ?)
+		`, id, encryptedKey, secret.Hint(req.APIKey), "密钥 1")
 	}
 
 	logger.Info(fmt.Sprintf("%s | 添加提供商 | %s", c.ClientIP(), req.Name))
@@ -96,6 +107,7 @@ func CreateProvider(c *gin.Context) {
 		"provider_type":   req.ProviderType,
 		"vertex_project":  req.VertexProject,
 		"vertex_location": req.VertexLocation,
+		"mock_config":     req.MockConfig,
 		"is_active":       true,
 	})
 }
@@ -138,8 +150,13 @@ func UpdateProvider(c *gin.Context) {
 		args = append(args, *req.BaseURL)
 	}
 	if req.APIKey != nil && *req.APIKey != "" {
+		encryptedKey, err := secret.Encrypt(*req.APIKey)
+		if err != nil {
+			c.JSON(500, gin.H{"detail": "加密密钥失败"})
+			return
+		}
 		updates = append(updates, "api_key = ?")
-		args = append(args, *req.APIKey)
+		args = append(args, encryptedKey)
 	}
 	if req.ModelPrefix != nil {
 		updates = append(updates, "model_prefix = ?")
@@ -165,6 +182,10 @@ func UpdateProvider(c *gin.Context) {
 		updates = append(updates, "proxy_url = ?")
 		args = append(args, *req.ProxyURL)
 	}
+	if req.MockConfig != nil {
+		updates = append(updates, "mock_config = ?")
+		args = append(args, *req.MockConfig)
+	}
 	if req.IsActive != nil {
 		active := 0
 		if *req.IsActive {
@@ -248,13 +269,13 @@ func FetchModels(c *gin.Context) {
 	}
 	db := database.DB()
 
-	var baseURL, apiKey, providerType, modelPrefix, proxyURL, name string
+	var baseURL, apiKey, providerType, modelPrefix, proxyURL, name, mockConfig string
 	var extraHeaders *string
 	err = db.QueryRow(`
 		SELECT name, base_url, api_key, provider_type, model_prefix, 
-		       COALESCE(proxy_url, ''), extra_headers 
+		       COALESCE(proxy_url, ''), extra_headers, COALESCE(mock_config, '') 
 		FROM providers WHERE id = ?
-	`, id).Scan(&name, &baseURL, &apiKey, &providerType, &modelPrefix, &proxyURL, &extraHeaders)
+	`, id).Scan(&name, &baseURL, &apiKey, &providerType, &modelPrefix, &proxyURL, &extraHeaders, &mockConfig)
 	if err != nil {
 		c.JSON(404, gin.H{"detail": "提供商不存在"})
 		return
@@ -267,12 +288,21 @@ func FetchModels(c *gin.Context) {
 		}
 	}
 
+	apiKey, err = secret.Decrypt(apiKey)
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "解密密钥失败"})
+		return
+	}
+
 	cfg := &proxy.ProviderConfig{
 		BaseURL:      baseURL,
 		APIKey:       apiKey,
 		ProviderType: providerType,
 		ProxyURL:     proxyURL,
 	}
+	if providerType == proxy.ProviderTypeMock {
+		cfg.Mock = proxy.ParseMockConfig(mockConfig)
+	}
 
 	if extraHeaders != nil && *extraHeaders != "" {
 		json.Unmarshal([]byte(*extraHeaders), &cfg.ExtraHeaders)
@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"vte/internal/auth"
+	"vte/internal/database"
+	"vte/internal/logger"
+	"vte/internal/models"
+)
+
+// GetCurrentMonthStart 获取当前自然月的开始时间（北京时间）
+func GetCurrentMonthStart() time.Time {
+	now := GetBeijingTime()
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, beijingLoc)
+}
+
+// getQuotaPrices 获取默认单价（美元 / 百万 token），用于未在模型价格表中配置的模型
+func getQuotaPrices() (inputPrice, outputPrice float64) {
+	db := database.DB()
+	var input, output string
+	db.QueryRow("SELECT value FROM settings WHERE key = 'quota_input_price'").Scan(&input)
+	db.QueryRow("SELECT value FROM settings WHERE key = 'quota_output_price'").Scan(&output)
+	inputPrice, _ = strconv.ParseFloat(input, 64)
+	outputPrice, _ = strconv.ParseFloat(output, 64)
+	return inputPrice, outputPrice
+}
+
+// quotaPeriodStatus 一个周期内的配额使用情况，Remaining 中不限制的项为 -1
+type quotaPeriodStatus struct {
+	Limit     models.QuotaLimit `json:"limit"`
+	Used      models.QuotaLimit `json:"used"`
+	Remaining models.QuotaLimit `json:"remaining"`
+	ResetAt   time.Time         `json:"reset_at"`
+}
+
+// quotaStatus 用户或网关密钥的配额使用情况，未设置的周期为 nil
+type quotaStatus struct {
+	Daily   *quotaPeriodStatus `json:"daily,omitempty"`
+	Monthly *quotaPeriodStatus `json:"monthly,omitempty"`
+}
+
+// loadUserQuota 读取用户的配额，未设置时返回 nil
+func loadUserQuota(userID int) *models.Quota {
+	var raw string
+	database.DB().QueryRow("SELECT COALESCE(quota, '') FROM users WHERE id = ?", userID).Scan(&raw)
+	return auth.ParseQuota(raw)
+}
+
+// getQuotaStatus 统计配额使用情况，column 为 token_usage 中的 user_id 或 api_key_id
+func getQuotaStatus(quota *models.Quota, column string, id int) *quotaStatus {
+	if quota.IsZero() {
+		return nil
+	}
+	dayStart := GetCurrentPeriodStart()
+	monthStart := GetCurrentMonthStart()
+	return &quotaStatus{
+		Daily:   getQuotaPeriodStatus(quota.Daily, column, id, dayStart, dayStart.Add(24*time.Hour)),
+		Monthly: getQuotaPeriodStatus(quota.Monthly, column, id, monthStart, monthStart.AddDate(0, 1, 0)),
+	}
+}
+
+func getQuotaPeriodStatus(limit models.QuotaLimit, column string, id int, start, resetAt time.Time) *quotaPeriodStatus {
+	if limit.IsZero() {
+		return nil
+	}
+
+	var used models.QuotaLimit
+	database.DB().QueryRow(
+		"SELECT COALESCE(SUM(total_tokens), 0), COUNT(*), COALESCE(SUM(cost), 0) FROM token_usage WHERE "+column+" = ? AND created_at >= ?",
+		id, start.UTC().Format("2006-01-02 15:04:05"),
+	).Scan(&used.Tokens, &used.Requests, &used.Cost)
+
+	remaining := models.QuotaLimit{Tokens: -1, Requests: -1, Cost: -1}
+	if limit.Tokens > 0 {
+		remaining.Tokens = max(limit.Tokens-used.Tokens, 0)
+	}
+	if limit.Requests > 0 {
+		remaining.Requests = max(limit.Requests-used.Requests, 0)
+	}
+	if limit.Cost > 0 {
+		remaining.Cost = math.Max(limit.Cost-used.Cost, 0)
+	}
+	return &quotaPeriodStatus{Limit: limit, Used: used, Remaining: remaining, ResetAt: resetAt}
+}
+
+// exhausted 返回已用尽的配额项名称，未用尽时返回空字符串
+func (s *quotaPeriodStatus) exhausted() string {
+	switch {
+	case s.Remaining.Tokens == 0:
+		return "Token"
+	case s.Remaining.Requests == 0:
+		return "请求次数"
+	case s.Remaining.Cost == 0:
+		return "费用"
+	}
+	return ""
+}
+
+// quotaStage 检查用户和网关密钥的每日/每月配额，并通过响应头返回剩余配额
+func quotaStage(req *chatRequest) *chatError {
+	type owner struct {
+		label  string
+		status *quotaStatus
+	}
+	owners := []owner{{"用户", getQuotaStatus(loadUserQuota(req.User.ID), "user_id", req.User.ID)}}
+	if req.APIKey != nil {
+		owners = append(owners, owner{"API Key", getQuotaStatus(req.APIKey.Quota, "api_key_id", req.APIKey.ID)})
+	}
+
+	// 同时设置了用户和密钥配额时，响应头取两者中较小的剩余量
+	remaining := map[string]float64{}
+	setRemaining := func(name string, value float64) {
+		if value < 0 {
+			return
+		}
+		if current, ok := remaining[name]; !ok || value < current {
+			remaining[name] = value
+		}
+	}
+
+	var exceeded *chatError
+	for _, o := range owners {
+		if o.status == nil {
+			continue
+		}
+		for _, p := range []struct {
+			name   string
+			label  string
+			status *quotaPeriodStatus
+		}{{"Daily", "每日", o.status.Daily}, {"Monthly", "每月", o.status.Monthly}} {
+			if p.status == nil {
+				continue
+			}
+			setRemaining("X-Quota-"+p.name+"-Remaining-Tokens", float64(p.status.Remaining.Tokens))
+			// 请求次数扣除本次请求
+			if p.status.Remaining.Requests > 0 {
+				setRemaining("X-Quota-"+p.name+"-Remaining-Requests", float64(p.status.Remaining.Requests-1))
+			} else {
+				setRemaining("X-Quota-"+p.name+"-Remaining-Requests", float64(p.status.Remaining.Requests))
+			}
+			setRemaining("X-Quota-"+p.name+"-Remaining-Cost", p.status.Remaining.Cost)
+
+			if what := p.status.exhausted(); what != "" && exceeded == nil {
+				errMsg := fmt.Sprintf("已用尽%s的%s%s配额，将于 %s 重置", o.label, p.label, what,
+					p.status.ResetAt.Format("2006-01-02 15:04"))
+				exceeded = &chatError{
+					Status: 429,
+					Body: gin.H{
+						"error": gin.H{
+							"message": errMsg,
+							"type":    "insufficient_quota",
+							"code":    "insufficient_quota",
+						},
+					},
+					Reason: fmt.Sprintf("%s%s%s配额用尽", o.label, p.label, what),
+				}
+			}
+		}
+	}
+
+	for name, value := range remaining {
+		if strings.HasSuffix(name, "Cost") {
+			req.setHeader(name, strconv.FormatFloat(value, 'f', 4, 64))
+		} else {
+			req.setHeader(name, strconv.FormatFloat(value, 'f', 0, 64))
+		}
+	}
+	return exceeded
+}
+
+// GetQuotaPriceSettings 获取默认单价
+func GetQuotaPriceSettings(c *gin.Context) {
+	inputPrice, outputPrice := getQuotaPrices()
+	c.JSON(200, gin.H{
+		"input_price":  inputPrice,
+		"output_price": outputPrice,
+	})
+}
+
+// SetQuotaPriceSettings 设置默认单价（美元 / 百万 token）
+func SetQuotaPriceSettings(c *gin.Context) {
+	var req models.QuotaPriceRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.InputPrice < 0 || req.OutputPrice < 0 {
+		c.JSON(400, gin.H{"detail": "无效的请求"})
+		return
+	}
+
+	db := database.DB()
+	input := strconv.FormatFloat(req.InputPrice, 'f', -1, 64)
+	output := strconv.FormatFloat(req.OutputPrice, 'f', -1, 64)
+	db.Exec(`INSERT INTO settings (key, value) VALUES ('quota_input_price', ?) ON CONFLICT(key) DO UPDATE SET value = ?`, input, input)
+	db.Exec(`INSERT INTO settings (key, value) VALUES ('quota_output_price', ?) ON CONFLICT(key) DO UPDATE SET value = ?`, output, output)
+
+	logger.Info(fmt.Sprintf("%s | 更新默认单价 | 输入=%s 输出=%s", c.ClientIP(), input, output))
+	c.JSON(200, gin.H{"message": "设置已更新"})
+}
@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"testing"
+
+	"vte/internal/database"
+	"vte/internal/models"
+)
+
+func TestQuotaDenialIgnoresCustomErrorRules(t *testing.T) {
+	req := newTestChatRequest(nil, false, false, false)
+	req.APIKey = &models.GatewayAPIKey{ID: 1000 + req.User.ID, Quota: &models.Quota{Daily: models.QuotaLimit{Requests: 1}}}
+	if _, err := database.DB().Exec("INSERT INTO token_usage (user_id, api_key_id, model_name, provider_name, total_tokens) VALUES (?, ?, 'mock-echo', 'mock', 10)",
+		req.User.ID, req.APIKey.ID); err != nil {
+		t.Fatalf("record usage: %v", err)
+	}
+
+	e := quotaStage(req)
+	if e == nil || e.Status != 429 {
+		t.Fatalf("quotaStage = %+v, want a 429 quota denial", e)
+	}
+
+	// 匹配 insufficient_quota 的自定义规则不能把配额拒绝改写为正常响应
+	setCustomErrorRule(t, "insufficient_quota")
+	resp := &recordResponder{}
+	writeChatError(req, resp, e)
+	if resp.status != 429 || resp.result != nil {
+		t.Errorf("status = %d, result = %v, want the 429 quota denial", resp.status, resp.result)
+	}
+}
@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"vte/internal/auth"
+	"vte/internal/logger"
+	"vte/internal/models"
+)
+
+// issueSession 登录成功后创建会话并签发访问令牌和刷新令牌
+func issueSession(c *gin.Context, user *models.User) (models.TokenResponse, error) {
+	sid, refreshToken, err := auth.CreateSession(user.ID, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		return models.TokenResponse{}, err
+	}
+	token, err := auth.GenerateToken(user.Username, sid)
+	if err != nil {
+		return models.TokenResponse{}, err
+	}
+	return models.TokenResponse{
+		AccessToken:  token,
+		RefreshToken: refreshToken,
+		TokenType:    "bearer",
+		ExpiresIn:    int(auth.AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+// currentSessionID 当前请求所属的会话，通过网关密钥访问时为空
+func currentSessionID(c *gin.Context) string {
+	sid, _ := c.Get("session_id")
+	s, _ := sid.(string)
+	return s
+}
+
+// RefreshToken 用刷新令牌换取新的访问令牌，刷新令牌同时轮换
+func RefreshToken(c *gin.Context) {
+	var req models.RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"detail": "无效的请求"})
+		return
+	}
+
+	userID, sid, refreshToken, err := auth.RefreshSession(req.RefreshToken, c.ClientIP(), c.Request.UserAgent())
+	if err == auth.ErrRefreshReused {
+		logger.Warn(fmt.Sprintf("%s | 刷新令牌被重复使用，已吊销会话 | 用户 %d", c.ClientIP(), userID))
+	}
+	if err != nil {
+		c.JSON(401, gin.H{"detail": "登录已失效，请重新登录"})
+		return
+	}
+
+	user, err := auth.GetUserByID(userID)
+	if err != nil || !user.IsActive {
+		auth.RevokeSession(userID, sid)
+		c.JSON(401, gin.H{"detail": "用户不存在或已禁用"})
+		return
+	}
+
+	token, err := auth.GenerateToken(user.Username, sid)
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "生成令牌失败"})
+		return
+	}
+	c.JSON(200, models.TokenResponse{
+		AccessToken:  token,
+		RefreshToken: refreshToken,
+		TokenType:    "bearer",
+		ExpiresIn:    int(auth.AccessTokenTTL.Seconds()),
+	})
+}
+
+// Logout 退出当前会话
+func Logout(c *gin.Context) {
+	user := c.MustGet("user").(*models.User)
+	if sid := currentSessionID(c); sid != "" {
+		auth.RevokeSession(user.ID, sid)
+	}
+	c.JSON(200, gin.H{"message": "已退出登录"})
+}
+
+// LogoutAll 退出所有设备上的会话，包括当前会话
+func LogoutAll(c *gin.Context) {
+	user := c.MustGet("user").(*models.User)
+	n := auth.RevokeUserSessions(user.ID, "")
+
+	logger.Info(fmt.Sprintf("%s | 退出所有设备 | %s | %d 个会话", c.ClientIP(), user.Username, n))
+	c.JSON(200, gin.H{"message": "已退出所有设备", "revoked": n})
+}
+
+// ListMySessions 列出当前用户的登录会话
+func ListMySessions(c *gin.Context) {
+	user := c.MustGet("user").(*models.User)
+	sessions, err := auth.ListSessions(user.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "查询失败"})
+		return
+	}
+	current := currentSessionID(c)
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current
+	}
+	c.JSON(200, sessions)
+}
+
+// RevokeMySession 退出当前用户的某个会话
+func RevokeMySession(c *gin.Context) {
+	user := c.MustGet("user").(*models.User)
+	if !auth.RevokeSession(user.ID, c.Param("sid")) {
+		c.JSON(404, gin.H{"detail": "会话不存在"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "会话已退出"})
+}
+
+// ListUserSessions 管理员查看用户的登录会话
+func ListUserSessions(c *gin.Context) {
+	target, ok := loadTargetUser(c)
+	if !ok {
+		return
+	}
+	sessions, err := auth.ListSessions(target.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "查询失败"})
+		return
+	}
+	c.JSON(200, sessions)
+}
+
+// RevokeUserSessions 管理员让用户在所有设备上退出登录
+func RevokeUserSessions(c *gin.Context) {
+	target, ok := loadTargetUser(c)
+	if !ok {
+		return
+	}
+
+	n := auth.RevokeUserSessions(target.ID, "")
+
+	operator := c.MustGet("user").(*models.User)
+	logger.Info(fmt.Sprintf("%s | 强制下线 | %s | %d 个会话 | 操作者: %s", c.ClientIP(), target.Username, n, operator.Username))
+	c.JSON(200, gin.H{"message": "已强制下线", "revoked": n})
+}
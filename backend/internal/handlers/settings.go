@@ -372,8 +372,10 @@ func SetCustomRateLimitRules(c *gin.Context) {
 			ProviderID  int    `json:"provider_id"`
 			ModelName   string `json:"model_name"`
 			MaxRequests int    `json:"max_requests"`
+			MaxTokens   int    `json:"max_tokens"`
 			Window      int    `json:"window"`
 			Enabled     bool   `json:"enabled"`
+			Scope       string `json:"scope"`
 		} `json:"rules"`
 	}
 	
@@ -381,6 +383,14 @@ func SetCustomRateLimitRules(c *gin.Context) {
 		c.JSON(400, gin.H{"detail": "无效的请求"})
 		return
 	}
+	for _, rule := range req.Rules {
+		switch rule.Scope {
+		case "", rateLimitScopeUser, rateLimitScopeAPIKey, rateLimitScopeIP:
+		default:
+			c.JSON(400, gin.H{"detail": fmt.Sprintf("未知的计数范围: %s", rule.Scope)})
+			return
+		}
+	}
 	
 	rulesJSON, _ := json.Marshal(req.Rules)
 	
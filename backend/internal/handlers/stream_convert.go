@@ -0,0 +1,325 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// completionAggregator 将流式 chunk 聚合为完整的 chat.completion
+type completionAggregator struct {
+	id                string
+	model             string
+	created           interface{}
+	systemFingerprint interface{}
+	choices           map[int]*aggregatedChoice
+	usage             map[string]interface{}
+}
+
+// aggregatedChoice 聚合中的单个 choice
+type aggregatedChoice struct {
+	role         string
+	content      strings.Builder
+	reasoning    strings.Builder
+	hasContent   bool
+	hasReasoning bool
+	toolCalls    map[int]*aggregatedToolCall
+	finishReason interface{}
+}
+
+// aggregatedToolCall 聚合中的单个工具调用，arguments 按片段拼接
+type aggregatedToolCall struct {
+	id        string
+	callType  string
+	name      string
+	arguments strings.Builder
+}
+
+// newCompletionAggregator model 为上游 chunk 未携带模型名时使用的默认值
+func newCompletionAggregator(model string) *completionAggregator {
+	return &completionAggregator{model: model, choices: make(map[int]*aggregatedChoice)}
+}
+
+// add 合并一个流式 chunk
+func (a *completionAggregator) add(chunk map[string]interface{}) {
+	if id, ok := chunk["id"].(string); ok && a.id == "" {
+		a.id = id
+	}
+	if model, ok := chunk["model"].(string); ok && model != "" {
+		a.model = model
+	}
+	if created, ok := chunk["created"]; ok && a.created == nil {
+		a.created = created
+	}
+	if fp, ok := chunk["system_fingerprint"]; ok && fp != nil {
+		a.systemFingerprint = fp
+	}
+	if usage, ok := chunk["usage"].(map[string]interface{}); ok {
+		a.usage = usage
+	}
+
+	choices, _ := chunk["choices"].([]interface{})
+	for _, c := range choices {
+		choice, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		index := 0
+		if idx, ok := choice["index"].(float64); ok {
+			index = int(idx)
+		}
+		agg := a.choices[index]
+		if agg == nil {
+			agg = &aggregatedChoice{toolCalls: make(map[int]*aggregatedToolCall)}
+			a.choices[index] = agg
+		}
+		if reason, ok := choice["finish_reason"]; ok && reason != nil {
+			agg.finishReason = reason
+		}
+
+		delta, ok := choice["delta"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if role, ok := delta["role"].(string); ok && role != "" {
+			agg.role = role
+		}
+		if content, ok := delta["content"].(string); ok {
+			agg.content.WriteString(content)
+			agg.hasContent = true
+		}
+		if reasoning, ok := delta["reasoning_content"].(string); ok {
+			agg.reasoning.WriteString(reasoning)
+			agg.hasReasoning = true
+		}
+
+		toolCalls, _ := delta["tool_calls"].([]interface{})
+		for i, tc := range toolCalls {
+			call, ok := tc.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			tcIndex := i
+			if idx, ok := call["index"].(float64); ok {
+				tcIndex = int(idx)
+			}
+			aggCall := agg.toolCalls[tcIndex]
+			if aggCall == nil {
+				aggCall = &aggregatedToolCall{callType: "function"}
+				agg.toolCalls[tcIndex] = aggCall
+			}
+			if id, ok := call["id"].(string); ok && id != "" {
+				aggCall.id = id
+			}
+			if t, ok := call["type"].(string); ok && t != "" {
+				aggCall.callType = t
+			}
+			if fn, ok := call["function"].(map[string]interface{}); ok {
+				if name, ok := fn["name"].(string); ok && name != "" {
+					aggCall.name = name
+				}
+				if args, ok := fn["arguments"].(string); ok {
+					aggCall.arguments.WriteString(args)
+				}
+			}
+		}
+	}
+}
+
+// result 生成完整的 chat.completion 响应
+func (a *completionAggregator) result() map[string]interface{} {
+	indexes := make([]int, 0, len(a.choices))
+	for index := range a.choices {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	choices := make([]interface{}, 0, len(indexes))
+	for _, index := range indexes {
+		agg := a.choices[index]
+
+		role := agg.role
+		if role == "" {
+			role = "assistant"
+		}
+		message := map[string]interface{}{"role": role}
+		if agg.hasContent || len(agg.toolCalls) == 0 {
+			message["content"] = agg.content.String()
+		} else {
+			message["content"] = nil
+		}
+		if agg.hasReasoning {
+			message["reasoning_content"] = agg.reasoning.String()
+		}
+
+		if len(agg.toolCalls) > 0 {
+			tcIndexes := make([]int, 0, len(agg.toolCalls))
+			for tcIndex := range agg.toolCalls {
+				tcIndexes = append(tcIndexes, tcIndex)
+			}
+			sort.Ints(tcIndexes)
+
+			toolCalls := make([]interface{}, 0, len(tcIndexes))
+			for _, tcIndex := range tcIndexes {
+				call := agg.toolCalls[tcIndex]
+				toolCalls = append(toolCalls, map[string]interface{}{
+					"id":   call.id,
+					"type": call.callType,
+					"function": map[string]interface{}{
+						"name":      call.name,
+						"arguments": call.arguments.String(),
+					},
+				})
+			}
+			message["tool_calls"] = toolCalls
+		}
+
+		finishReason := agg.finishReason
+		if finishReason == nil {
+			finishReason = "stop"
+		}
+		choices = append(choices, map[string]interface{}{
+			"index":         index,
+			"message":       message,
+			"finish_reason": finishReason,
+		})
+	}
+
+	id := a.id
+	if id == "" {
+		id = fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
+	}
+	created := a.created
+	if created == nil {
+		created = time.Now().Unix()
+	}
+	result := map[string]interface{}{
+		"id":      id,
+		"object":  "chat.completion",
+		"created": created,
+		"model":   a.model,
+		"choices": choices,
+	}
+	if a.systemFingerprint != nil {
+		result["system_fingerprint"] = a.systemFingerprint
+	}
+	if a.usage != nil {
+		result["usage"] = a.usage
+	}
+	return result
+}
+
+// completionToChunks 将完整的 chat.completion 拆分为等价的流式 chunk
+// 每个 choice 依次生成 role+content、tool_calls、finish_reason 三个 chunk，usage chunk 由调用方按需追加
+func completionToChunks(result map[string]interface{}) []map[string]interface{} {
+	id, _ := result["id"].(string)
+	model, _ := result["model"].(string)
+	created, ok := result["created"]
+	if !ok {
+		created = time.Now().Unix()
+	}
+
+	newChunk := func(choices []interface{}) map[string]interface{} {
+		chunk := map[string]interface{}{
+			"id":      id,
+			"object":  "chat.completion.chunk",
+			"created": created,
+			"model":   model,
+			"choices": choices,
+		}
+		if fp, ok := result["system_fingerprint"]; ok {
+			chunk["system_fingerprint"] = fp
+		}
+		return chunk
+	}
+
+	var chunks []map[string]interface{}
+	choices, _ := result["choices"].([]interface{})
+	for i, c := range choices {
+		choice, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		index := interface{}(i)
+		if idx, ok := choice["index"]; ok {
+			index = idx
+		}
+		message, _ := choice["message"].(map[string]interface{})
+
+		role, _ := message["role"].(string)
+		if role == "" {
+			role = "assistant"
+		}
+		delta := map[string]interface{}{"role": role}
+		if content, ok := message["content"].(string); ok {
+			delta["content"] = content
+		}
+		if reasoning, ok := message["reasoning_content"].(string); ok {
+			delta["reasoning_content"] = reasoning
+		}
+		chunks = append(chunks, newChunk([]interface{}{
+			map[string]interface{}{"index": index, "delta": delta, "finish_reason": nil},
+		}))
+
+		if toolCalls, ok := message["tool_calls"].([]interface{}); ok && len(toolCalls) > 0 {
+			deltaCalls := make([]interface{}, 0, len(toolCalls))
+			for tcIndex, tc := range toolCalls {
+				call, ok := tc.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				deltaCall := map[string]interface{}{"index": tcIndex}
+				for k, v := range call {
+					deltaCall[k] = v
+				}
+				deltaCalls = append(deltaCalls, deltaCall)
+			}
+			chunks = append(chunks, newChunk([]interface{}{
+				map[string]interface{}{"index": index, "delta": map[string]interface{}{"tool_calls": deltaCalls}, "finish_reason": nil},
+			}))
+		}
+
+		finishReason := choice["finish_reason"]
+		if finishReason == nil {
+			finishReason = "stop"
+		}
+		chunks = append(chunks, newChunk([]interface{}{
+			map[string]interface{}{"index": index, "delta": map[string]interface{}{}, "finish_reason": finishReason},
+		}))
+	}
+	return chunks
+}
+
+// writeSSEChunk 以 SSE 格式写入一个 chunk
+func writeSSEChunk(resp chatResponder, chunk map[string]interface{}) bool {
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return true
+	}
+	return resp.StreamLine("data: "+string(data)) && resp.StreamLine("")
+}
+
+// writeChunkWithoutUsage 去掉 usage 后写入 chunk，仅包含 usage 的 chunk 直接丢弃
+func writeChunkWithoutUsage(resp chatResponder, chunk map[string]interface{}) bool {
+	if choices, _ := chunk["choices"].([]interface{}); len(choices) == 0 {
+		return true
+	}
+	stripped := make(map[string]interface{}, len(chunk))
+	for k, v := range chunk {
+		if k != "usage" {
+			stripped[k] = v
+		}
+	}
+	data, err := json.Marshal(stripped)
+	if err != nil {
+		return true
+	}
+	return resp.StreamLine("data: " + string(data))
+}
+
+// isSSEDone 判断是否为流结束标记
+func isSSEDone(line string) bool {
+	return strings.TrimSpace(line) == "data: [DONE]"
+}
@@ -11,6 +11,7 @@ import (
 	"vte/internal/logger"
 	"vte/internal/models"
 	"vte/internal/proxy"
+	"vte/internal/secret"
 )
 
 // TestConnection 测试提供商连接
@@ -36,15 +37,17 @@ func TestConnection(c *gin.Context) {
 		VertexLocation string
 		ExtraHeaders   *string
 		ProxyURL       string
+		MockConfig     string
 	}
 	err = db.QueryRow(`
 		SELECT name, base_url, api_key, provider_type, 
 		       COALESCE(vertex_project, ''), COALESCE(vertex_location, 'global'),
-		       extra_headers, COALESCE(proxy_url, '')
+		       extra_headers, COALESCE(proxy_url, ''), COALESCE(mock_config, '')
 		FROM providers WHERE id = ?
 	`, providerID).Scan(
 		&provider.Name, &provider.BaseURL, &provider.APIKey, &provider.ProviderType,
 		&provider.VertexProject, &provider.VertexLocation, &provider.ExtraHeaders, &provider.ProxyURL,
+		&provider.MockConfig,
 	)
 	if err != nil {
 		c.JSON(404, gin.H{"detail": "提供商不存在"})
@@ -86,6 +89,12 @@ func TestConnection(c *gin.Context) {
 		}
 	}
 
+	apiKey, err = secret.Decrypt(apiKey)
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "解密密钥失败"})
+		return
+	}
+
 	// 构建配置
 	cfg := &proxy.ProviderConfig{
 		BaseURL:        provider.BaseURL,
@@ -99,6 +108,9 @@ func TestConnection(c *gin.Context) {
 	if provider.ExtraHeaders != nil && *provider.ExtraHeaders != "" {
 		json.Unmarshal([]byte(*provider.ExtraHeaders), &cfg.ExtraHeaders)
 	}
+	if provider.ProviderType == proxy.ProviderTypeMock {
+		cfg.Mock = proxy.ParseMockConfig(provider.MockConfig)
+	}
 
 	// 处理 Vertex Express 模型名
 	testModelID := modelOriginalID
@@ -3,6 +3,7 @@ package handlers
 import (
 	"fmt"
 	"log"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -42,24 +43,53 @@ func GetCurrentPeriodStart() time.Time {
 	return today3PM
 }
 
-// RecordTokenUsage 记录token使用情况
-func RecordTokenUsage(modelName, providerName string, promptTokens, completionTokens, totalTokens int) error {
+// RecordTokenUsage 记录token使用情况，按模型价格计算费用并写回 usage.Cost 和 usage.ID
+func RecordTokenUsage(usage *models.TokenUsage) error {
+	usage.Cost = calculateCost(usage)
 	db := database.DB()
-	_, err := db.Exec(`
-		INSERT INTO token_usage (model_name, provider_name, prompt_tokens, completion_tokens, total_tokens)
-		VALUES (?, ?, ?, ?, ?)
-	`, modelName, providerName, promptTokens, completionTokens, totalTokens)
-	return err
+	result, err := db.Exec(`
+		INSERT INTO token_usage (user_id, api_key_id, model_name, provider_name, prompt_tokens, completion_tokens, total_tokens,
+			cached_tokens, image_count, duration, cost)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, usage.UserID, usage.APIKeyID, usage.ModelName, usage.ProviderName, usage.PromptTokens, usage.CompletionTokens, usage.TotalTokens,
+		usage.CachedTokens, usage.ImageCount, usage.Duration, usage.Cost)
+	if err != nil {
+		return err
+	}
+	id, _ := result.LastInsertId()
+	usage.ID = int(id)
+	return nil
 }
 
-// GetTodayTokenStats 获取当前周期的token统计（15:00 到 次日 15:00）
+// GetTodayTokenStats 获取当前周期的token统计（15:00 到 次日 15:00），可通过 user_id 参数筛选用户
 func GetTodayTokenStats(c *gin.Context) {
+	userID, _ := strconv.Atoi(c.Query("user_id"))
+	writeTokenStats(c, userID)
+}
+
+// GetMyTokenStats 获取当前用户在当前周期的token统计
+func GetMyTokenStats(c *gin.Context) {
+	user := c.MustGet("user").(*models.User)
+	writeTokenStats(c, user.ID)
+}
+
+// writeTokenStats 查询并返回当前周期的token统计，userID 为 0 时统计所有用户
+func writeTokenStats(c *gin.Context, userID int) {
 	db := database.DB()
 	
 	// 使用北京时间获取当前统计周期的开始时间（15:00），然后转换为UTC用于数据库查询
 	now := GetBeijingTime()
 	periodStart := GetCurrentPeriodStart()
 	periodStartUTC := periodStart.UTC().Format("2006-01-02 15:04:05")
+
+	where := "created_at >= ?"
+	spendWhere := "t.created_at >= ?"
+	args := []interface{}{periodStartUTC}
+	if userID > 0 {
+		where += " AND user_id = ?"
+		spendWhere += " AND t.user_id = ?"
+		args = append(args, userID)
+	}
 	
 	// 查询当前周期的总统计（15:00 到 次日 15:00）
 	var stats models.TokenStats
@@ -67,10 +97,10 @@ func GetTodayTokenStats(c *gin.Context) {
 		SELECT 
 			COALESCE(SUM(total_tokens), 0) as total_tokens,
 			COALESCE(SUM(prompt_tokens), 0) as prompt_tokens,
-			COALESCE(SUM(completion_tokens), 0) as completion_tokens
+			COALESCE(SUM(completion_tokens), 0) as completion_tokens,
+			COALESCE(SUM(cost), 0) as cost
 		FROM token_usage
-		WHERE created_at >= ?
-	`, periodStartUTC).Scan(&stats.TotalTokens, &stats.PromptTokens, &stats.CompletionTokens)
+		WHERE `+where, args...).Scan(&stats.TotalTokens, &stats.PromptTokens, &stats.CompletionTokens, &stats.TotalCost)
 	
 	if err != nil {
 		c.JSON(500, gin.H{"detail": "查询统计失败"})
@@ -91,10 +121,10 @@ func GetTodayTokenStats(c *gin.Context) {
 			COALESCE(SUM(total_tokens), 0) as total_tokens,
 			COUNT(*) as request_count
 		FROM token_usage
-		WHERE created_at >= ?
+		WHERE `+where+`
 		GROUP BY hour, minute_slot
 		ORDER BY hour, minute_slot
-	`, periodStartUTC)
+	`, args...)
 	
 	if err != nil {
 		c.JSON(500, gin.H{"detail": "查询时段统计失败"})
@@ -147,12 +177,13 @@ func GetTodayTokenStats(c *gin.Context) {
 			COALESCE(SUM(total_tokens), 0) as total_tokens,
 			COALESCE(SUM(prompt_tokens), 0) as prompt_tokens,
 			COALESCE(SUM(completion_tokens), 0) as completion_tokens,
-			COUNT(*) as request_count
+			COUNT(*) as request_count,
+			COALESCE(SUM(cost), 0) as cost
 		FROM token_usage
-		WHERE created_at >= ?
+		WHERE `+where+`
 		GROUP BY model_name, provider_name
 		ORDER BY total_tokens DESC
-	`, periodStartUTC)
+	`, args...)
 	
 	if err != nil {
 		c.JSON(500, gin.H{"detail": "查询模型统计失败"})
@@ -164,9 +195,16 @@ func GetTodayTokenStats(c *gin.Context) {
 	for modelRows.Next() {
 		var ms models.ModelTokenStats
 		modelRows.Scan(&ms.ModelName, &ms.ProviderName, &ms.TotalTokens, 
-			&ms.PromptTokens, &ms.CompletionTokens, &ms.RequestCount)
+			&ms.PromptTokens, &ms.CompletionTokens, &ms.RequestCount, &ms.Cost)
 		stats.ModelStats = append(stats.ModelStats, ms)
 	}
+
+	// 按提供商和用户汇总费用（按用户筛选时不返回用户维度）
+	providerStats, _ := querySpendStats("t.provider_name", spendWhere, args)
+	var userStats []models.SpendStats
+	if userID == 0 {
+		userStats, _ = querySpendStats("COALESCE(u.username, '未知用户')", spendWhere, args)
+	}
 	
 	// 添加当前小时和重置时间信息
 	// 计算下次重置时间（北京时间15:00）
@@ -179,22 +217,22 @@ func GetTodayTokenStats(c *gin.Context) {
 		"total_tokens":      stats.TotalTokens,
 		"prompt_tokens":     stats.PromptTokens,
 		"completion_tokens": stats.CompletionTokens,
+		"total_cost":        stats.TotalCost,
 		"hourly_stats":      stats.HourlyStats,
 		"model_stats":       stats.ModelStats,
+		"provider_stats":    providerStats,
+		"user_stats":        userStats,
 		"server_time":       now.Format("2006-01-02 15:04:05"),
 		"next_reset_time":   next3PM.Format("2006-01-02 15:04:05"),
 		"timezone":          "Asia/Shanghai (UTC+8)",
 	})
 }
 
-// CleanOldTokenRecords 清理旧的token记录（删除当前周期之前的所有数据）
+// CleanOldTokenRecords 清理旧的token记录（删除超过保留天数的数据，每月配额和费用统计依赖历史记录）
 func CleanOldTokenRecords() error {
 	db := database.DB()
-	// 获取当前统计周期的开始时间（15:00）
-	periodStart := GetCurrentPeriodStart()
-	// 转换为 UTC 时间进行数据库查询
-	periodStartUTC := periodStart.UTC()
-	_, err := db.Exec("DELETE FROM token_usage WHERE created_at < ?", periodStartUTC.Format("2006-01-02 15:04:05"))
+	cutoff := time.Now().UTC().AddDate(0, 0, -getTokenRetentionDays())
+	_, err := db.Exec("DELETE FROM token_usage WHERE created_at < ?", cutoff.Format("2006-01-02 15:04:05"))
 	return err
 }
 
@@ -0,0 +1,322 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"vte/internal/auth"
+	"vte/internal/database"
+	"vte/internal/logger"
+	"vte/internal/models"
+	"vte/internal/secret"
+)
+
+// totpIssuer 认证器应用中显示的发行方
+const totpIssuer = "VTE"
+
+// loadRecoveryCodes 读取用户剩余恢复码的哈希
+func loadRecoveryCodes(userID int) ([]string, string) {
+	var raw string
+	database.DB().QueryRow("SELECT COALESCE(recovery_codes, '') FROM users WHERE id = ?", userID).Scan(&raw)
+	var hashes []string
+	if raw != "" {
+		json.Unmarshal([]byte(raw), &hashes)
+	}
+	return hashes, raw
+}
+
+// verifySecondFactor 校验 TOTP 验证码或恢复码，恢复码使用后作废
+func verifySecondFactor(userID int, code string) bool {
+	db := database.DB()
+	var encrypted string
+	var lastStep int64
+	if err := db.QueryRow("SELECT COALESCE(totp_secret, ''), COALESCE(totp_last_step, 0) FROM users WHERE id = ?", userID).
+		Scan(&encrypted, &lastStep); err != nil || encrypted == "" {
+		return false
+	}
+	totpSecret, err := secret.Decrypt(encrypted)
+	if err != nil {
+		logger.Error(fmt.Sprintf("解密两步验证密钥失败 | 用户 %d | %v", userID, err))
+		return false
+	}
+
+	if step, ok := auth.VerifyTOTP(totpSecret, code, lastStep); ok {
+		// 记录已使用的时间步，同一验证码不能再次使用
+		result, err := db.Exec("UPDATE users SET totp_last_step = ? WHERE id = ? AND COALESCE(totp_last_step, 0) < ?", step, userID, step)
+		if err != nil {
+			return false
+		}
+		n, _ := result.RowsAffected()
+		return n == 1
+	}
+
+	hashes, raw := loadRecoveryCodes(userID)
+	hash := auth.HashRecoveryCode(code)
+	for i, h := range hashes {
+		if h != hash {
+			continue
+		}
+		remaining, _ := json.Marshal(append(hashes[:i:i], hashes[i+1:]...))
+		result, err := db.Exec("UPDATE users SET recovery_codes = ? WHERE id = ? AND recovery_codes = ?", string(remaining), userID, raw)
+		if err != nil {
+			return false
+		}
+		n, _ := result.RowsAffected()
+		return n == 1
+	}
+	return false
+}
+
+// issueRecoveryCodes 生成新的恢复码并替换旧的，返回明文
+func issueRecoveryCodes(userID int) ([]string, error) {
+	codes, hashes, err := auth.GenerateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	data, _ := json.Marshal(hashes)
+	if _, err := database.DB().Exec("UPDATE users SET recovery_codes = ? WHERE id = ?", string(data), userID); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// LoginTwoFactor 登录第二步：校验临时令牌和验证码后签发登录令牌
+func LoginTwoFactor(c *gin.Context) {
+	var req models.TwoFactorLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"detail": "无效的请求"})
+		return
+	}
+
+	username, err := auth.ParseChallengeToken(req.ChallengeToken)
+	if err != nil {
+		c.JSON(401, gin.H{"detail": "验证已过期，请重新登录"})
+		return
+	}
+	release, ok := beginLoginAttempt(c, username)
+	if !ok {
+		return
+	}
+	defer release()
+
+	user, err := auth.GetUserByUsername(username)
+	if err != nil || !user.IsActive {
+		c.JSON(401, gin.H{"detail": "用户不存在或已禁用"})
+		return
+	}
+
+	if !user.TOTPEnabled || !verifySecondFactor(user.ID, req.Code) {
+		// 返回 400 而非 401，前端保留临时令牌以便重新输入
+		recordLoginFailure(c, username, "two_factor")
+		logger.Warn(fmt.Sprintf("%s | 两步验证失败 | %s", c.ClientIP(), username))
+		c.JSON(400, gin.H{"detail": "验证码错误"})
+		return
+	}
+
+	tokens, err := issueSession(c, user)
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "生成令牌失败"})
+		return
+	}
+
+	auth.ClearLoginFailures(auth.LoginScopeUser, auth.LoginUserKey(user.Username))
+	logger.Info(fmt.Sprintf("%s | 登录成功 | %s | 两步验证", c.ClientIP(), username))
+	c.JSON(200, tokens)
+}
+
+// GetTwoFactorStatus 获取当前用户的两步验证状态
+func GetTwoFactorStatus(c *gin.Context) {
+	user := c.MustGet("user").(*models.User)
+	hashes, _ := loadRecoveryCodes(user.ID)
+	c.JSON(200, gin.H{
+		"enabled":                  user.TOTPEnabled,
+		"required":                 user.IsAdmin && auth.AdminTwoFactorRequired(),
+		"recovery_codes_remaining": len(hashes),
+	})
+}
+
+// SetupTwoFactor 生成新的 TOTP 密钥，验证通过（EnableTwoFactor）后才生效
+func SetupTwoFactor(c *gin.Context) {
+	user := c.MustGet("user").(*models.User)
+	if user.TOTPEnabled {
+		c.JSON(400, gin.H{"detail": "已启用两步验证，请先关闭"})
+		return
+	}
+
+	totpSecret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "生成密钥失败"})
+		return
+	}
+	encrypted, err := secret.Encrypt(totpSecret)
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "加密密钥失败"})
+		return
+	}
+	if _, err := database.DB().Exec("UPDATE users SET totp_secret = ?, totp_last_step = 0 WHERE id = ?", encrypted, user.ID); err != nil {
+		c.JSON(500, gin.H{"detail": "保存失败"})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"secret": totpSecret,
+		"uri":    auth.TOTPProvisioningURI(totpSecret, user.Username, totpIssuer),
+	})
+}
+
+// EnableTwoFactor 校验认证器生成的验证码后启用两步验证，返回一次性恢复码
+func EnableTwoFactor(c *gin.Context) {
+	var req models.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"detail": "无效的请求"})
+		return
+	}
+
+	user := c.MustGet("user").(*models.User)
+	if user.TOTPEnabled {
+		c.JSON(400, gin.H{"detail": "已启用两步验证"})
+		return
+	}
+
+	var encrypted string
+	database.DB().QueryRow("SELECT COALESCE(totp_secret, '') FROM users WHERE id = ?", user.ID).Scan(&encrypted)
+	totpSecret, err := secret.Decrypt(encrypted)
+	if err != nil || totpSecret == "" {
+		c.JSON(400, gin.H{"detail": "请先生成密钥"})
+		return
+	}
+	step, ok := auth.VerifyTOTP(totpSecret, req.Code, 0)
+	if !ok {
+		c.JSON(400, gin.H{"detail": "验证码错误，请确认设备时间准确"})
+		return
+	}
+
+	codes, err := issueRecoveryCodes(user.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "生成恢复码失败"})
+		return
+	}
+	database.DB().Exec("UPDATE users SET totp_enabled = 1, totp_last_step = ? WHERE id = ?", step, user.ID)
+
+	logger.Info(fmt.Sprintf("%s | 启用两步验证 | %s", c.ClientIP(), user.Username))
+	c.JSON(200, gin.H{"message": "两步验证已启用", "recovery_codes": codes})
+}
+
+// DisableTwoFactor 校验验证码或恢复码后关闭两步验证
+func DisableTwoFactor(c *gin.Context) {
+	var req models.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"detail": "无效的请求"})
+		return
+	}
+
+	user := c.MustGet("user").(*models.User)
+	if !user.TOTPEnabled {
+		c.JSON(400, gin.H{"detail": "未启用两步验证"})
+		return
+	}
+	if user.IsAdmin && auth.AdminTwoFactorRequired() {
+		c.JSON(400, gin.H{"detail": "系统要求管理员启用两步验证，无法关闭"})
+		return
+	}
+	if !verifySecondFactor(user.ID, req.Code) {
+		c.JSON(400, gin.H{"detail": "验证码错误"})
+		return
+	}
+
+	clearTwoFactor(user.ID)
+	logger.Info(fmt.Sprintf("%s | 关闭两步验证 | %s", c.ClientIP(), user.Username))
+	c.JSON(200, gin.H{"message": "两步验证已关闭"})
+}
+
+// RegenerateRecoveryCodes 校验验证码后重新生成恢复码，旧恢复码全部作废
+func RegenerateRecoveryCodes(c *gin.Context) {
+	var req models.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"detail": "无效的请求"})
+		return
+	}
+
+	user := c.MustGet("user").(*models.User)
+	if !user.TOTPEnabled || !verifySecondFactor(user.ID, req.Code) {
+		c.JSON(400, gin.H{"detail": "验证码错误"})
+		return
+	}
+
+	codes, err := issueRecoveryCodes(user.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "生成恢复码失败"})
+		return
+	}
+
+	logger.Info(fmt.Sprintf("%s | 重新生成恢复码 | %s", c.ClientIP(), user.Username))
+	c.JSON(200, gin.H{"recovery_codes": codes})
+}
+
+// ResetUserTwoFactor 管理员为丢失设备的用户关闭两步验证
+func ResetUserTwoFactor(c *gin.Context) {
+	target, ok := loadTargetUser(c)
+	if !ok {
+		return
+	}
+
+	// 自己的两步验证需要验证码才能关闭
+	operator := c.MustGet("user").(*models.User)
+	if target.ID == operator.ID {
+		c.JSON(400, gin.H{"detail": "请在仪表盘中关闭自己的两步验证"})
+		return
+	}
+
+	clearTwoFactor(target.ID)
+
+	logger.Info(fmt.Sprintf("%s | 重置两步验证 | %s | 操作者: %s", c.ClientIP(), target.Username, operator.Username))
+	c.JSON(200, gin.H{"message": "两步验证已重置"})
+}
+
+func clearTwoFactor(userID int) {
+	database.DB().Exec("UPDATE users SET totp_enabled = 0, totp_secret = '', totp_last_step = 0, recovery_codes = '' WHERE id = ?", userID)
+}
+
+// GetTwoFactorSettings 获取是否要求管理员启用两步验证
+func GetTwoFactorSettings(c *gin.Context) {
+	c.JSON(200, gin.H{"require_admin": auth.AdminTwoFactorRequired()})
+}
+
+// SetTwoFactorSettings 设置是否要求管理员启用两步验证
+// 开启后未启用两步验证的管理员只能访问个人接口，直到完成绑定
+func SetTwoFactorSettings(c *gin.Context) {
+	var req struct {
+		RequireAdmin bool `json:"require_admin"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"detail": "无效的请求"})
+		return
+	}
+
+	operator := c.MustGet("user").(*models.User)
+	if req.RequireAdmin && !operator.TOTPEnabled {
+		c.JSON(400, gin.H{"detail": "请先为自己启用两步验证"})
+		return
+	}
+
+	value := "false"
+	if req.RequireAdmin {
+		value = "true"
+	}
+	database.DB().Exec(`INSERT INTO settings (key, value) VALUES ('require_admin_2fa', ?) ON CONFLICT(key) DO UPDATE SET value = ?`, value, value)
+
+	missing := []string{}
+	rows, err := database.DB().Query("SELECT username FROM users WHERE is_admin = 1 AND is_active = 1 AND COALESCE(totp_enabled, 0) = 0")
+	if err == nil {
+		for rows.Next() {
+			var name string
+			rows.Scan(&name)
+			missing = append(missing, name)
+		}
+		rows.Close()
+	}
+
+	logger.Info(fmt.Sprintf("%s | 要求管理员两步验证: %s", c.ClientIP(), value))
+	c.JSON(200, gin.H{"message": "设置已更新", "admins_without_2fa": missing})
+}
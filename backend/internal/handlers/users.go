@@ -0,0 +1,384 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"vte/internal/auth"
+	"vte/internal/database"
+	"vte/internal/logger"
+	"vte/internal/models"
+)
+
+// ListUsers 列出所有用户及其当前周期的用量
+func ListUsers(c *gin.Context) {
+	db := database.DB()
+	periodStartUTC := GetCurrentPeriodStart().UTC().Format("2006-01-02 15:04:05")
+	lockouts := loadUserLockouts()
+
+	rows, err := db.Query(`
+		SELECT u.id, u.username, u.is_admin, COALESCE(u.role, ''), u.is_active, u.created_at, COALESCE(u.quota, ''),
+		       COALESCE(u.credit_balance, 0), COALESCE(u.group_name, ''),
+		       COALESCE(u.email, ''), COALESCE(u.oidc_subject, '') != '', COALESCE(u.totp_enabled, 0) = 1,
+		       COALESCE(SUM(t.total_tokens), 0), COUNT(t.id)
+		FROM users u
+		LEFT JOIN token_usage t ON t.user_id = u.id AND t.created_at >= ?
+		GROUP BY u.id
+		ORDER BY u.id
+	`, periodStartUTC)
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "查询失败"})
+		return
+	}
+	defer rows.Close()
+
+	users := []gin.H{}
+	for rows.Next() {
+		var id, isAdmin, isActive, totalTokens, requestCount int
+		var username, role, quota, group, email string
+		var creditBalance float64
+		var ssoLinked, totpEnabled bool
+		var createdAt time.Time
+		if err := rows.Scan(&id, &username, &isAdmin, &role, &isActive, &createdAt, &quota, &creditBalance, &group,
+			&email, &ssoLinked, &totpEnabled, &totalTokens, &requestCount); err != nil {
+			continue
+		}
+		users = append(users, gin.H{
+			"id":             id,
+			"username":       username,
+			"is_admin":       isAdmin == 1,
+			"role":           auth.ResolveRole(isAdmin == 1, role),
+			"is_active":      isActive == 1,
+			"created_at":     createdAt,
+			"total_tokens":   totalTokens,
+			"request_count":  requestCount,
+			"quota":          auth.ParseQuota(quota),
+			"credit_balance": creditBalance,
+			"group":          group,
+			"email":          email,
+			"sso_linked":     ssoLinked,
+			"totp_enabled":   totpEnabled,
+			"locked_until":   lockouts[auth.LoginUserKey(username)],
+		})
+	}
+
+	c.JSON(200, users)
+}
+
+// CreateUser 创建用户，返回的 API Key 可直接交给该用户使用
+func CreateUser(c *gin.Context) {
+	var req models.UserCreate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"detail": "无效的请求"})
+		return
+	}
+
+	db := database.DB()
+
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", req.Username).Scan(&count)
+	if count > 0 {
+		c.JSON(400, gin.H{"detail": "用户名已存在"})
+		return
+	}
+
+	role := req.Role
+	if role == "" {
+		role = models.RoleUser
+		if req.IsAdmin {
+			role = models.RoleAdmin
+		}
+	}
+	if !auth.ValidRole(role) {
+		c.JSON(400, gin.H{"detail": "未知的角色: " + role})
+		return
+	}
+
+	id, apiKey, err := createUser(req.Username, req.Password, strings.TrimSpace(req.Email), "", role)
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "创建失败"})
+		return
+	}
+	operator := c.MustGet("user").(*models.User)
+	logger.Info(fmt.Sprintf("%s | 创建用户 | %s | 操作者: %s", c.ClientIP(), req.Username, operator.Username))
+
+	c.JSON(200, gin.H{
+		"id":        id,
+		"username":  req.Username,
+		"api_key":   apiKey,
+		"is_admin":  role == models.RoleAdmin,
+		"role":      role,
+		"is_active": true,
+	})
+}
+
+// createUser 创建用户及其默认网关密钥，返回用户 ID 和密钥明文
+func createUser(username, password, email, oidcSubject, role string) (int, string, error) {
+	hashed, err := auth.HashPassword(password)
+	if err != nil {
+		return 0, "", err
+	}
+
+	apiKey := auth.GenerateAPIKey()
+	result, err := database.DB().Exec(
+		"INSERT INTO users (username, hashed_password, api_key, is_admin, role, email, oidc_subject) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		username, hashed, database.HashAPIKey(apiKey), boolToInt(role == models.RoleAdmin), role, email, oidcSubject,
+	)
+	if err != nil {
+		return 0, "", err
+	}
+
+	id, _ := result.LastInsertId()
+	if _, err := auth.InsertGatewayKey(int(id), apiKey, nil); err != nil {
+		return 0, "", err
+	}
+	return int(id), apiKey, nil
+}
+
+// UpdateUser 修改用户名、角色、启用状态、配额或计费分组
+func UpdateUser(c *gin.Context) {
+	target, ok := loadTargetUser(c)
+	if !ok {
+		return
+	}
+
+	var req models.UserUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"detail": "无效的请求"})
+		return
+	}
+
+	operator := c.MustGet("user").(*models.User)
+	db := database.DB()
+
+	// role 优先；只传 is_admin 时 true 设为管理员，false 把管理员降为普通用户，其他角色不变
+	newRole := ""
+	switch {
+	case req.Role != nil:
+		newRole = *req.Role
+		if !auth.ValidRole(newRole) {
+			c.JSON(400, gin.H{"detail": "未知的角色: " + newRole})
+			return
+		}
+	case req.IsAdmin != nil && *req.IsAdmin:
+		newRole = models.RoleAdmin
+	case req.IsAdmin != nil && target.IsAdmin:
+		newRole = models.RoleUser
+	}
+
+	// 不能取消自己的管理员权限或禁用自己，且必须保留至少一个启用的管理员
+	removesAdmin := (newRole != "" && newRole != models.RoleAdmin) || (req.IsActive != nil && !*req.IsActive)
+	if removesAdmin && target.ID == operator.ID {
+		c.JSON(400, gin.H{"detail": "不能禁用自己或取消自己的管理员权限"})
+		return
+	}
+	if removesAdmin && target.IsAdmin && target.IsActive && countOtherActiveAdmins(target.ID) == 0 {
+		c.JSON(400, gin.H{"detail": "至少需要保留一个启用的管理员"})
+		return
+	}
+
+	updates := []string{}
+	args := []interface{}{}
+
+	if req.Username != nil && *req.Username != target.Username {
+		if *req.Username == "" {
+			c.JSON(400, gin.H{"detail": "用户名不能为空"})
+			return
+		}
+		var count int
+		db.QueryRow("SELECT COUNT(*) FROM users WHERE username = ? AND id != ?", *req.Username, target.ID).Scan(&count)
+		if count > 0 {
+			c.JSON(400, gin.H{"detail": "用户名已存在"})
+			return
+		}
+		updates = append(updates, "username = ?")
+		args = append(args, *req.Username)
+	}
+	if newRole != "" {
+		updates = append(updates, "role = ?", "is_admin = ?")
+		args = append(args, newRole, boolToInt(newRole == models.RoleAdmin))
+	}
+	if req.IsActive != nil {
+		updates = append(updates, "is_active = ?")
+		args = append(args, boolToInt(*req.IsActive))
+	}
+	if req.Quota != nil {
+		updates = append(updates, "quota = ?")
+		args = append(args, auth.FormatQuota(req.Quota))
+	}
+	if req.Group != nil {
+		updates = append(updates, "group_name = ?")
+		args = append(args, strings.TrimSpace(*req.Group))
+	}
+	if req.Email != nil {
+		updates = append(updates, "email = ?")
+		args = append(args, strings.TrimSpace(*req.Email))
+	}
+
+	if len(updates) > 0 {
+		query := "UPDATE users SET "
+		for i, u := range updates {
+			if i > 0 {
+				query += ", "
+			}
+			query += u
+		}
+		query += " WHERE id = ?"
+		args = append(args, target.ID)
+
+		if _, err := db.Exec(query, args...); err != nil {
+			c.JSON(500, gin.H{"detail": "更新失败"})
+			return
+		}
+	}
+
+	// 禁用或改名后该用户已登录的会话全部失效
+	renamed := req.Username != nil && *req.Username != target.Username
+	if renamed || (req.IsActive != nil && !*req.IsActive) {
+		auth.RevokeUserSessions(target.ID, "")
+	}
+
+	logger.Info(fmt.Sprintf("%s | 更新用户 | %s | 操作者: %s", c.ClientIP(), target.Username, operator.Username))
+	c.JSON(200, gin.H{"message": "更新成功"})
+}
+
+// DeleteUser 删除用户，历史用量记录保留
+func DeleteUser(c *gin.Context) {
+	target, ok := loadTargetUser(c)
+	if !ok {
+		return
+	}
+
+	operator := c.MustGet("user").(*models.User)
+	if target.ID == operator.ID {
+		c.JSON(400, gin.H{"detail": "不能删除自己"})
+		return
+	}
+	if target.IsAdmin && target.IsActive && countOtherActiveAdmins(target.ID) == 0 {
+		c.JSON(400, gin.H{"detail": "至少需要保留一个启用的管理员"})
+		return
+	}
+
+	db := database.DB()
+	if _, err := db.Exec("DELETE FROM users WHERE id = ?", target.ID); err != nil {
+		c.JSON(500, gin.H{"detail": "删除失败"})
+		return
+	}
+	db.Exec("DELETE FROM gateway_api_keys WHERE user_id = ?", target.ID)
+	db.Exec("DELETE FROM admin_tokens WHERE user_id = ?", target.ID)
+	db.Exec("DELETE FROM sessions WHERE user_id = ?", target.ID)
+
+	logger.Info(fmt.Sprintf("%s | 删除用户 | %s | 操作者: %s", c.ClientIP(), target.Username, operator.Username))
+	c.JSON(200, gin.H{"message": "删除成功"})
+}
+
+// ResetUserPassword 管理员重置用户密码，无需原密码
+func ResetUserPassword(c *gin.Context) {
+	target, ok := loadTargetUser(c)
+	if !ok {
+		return
+	}
+
+	var req models.ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"detail": "无效的请求"})
+		return
+	}
+
+	hashed, err := auth.HashPassword(req.NewPassword)
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "密码加密失败"})
+		return
+	}
+
+	if _, err := database.DB().Exec("UPDATE users SET hashed_password = ? WHERE id = ?", hashed, target.ID); err != nil {
+		c.JSON(500, gin.H{"detail": "更新失败"})
+		return
+	}
+
+	// 重置密码后该用户的会话全部失效，为自己重置时保留当前会话
+	operator := c.MustGet("user").(*models.User)
+	exceptSID := ""
+	if target.ID == operator.ID {
+		exceptSID = currentSessionID(c)
+	}
+	auth.RevokeUserSessions(target.ID, exceptSID)
+	logger.Info(fmt.Sprintf("%s | 重置密码 | %s | 操作者: %s", c.ClientIP(), target.Username, operator.Username))
+	c.JSON(200, gin.H{"message": "密码已重置"})
+}
+
+// RegenerateUserAPIKey 管理员为用户重新生成默认 API Key，旧 Key 立即失效
+func RegenerateUserAPIKey(c *gin.Context) {
+	target, ok := loadTargetUser(c)
+	if !ok {
+		return
+	}
+
+	newKey, err := replaceDefaultKey(target.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"detail": "更新失败"})
+		return
+	}
+
+	operator := c.MustGet("user").(*models.User)
+	logger.Info(fmt.Sprintf("%s | 重新生成API Key | %s | 操作者: %s", c.ClientIP(), target.Username, operator.Username))
+	c.JSON(200, gin.H{"api_key": newKey})
+}
+
+// loadUserLockouts 获取当前被锁定的用户名及解锁时间
+func loadUserLockouts() map[string]*time.Time {
+	lockouts := make(map[string]*time.Time)
+	rows, err := database.DB().Query("SELECT key, locked_until FROM login_throttle WHERE scope = ?", auth.LoginScopeUser)
+	if err != nil {
+		return lockouts
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var lockedUntil sql.NullTime
+		if rows.Scan(&key, &lockedUntil) == nil && time.Now().Before(lockedUntil.Time) {
+			lockouts[key] = &lockedUntil.Time
+		}
+	}
+	return lockouts
+}
+
+// loadTargetUser 读取路径参数 id 对应的用户，失败时写入错误响应
+func loadTargetUser(c *gin.Context) (*models.User, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"detail": "无效的用户ID"})
+		return nil, false
+	}
+
+	var user models.User
+	var isAdmin, isActive int
+	err = database.DB().QueryRow("SELECT id, username, is_admin, COALESCE(role, ''), is_active FROM users WHERE id = ?", id).
+		Scan(&user.ID, &user.Username, &isAdmin, &user.Role, &isActive)
+	if err != nil {
+		c.JSON(404, gin.H{"detail": "用户不存在"})
+		return nil, false
+	}
+	user.IsAdmin = isAdmin == 1
+	user.Role = auth.ResolveRole(user.IsAdmin, user.Role)
+	user.IsActive = isActive == 1
+	return &user, true
+}
+
+// countOtherActiveAdmins 统计除指定用户外启用的管理员数量
+func countOtherActiveAdmins(excludeID int) int {
+	var count int
+	database.DB().QueryRow("SELECT COUNT(*) FROM users WHERE is_admin = 1 AND is_active = 1 AND id != ?", excludeID).Scan(&count)
+	return count
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
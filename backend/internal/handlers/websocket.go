@@ -0,0 +1,402 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"vte/internal/auth"
+	"vte/internal/config"
+	"vte/internal/logger"
+	"vte/internal/models"
+)
+
+// WebSocket 连接参数
+const (
+	wsWriteWait      = 10 * time.Second // 单次写入超时
+	wsPongWait       = 60 * time.Second // 超过该时间未收到任何消息则断开
+	wsPingPeriod     = 30 * time.Second // 服务端发送 ping 的间隔，必须小于 wsPongWait
+	wsMaxMessageSize = 16 << 20         // 单条消息最大 16MB
+	wsMaxInflight    = 32               // 每个连接同时处理的最大请求数
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin:     checkWSOrigin,
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// wsOrigins WebSocket 接口允许的跨域来源，与 /v1 接口使用同一 CORS 配置
+var wsOrigins config.CORSPolicy
+
+// SetWebSocketOrigins 设置 WebSocket 接口允许的跨域来源
+func SetWebSocketOrigins(policy config.CORSPolicy) {
+	wsOrigins = policy
+}
+
+// checkWSOrigin 浏览器发起的连接只允许同源页面和 CORS_PUBLIC_ORIGINS 中的来源，防止其他网站借助拿到的密钥建立连接
+// 不带 Origin 的请求来自 SDK 等非浏览器客户端，不受限制
+func checkWSOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host) || wsOrigins.AllowsOrigin(origin)
+}
+
+// wsClientMessage 客户端发送的消息
+//
+//	{"type": "request", "id": "r1", "body": {...chat payload...}}
+//	{"type": "cancel", "id": "r1"}
+//	{"type": "ping", "id": "p1"}
+//
+// 未携带 type 的消息视为旧格式：整条消息即为请求体，由服务端分配 id
+type wsClientMessage struct {
+	Type string                 `json:"type"`
+	ID   string                 `json:"id"`
+	Body map[string]interface{} `json:"body"`
+}
+
+// wsServerMessage 服务端发送的消息
+// type: chunk（流式数据）/ response（非流式结果）/ done / error / cancelled / pong
+type wsServerMessage struct {
+	Type  string      `json:"type"`
+	ID    string      `json:"id,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+	Error *wsError    `json:"error,omitempty"`
+}
+
+// wsError 结构化错误
+type wsError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	Type    string `json:"type,omitempty"`
+	Code    string `json:"code,omitempty"`
+}
+
+// wsSession 一个 WebSocket 连接，可同时处理多个请求
+type wsSession struct {
+	conn     *websocket.Conn
+	rawKey   string // 连接时使用的 API Key，每个请求重新校验
+	clientIP string
+
+	ctx    context.Context // 连接关闭时取消，同时中止所有进行中的请求
+	cancel context.CancelFunc
+
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	inflight map[string]context.CancelFunc // 请求 id -> 取消函数
+	seq      int
+	wg       sync.WaitGroup
+}
+
+// OpenAIChatCompletionsWS 处理 WebSocket 连接的聊天完成请求
+func OpenAIChatCompletionsWS(c *gin.Context) {
+	// 从查询参数或 header 获取 API Key
+	apiKey := c.Query("api_key")
+	if apiKey == "" {
+		apiKey = auth.ExtractAPIKey(c)
+	}
+
+	if apiKey == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"detail": "缺少 API Key"})
+		return
+	}
+
+	// 验证 API Key
+	if _, _, status, err := authorizeWSKey(apiKey, c.ClientIP()); err != nil {
+		c.JSON(status, gin.H{"detail": err.Error()})
+		return
+	}
+
+	// 升级为 WebSocket 连接
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		logger.Error(fmt.Sprintf("WebSocket 升级失败: %v", err))
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &wsSession{
+		conn:     conn,
+		rawKey:   apiKey,
+		clientIP: c.ClientIP(),
+		ctx:      ctx,
+		cancel:   cancel,
+		inflight: make(map[string]context.CancelFunc),
+	}
+	s.run()
+}
+
+// authorizeWSKey 校验 API Key、IP 访问规则和 chat 权限，失败时返回对应的状态码
+func authorizeWSKey(apiKey, clientIP string) (*models.User, *models.GatewayAPIKey, int, error) {
+	user, key, err := auth.AuthenticateAPIKey(apiKey)
+	if err != nil {
+		return nil, nil, http.StatusUnauthorized, err
+	}
+	if err := auth.CheckAPIKeyIP(key, clientIP); err != nil {
+		return nil, nil, http.StatusForbidden, err
+	}
+	if !key.HasScope(models.ScopeChat) {
+		return nil, nil, http.StatusForbidden, errors.New("API Key 缺少 chat 权限")
+	}
+	return user, key, 0, nil
+}
+
+// run 读取消息直到连接关闭，关闭时取消所有进行中的请求
+func (s *wsSession) run() {
+	defer func() {
+		s.cancel()
+		s.wg.Wait()
+	}()
+
+	s.conn.SetReadLimit(wsMaxMessageSize)
+	s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	go s.keepalive()
+
+	for {
+		_, message, err := s.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure, websocket.CloseAbnormalClosure) {
+				logger.Error(fmt.Sprintf("WebSocket 读取错误: %v", err))
+			}
+			return
+		}
+		s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+
+		var msg wsClientMessage
+		if err := json.Unmarshal(message, &msg); err != nil {
+			s.sendError("", 400, gin.H{"detail": "无效的 JSON"})
+			continue
+		}
+
+		switch msg.Type {
+		case "request":
+			if msg.ID == "" {
+				s.sendError("", 400, gin.H{"detail": "缺少请求 id"})
+				continue
+			}
+			s.startRequest(msg.ID, msg.Body)
+		case "cancel":
+			s.cancelRequest(msg.ID)
+		case "ping":
+			s.send(wsServerMessage{Type: "pong", ID: msg.ID})
+		case "":
+			// 旧格式：整条消息即为请求体
+			var body map[string]interface{}
+			json.Unmarshal(message, &body)
+			s.startRequest(s.nextID(), body)
+		default:
+			s.sendError(msg.ID, 400, gin.H{"detail": fmt.Sprintf("未知的消息类型: %s", msg.Type)})
+		}
+	}
+}
+
+// keepalive 定期发送 ping，对端需回复 pong 以维持连接
+func (s *wsSession) keepalive() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				s.cancel()
+				return
+			}
+		}
+	}
+}
+
+func (s *wsSession) nextID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	return strconv.Itoa(s.seq)
+}
+
+// startRequest 在独立的 goroutine 中处理一个请求
+func (s *wsSession) startRequest(id string, body map[string]interface{}) {
+	if body == nil {
+		s.sendError(id, 400, gin.H{"detail": "缺少请求体"})
+		return
+	}
+
+	// 每个请求重新校验密钥，密钥被吊销、过期或用户被禁用后关闭连接
+	user, key, status, err := authorizeWSKey(s.rawKey, s.clientIP)
+	if err != nil {
+		s.sendError(id, status, gin.H{"detail": err.Error()})
+		s.close(websocket.ClosePolicyViolation, "API Key 已失效")
+		return
+	}
+
+	s.mu.Lock()
+	if _, exists := s.inflight[id]; exists {
+		s.mu.Unlock()
+		s.sendError(id, 409, gin.H{"detail": fmt.Sprintf("请求 id 已存在: %s", id)})
+		return
+	}
+	if len(s.inflight) >= wsMaxInflight {
+		s.mu.Unlock()
+		s.sendError(id, 429, gin.H{"detail": fmt.Sprintf("单个连接最多同时处理 %d 个请求", wsMaxInflight)})
+		return
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.inflight[id] = cancel
+	s.mu.Unlock()
+
+	// 未指定时默认使用流式，流式模式设置仍然生效
+	if _, ok := body["stream"]; !ok {
+		body["stream"] = true
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() {
+			cancel()
+			s.mu.Lock()
+			delete(s.inflight, id)
+			s.mu.Unlock()
+		}()
+
+		resp := &wsResponder{session: s, id: id, ctx: ctx}
+		req, e := newChatRequest(ctx, body, user, s.clientIP)
+		if e != nil {
+			resp.Error(e.Status, e.Body)
+			return
+		}
+		req.WebSocket = true
+		req.APIKey = key
+
+		runChatPipeline(req, resp)
+		resp.finish()
+	}()
+}
+
+// cancelRequest 取消进行中的请求，上游请求会被立即中止
+func (s *wsSession) cancelRequest(id string) {
+	s.mu.Lock()
+	cancel, ok := s.inflight[id]
+	s.mu.Unlock()
+	if !ok {
+		s.sendError(id, 404, gin.H{"detail": fmt.Sprintf("请求不存在或已完成: %s", id)})
+		return
+	}
+	cancel()
+}
+
+// send 写入一条消息，写入失败时关闭连接
+func (s *wsSession) send(msg wsServerMessage) bool {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.ctx.Err() != nil {
+		return false
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if err := s.conn.WriteJSON(msg); err != nil {
+		logger.Error(fmt.Sprintf("WebSocket 写入错误: %v", err))
+		s.cancel()
+		s.conn.Close()
+		return false
+	}
+	return true
+}
+
+// close 发送关闭帧并断开连接，进行中的请求随之取消
+func (s *wsSession) close(code int, reason string) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteWait))
+	s.cancel()
+	s.conn.Close()
+}
+
+// sendError 写入结构化错误
+func (s *wsSession) sendError(id string, status int, body gin.H) {
+	e := &chatError{Status: status, Body: body}
+	wsErr := &wsError{Status: status, Message: e.detail()}
+	if inner, ok := body["error"].(gin.H); ok {
+		wsErr.Type, _ = inner["type"].(string)
+		wsErr.Code, _ = inner["code"].(string)
+	}
+	s.send(wsServerMessage{Type: "error", ID: id, Error: wsErr})
+}
+
+// wsResponder 将单个请求的管道输出写入 WebSocket 会话
+type wsResponder struct {
+	session   *wsSession
+	id        string
+	ctx       context.Context
+	streaming bool
+	done      bool // 已发送终止消息
+}
+
+func (r *wsResponder) Error(status int, body gin.H) {
+	if r.ctx.Err() != nil {
+		return
+	}
+	r.session.sendError(r.id, status, body)
+	r.done = true
+}
+
+func (r *wsResponder) JSON(result map[string]interface{}) {
+	if r.ctx.Err() != nil {
+		return
+	}
+	r.session.send(wsServerMessage{Type: "response", ID: r.id, Data: result})
+	r.done = true
+}
+
+// Header WebSocket 消息没有响应头，忽略
+func (r *wsResponder) Header(key, value string) {}
+
+func (r *wsResponder) StreamStart() {
+	r.streaming = true
+}
+
+func (r *wsResponder) StreamLine(line string) bool {
+	if r.ctx.Err() != nil {
+		return false
+	}
+	chunk := parseSSEData(line)
+	if chunk == nil {
+		return true
+	}
+	return r.session.send(wsServerMessage{Type: "chunk", ID: r.id, Data: chunk})
+}
+
+// finish 发送请求的终止消息：被取消时为 cancelled，流式结束时为 done
+func (r *wsResponder) finish() {
+	if r.done {
+		return
+	}
+	if r.ctx.Err() != nil {
+		if r.session.ctx.Err() == nil {
+			r.session.send(wsServerMessage{Type: "cancelled", ID: r.id})
+		}
+		return
+	}
+	if r.streaming {
+		r.session.send(wsServerMessage{Type: "done", ID: r.id})
+	}
+}
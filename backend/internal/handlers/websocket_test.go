@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+
+	"vte/internal/auth"
+	"vte/internal/config"
+	"vte/internal/database"
+)
+
+func TestCheckWSOrigin(t *testing.T) {
+	defer SetWebSocketOrigins(wsOrigins)
+
+	tests := []struct {
+		name    string
+		origins []string
+		origin  string
+		want    bool
+	}{
+		{"no origin", []string{"none"}, "", true},
+		{"same origin", []string{"none"}, "https://vte.example.com", true},
+		{"cross origin denied", []string{"none"}, "https://evil.example.org", false},
+		{"listed origin", []string{"https://app.example.org/"}, "https://app.example.org", true},
+		{"wildcard subdomain", []string{"https://*.example.org"}, "https://chat.example.org", true},
+		{"unlisted origin", []string{"https://app.example.org"}, "https://evil.example.org", false},
+		{"any origin", []string{"*"}, "https://evil.example.org", true},
+		{"invalid origin", []string{"https://app.example.org"}, "null", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetWebSocketOrigins(config.CORSPolicy{Origins: tt.origins})
+			r := httptest.NewRequest("GET", "http://vte.example.com/v1/chat/completions/ws", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := checkWSOrigin(r); got != tt.want {
+				t.Errorf("checkWSOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWSRevalidatesKeyPerRequest(t *testing.T) {
+	db := database.DB()
+	result, err := db.Exec("INSERT INTO users (username, hashed_password, api_key) VALUES ('ws-revoke', '', 'ws-revoke-legacy')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, _ := result.LastInsertId()
+	apiKey := auth.GenerateAPIKey()
+	keyID, err := auth.InsertGatewayKey(int(userID), apiKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/v1/chat/completions/ws", OpenAIChatCompletionsWS)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/chat/completions/ws?api_key="+apiKey, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	// 连接建立后吊销密钥，后续请求应被拒绝并关闭连接
+	db.Exec("UPDATE gateway_api_keys SET is_revoked = 1 WHERE id = ?", keyID)
+	conn.WriteJSON(map[string]interface{}{
+		"type": "request", "id": "r1",
+		"body": map[string]interface{}{"model": "mock-echo", "messages": []interface{}{map[string]interface{}{"role": "user", "content": "hi"}}},
+	})
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg wsServerMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if msg.Type != "error" || msg.ID != "r1" || msg.Error == nil || msg.Error.Status != 401 {
+		t.Fatalf("got %+v, want a 401 error for r1", msg)
+	}
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation {
+		t.Errorf("read after revocation = %v, want close %d", err, websocket.ClosePolicyViolation)
+	}
+}
@@ -1,14 +1,34 @@
 package models
 
-import "time"
+import (
+	"strings"
+	"time"
+)
+
+// 网关 API Key 的权限范围
+const (
+	ScopeChat       = "chat"
+	ScopeEmbeddings = "embeddings"
+	ScopeAdminRead  = "admin-read" // 以 API Key 只读访问管理接口（仅管理角色的密钥）
+)
+
+// 用户角色，决定可以访问哪些管理接口
+const (
+	RoleUser     = "user"     // 普通用户，只能使用网关和个人接口
+	RoleViewer   = "viewer"   // 查看统计、日志、模型和提供商列表
+	RoleOperator = "operator" // 在 viewer 基础上启用/禁用模型和提供商密钥、测试连接
+	RoleAdmin    = "admin"    // 全部权限
+)
 
 type User struct {
 	ID             int       `json:"id"`
 	Username       string    `json:"username"`
 	HashedPassword string    `json:"-"`
-	APIKey         string    `json:"api_key"`
+	APIKey         string    `json:"-"` // 默认密钥的 SHA-256 哈希
 	IsAdmin        bool      `json:"is_admin"`
+	Role           string    `json:"role"`
 	IsActive       bool      `json:"is_active"`
+	TOTPEnabled    bool      `json:"totp_enabled"`
 	CreatedAt      time.Time `json:"created_at"`
 }
 
@@ -23,15 +43,167 @@ type Provider struct {
 	VertexLocation string    `json:"vertex_location,omitempty"`
 	ExtraHeaders   string    `json:"-"`
 	ProxyURL       string    `json:"-"`
+	MockConfig     string    `json:"mock_config,omitempty"`
 	IsActive       bool      `json:"is_active"`
 	CreatedAt      time.Time `json:"created_at"`
 }
 
+// GatewayAPIKey 用户访问网关的 API Key，每个用户可拥有多个
+type GatewayAPIKey struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	APIKey     string     `json:"api_key,omitempty"` // 明文密钥，仅在创建时返回一次
+	KeyHash    string     `json:"-"`                 // 数据库中保存的 SHA-256 哈希
+	KeyPrefix  string     `json:"key_prefix"`        // 密钥的前几位，用于识别
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	IsRevoked  bool       `json:"is_revoked"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+
+	// AllowedModels 非空时只能使用匹配的模型，DeniedModels 优先于 AllowedModels
+	// 支持 * 通配符，如 gpt-4o-mini*、*claude*，不区分大小写
+	AllowedModels []string `json:"allowed_models"`
+	DeniedModels  []string `json:"denied_models"`
+
+	// AllowedIPs 非空时只能从匹配的 IP 使用，DeniedIPs 优先，支持单个 IP 和 CIDR
+	AllowedIPs []string `json:"allowed_ips"`
+	DeniedIPs  []string `json:"denied_ips"`
+
+	Quota *Quota `json:"quota"` // 为 nil 时不限制，仍受所属用户的配额约束
+}
+
+// HasScope 判断密钥是否拥有指定权限
+func (k *GatewayAPIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IsExpired 判断密钥是否已过期
+func (k *GatewayAPIKey) IsExpired() bool {
+	return k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt)
+}
+
+// AllowsModel 判断密钥是否可以使用模型，names 为同一模型的不同名称（显示名称、原始 ID 等）
+func (k *GatewayAPIKey) AllowsModel(names ...string) bool {
+	if k == nil {
+		return true
+	}
+	if matchAnyModel(k.DeniedModels, names) {
+		return false
+	}
+	return len(k.AllowedModels) == 0 || matchAnyModel(k.AllowedModels, names)
+}
+
+func matchAnyModel(patterns, names []string) bool {
+	for _, pattern := range patterns {
+		for _, name := range names {
+			if name != "" && MatchModelPattern(pattern, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MatchModelPattern 判断模型名称是否匹配模式，* 匹配任意字符（包括 /），不区分大小写
+func MatchModelPattern(pattern, name string) bool {
+	pattern, name = strings.ToLower(pattern), strings.ToLower(name)
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == name
+	}
+	if !strings.HasPrefix(name, parts[0]) {
+		return false
+	}
+	name = name[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(name, part)
+		if i < 0 {
+			return false
+		}
+		name = name[i+len(part):]
+	}
+	return len(name) >= len(last) && strings.HasSuffix(name, last)
+}
+
+// GatewayAPIKeyCreate 创建网关密钥请求，scopes 为空时默认 chat + embeddings
+type GatewayAPIKeyCreate struct {
+	Name      string     `json:"name" binding:"required"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+
+	AllowedModels []string `json:"allowed_models"`
+	DeniedModels  []string `json:"denied_models"`
+	AllowedIPs    []string `json:"allowed_ips"`
+	DeniedIPs     []string `json:"denied_ips"`
+	Quota         *Quota   `json:"quota"`
+}
+
+// GatewayAPIKeyUpdate 更新网关密钥请求
+type GatewayAPIKeyUpdate struct {
+	Name   *string  `json:"name"`
+	Scopes []string `json:"scopes"`
+
+	// 传入空数组表示清空限制，不传则保持不变
+	AllowedModels []string `json:"allowed_models"`
+	DeniedModels  []string `json:"denied_models"`
+	AllowedIPs    []string `json:"allowed_ips"`
+	DeniedIPs     []string `json:"denied_ips"`
+	Quota         *Quota   `json:"quota"` // 各项均为 0 时取消配额
+}
+
+// AdminToken 用于自动化脚本调用管理接口的长期令牌，与网关密钥分开管理
+// 只能访问令牌权限和所属用户角色都允许的管理接口
+type AdminToken struct {
+	ID          int        `json:"id"`
+	UserID      int        `json:"user_id"`
+	Username    string     `json:"username"`
+	Name        string     `json:"name"`
+	Token       string     `json:"token,omitempty"` // 明文令牌，仅在创建时返回一次
+	TokenHash   string     `json:"-"`               // 数据库中保存的 SHA-256 哈希
+	TokenPrefix string     `json:"token_prefix"`    // 令牌的前几位，用于查找和识别
+	Permissions []string   `json:"permissions"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	IsRevoked   bool       `json:"is_revoked"`
+	LastUsedAt  *time.Time `json:"last_used_at"`
+	LastUsedIP  string     `json:"last_used_ip"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// HasPermission 判断令牌是否拥有指定权限
+func (t *AdminToken) HasPermission(perm string) bool {
+	for _, p := range t.Permissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// IsExpired 判断令牌是否已过期
+func (t *AdminToken) IsExpired() bool {
+	return t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)
+}
+
+// AdminTokenCreate 创建管理令牌请求
+type AdminTokenCreate struct {
+	Name        string     `json:"name" binding:"required"`
+	Permissions []string   `json:"permissions" binding:"required"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+}
+
 // ProviderAPIKey 提供商的多密钥支持
 type ProviderAPIKey struct {
 	ID         int        `json:"id"`
 	ProviderID int        `json:"provider_id"`
-	APIKey     string     `json:"api_key,omitempty"`
+	KeyHint    string     `json:"key_hint"` // 密钥末 4 位，密钥本身加密保存不返回
 	Name       string     `json:"name"`
 	IsActive   bool       `json:"is_active"`
 	UsageCount int        `json:"usage_count"`
@@ -79,20 +251,56 @@ type LoginRequest struct {
 }
 
 type TokenResponse struct {
-	AccessToken string `json:"access_token"`
-	TokenType   string `json:"token_type"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"` // 访问令牌有效秒数
+}
+
+// RefreshRequest 用刷新令牌换取新的访问令牌
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// Session 登录会话
+type Session struct {
+	ID         string    `json:"id"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+// TwoFactorLoginRequest 登录第二步：提交验证码或恢复码
+type TwoFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	Code           string `json:"code" binding:"required"`
+}
+
+// TwoFactorChallenge 启用两步验证的用户通过密码验证后返回，需再提交验证码
+type TwoFactorChallenge struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token"`
+}
+
+// TwoFactorCodeRequest 提交验证码或恢复码
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
 }
 
 type ProviderCreate struct {
 	Name           string `json:"name" binding:"required"`
 	BaseURL        string `json:"base_url"`
-	APIKey         string `json:"api_key" binding:"required"`
+	APIKey         string `json:"api_key"`
 	ModelPrefix    string `json:"model_prefix"`
 	ProviderType   string `json:"provider_type"`
 	VertexProject  string `json:"vertex_project"`
 	VertexLocation string `json:"vertex_location"`
 	ExtraHeaders   string `json:"extra_headers"`
 	ProxyURL       string `json:"proxy_url"`
+	MockConfig     string `json:"mock_config"`
 }
 
 type ProviderUpdate struct {
@@ -105,6 +313,7 @@ type ProviderUpdate struct {
 	VertexLocation *string `json:"vertex_location"`
 	ExtraHeaders   *string `json:"extra_headers"`
 	ProxyURL       *string `json:"proxy_url"`
+	MockConfig     *string `json:"mock_config"`
 	IsActive       *bool   `json:"is_active"`
 }
 
@@ -131,6 +340,31 @@ type ChangeUsernameRequest struct {
 	NewUsername string `json:"new_username" binding:"required"`
 }
 
+// UserCreate 管理员创建用户请求
+type UserCreate struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+	IsAdmin  bool   `json:"is_admin"`
+	Role     string `json:"role"`  // 为空时按 is_admin 决定
+	Email    string `json:"email"` // 用于单点登录时匹配账户
+}
+
+// UserUpdate 管理员更新用户请求
+type UserUpdate struct {
+	Username *string `json:"username"`
+	IsAdmin  *bool   `json:"is_admin"`
+	Role     *string `json:"role"` // 同时提供时优先于 is_admin
+	IsActive *bool   `json:"is_active"`
+	Quota    *Quota  `json:"quota"` // 各项均为 0 时取消配额
+	Group    *string `json:"group"` // 计费分组，决定费用倍率
+	Email    *string `json:"email"`
+}
+
+// ResetPasswordRequest 管理员重置用户密码请求
+type ResetPasswordRequest struct {
+	NewPassword string `json:"new_password" binding:"required"`
+}
+
 type StreamModeRequest struct {
 	Mode string `json:"mode" binding:"required"`
 }
@@ -170,20 +404,140 @@ type ConcurrencyRequest struct {
 	Limit   int  `json:"limit"`
 }
 
+// QuotaLimit 一个周期内的配额上限，各项为 0 表示不限制
+type QuotaLimit struct {
+	Tokens   int64   `json:"tokens"`
+	Requests int64   `json:"requests"`
+	Cost     float64 `json:"cost"` // 按配额单价估算的费用（美元）
+}
+
+// IsZero 判断是否未设置任何限制
+func (l QuotaLimit) IsZero() bool {
+	return l.Tokens <= 0 && l.Requests <= 0 && l.Cost <= 0
+}
+
+// Quota 用户或网关密钥的每日、每月配额，每日周期与 Token 统计一致（北京时间 15:00 开始）
+type Quota struct {
+	Daily   QuotaLimit `json:"daily"`
+	Monthly QuotaLimit `json:"monthly"`
+}
+
+// IsZero 判断是否未设置任何限制
+func (q *Quota) IsZero() bool {
+	return q == nil || (q.Daily.IsZero() && q.Monthly.IsZero())
+}
+
+// QuotaPriceRequest 估算配额费用使用的单价（美元 / 百万 token）
+type QuotaPriceRequest struct {
+	InputPrice  float64 `json:"input_price"`
+	OutputPrice float64 `json:"output_price"`
+}
+
 type TokenUsage struct {
 	ID               int       `json:"id"`
+	UserID           int       `json:"user_id"`
+	APIKeyID         int       `json:"api_key_id"`
 	ModelName        string    `json:"model_name"`
 	ProviderName     string    `json:"provider_name"`
 	PromptTokens     int       `json:"prompt_tokens"`
 	CompletionTokens int       `json:"completion_tokens"`
 	TotalTokens      int       `json:"total_tokens"`
+	CachedTokens     int       `json:"cached_tokens"` // 输入中命中缓存的 token 数
+	ImageCount       int       `json:"image_count"`   // 输入中的图片数
+	Duration         float64   `json:"duration"`      // 请求耗时（秒）
+	Cost             float64   `json:"cost"`
 	CreatedAt        time.Time `json:"created_at"`
 }
 
+// ModelPrice 模型价格，token 单价为美元 / 百万 token
+// ModelName 支持 * 通配符，精确匹配优先，其次是最长的模式
+type ModelPrice struct {
+	ID               int       `json:"id"`
+	ModelName        string    `json:"model_name"`
+	InputPrice       float64   `json:"input_price"`
+	CachedInputPrice float64   `json:"cached_input_price"` // 为 0 时按 InputPrice 计算
+	OutputPrice      float64   `json:"output_price"`
+	ImagePrice       float64   `json:"image_price"`       // 每张输入图片
+	SecondPrice      float64   `json:"second_price"`      // 每秒请求耗时
+	MaxOutputTokens  int       `json:"max_output_tokens"` // 请求未指定 max_tokens 时预扣余额的输出 token 数，为 0 时使用默认值
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// 余额流水类型
+const (
+	CreditTypeTopUp  = "topup"  // 管理员充值
+	CreditTypeAdjust = "adjust" // 管理员扣减
+	CreditTypeDeduct = "deduct" // 请求扣费（含预扣和补扣）
+	CreditTypeRefund = "refund" // 退还预扣（请求失败或多扣）
+)
+
+// CreditTransaction 余额流水，Amount 为正数表示增加，Balance 为变动后的余额
+type CreditTransaction struct {
+	ID           int       `json:"id"`
+	UserID       int       `json:"user_id"`
+	Type         string    `json:"type"`
+	Amount       float64   `json:"amount"`
+	Balance      float64   `json:"balance"`
+	ModelName    string    `json:"model_name,omitempty"`
+	TokenUsageID int       `json:"token_usage_id,omitempty"`
+	Description  string    `json:"description"`
+	Operator     string    `json:"operator,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// CreditTopUpRequest 管理员调整用户余额请求，Amount 为负数时扣减
+type CreditTopUpRequest struct {
+	Amount      float64 `json:"amount" binding:"required"`
+	Description string  `json:"description"`
+}
+
+// CreditSettings 余额计费设置
+type CreditSettings struct {
+	Enabled          bool               `json:"enabled"`
+	GroupMultipliers map[string]float64 `json:"group_multipliers"`  // 分组 → 费用倍率，未配置的分组按 1 计算
+	DefaultMaxTokens int                `json:"default_max_tokens"` // 请求和模型价格都未指定输出上限时预扣的输出 token 数
+}
+
+// LoginProtectionSettings 登录防暴力破解设置
+// 连续失败达到阈值的一半后每次失败的等待时间翻倍，达到阈值后锁定，之后每次失败锁定时间翻倍
+type LoginProtectionSettings struct {
+	Enabled         bool `json:"enabled"`
+	MaxUserFailures int  `json:"max_user_failures"` // 同一用户名连续失败多少次后锁定
+	MaxIPFailures   int  `json:"max_ip_failures"`   // 同一 IP 连续失败多少次后锁定
+	LockoutMinutes  int  `json:"lockout_minutes"`   // 首次锁定时长
+}
+
+// OIDCSettings OpenID Connect 单点登录设置
+type OIDCSettings struct {
+	Enabled         bool     `json:"enabled"`
+	Issuer          string   `json:"issuer"`
+	ClientID        string   `json:"client_id"`
+	ClientSecret    string   `json:"client_secret,omitempty"` // 加密保存，读取设置时不返回，更新时留空表示不修改
+	ClientSecretSet bool     `json:"client_secret_set"`
+	RedirectURL     string   `json:"redirect_url"` // 为空时根据请求地址生成 /api/auth/oidc/callback
+	Scopes          string   `json:"scopes"`
+	AutoProvision   bool     `json:"auto_provision"` // 没有匹配的账户时自动创建
+	AdminClaim      string   `json:"admin_claim"`    // 决定是否为管理员的声明，如 groups；为空时不修改管理员权限
+	AdminValues     []string `json:"admin_values"`   // 声明包含其中任一值时为管理员
+	ButtonText      string   `json:"button_text"`
+}
+
+// ModelPriceRequest 创建或更新模型价格请求
+type ModelPriceRequest struct {
+	ModelName        string  `json:"model_name" binding:"required"`
+	InputPrice       float64 `json:"input_price"`
+	CachedInputPrice float64 `json:"cached_input_price"`
+	OutputPrice      float64 `json:"output_price"`
+	ImagePrice       float64 `json:"image_price"`
+	SecondPrice      float64 `json:"second_price"`
+	MaxOutputTokens  int     `json:"max_output_tokens"`
+}
+
 type TokenStats struct {
 	TotalTokens      int                `json:"total_tokens"`
 	PromptTokens     int                `json:"prompt_tokens"`
 	CompletionTokens int                `json:"completion_tokens"`
+	TotalCost        float64            `json:"total_cost"`
 	HourlyStats      []HourlyTokenStats `json:"hourly_stats"`
 	ModelStats       []ModelTokenStats  `json:"model_stats"`
 }
@@ -195,10 +549,25 @@ type HourlyTokenStats struct {
 }
 
 type ModelTokenStats struct {
-	ModelName        string `json:"model_name"`
-	ProviderName     string `json:"provider_name"`
-	TotalTokens      int    `json:"total_tokens"`
-	PromptTokens     int    `json:"prompt_tokens"`
-	CompletionTokens int    `json:"completion_tokens"`
-	RequestCount     int    `json:"request_count"`
+	ModelName        string  `json:"model_name"`
+	ProviderName     string  `json:"provider_name"`
+	TotalTokens      int     `json:"total_tokens"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	RequestCount     int     `json:"request_count"`
+	Cost             float64 `json:"cost"`
+}
+
+// SpendStats 按某个维度（模型、提供商、用户）汇总的费用
+type SpendStats struct {
+	Name         string  `json:"name"`
+	RequestCount int     `json:"request_count"`
+	TotalTokens  int     `json:"total_tokens"`
+	Cost         float64 `json:"cost"`
+}
+
+// IPAccessSettings 全局的 IP 访问控制，对所有网关密钥生效，DeniedIPs 优先于 AllowedIPs
+type IPAccessSettings struct {
+	AllowedIPs []string `json:"allowed_ips"`
+	DeniedIPs  []string `json:"denied_ips"`
 }
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -24,6 +25,7 @@ type ProviderConfig struct {
 	VertexLocation string
 	ExtraHeaders   map[string]string
 	ProxyURL       string
+	Mock           *MockConfig // ProviderType 为 mock 时使用
 }
 
 func getClient(proxyURL string) *http.Client {
@@ -63,6 +65,18 @@ func getClient(proxyURL string) *http.Client {
 	return client
 }
 
+// httpClient 返回该提供商使用的 HTTP 客户端，mock 提供商使用本地生成响应的 transport
+func (cfg *ProviderConfig) httpClient() *http.Client {
+	if cfg.ProviderType == ProviderTypeMock {
+		mock := cfg.Mock
+		if mock == nil {
+			mock = ParseMockConfig("")
+		}
+		return &http.Client{Transport: &mockTransport{cfg: mock}}
+	}
+	return getClient(cfg.ProxyURL)
+}
+
 func InvalidateClient(proxyURL string) {
 	poolMu.Lock()
 	delete(clientPool, proxyURL)
@@ -80,6 +94,9 @@ func (cfg *ProviderConfig) getChatURL() string {
 			cfg.VertexProject, location,
 		)
 	}
+	if cfg.ProviderType == ProviderTypeMock {
+		return mockBaseURL + "/chat/completions"
+	}
 	return strings.TrimSuffix(cfg.BaseURL, "/") + "/chat/completions"
 }
 
@@ -87,6 +104,9 @@ func (cfg *ProviderConfig) getModelsURL() string {
 	if cfg.ProviderType == "vertex_express" {
 		return ""
 	}
+	if cfg.ProviderType == ProviderTypeMock {
+		return mockBaseURL + "/models"
+	}
 	return strings.TrimSuffix(cfg.BaseURL, "/") + "/models"
 }
 
@@ -121,7 +141,7 @@ func (cfg *ProviderConfig) ListModels() ([]map[string]interface{}, error) {
 		return nil, nil
 	}
 
-	client := getClient(cfg.ProxyURL)
+	client := cfg.httpClient()
 
 	req, err := http.NewRequest("GET", modelsURL, nil)
 	if err != nil {
@@ -164,7 +184,12 @@ func (cfg *ProviderConfig) ChatCompletion(payload map[string]interface{}) (map[s
 
 // ChatCompletionWithRetry 带重试的非流式请求
 func (cfg *ProviderConfig) ChatCompletionWithRetry(payload map[string]interface{}, maxRetries int) (map[string]interface{}, error) {
-	client := getClient(cfg.ProxyURL)
+	return cfg.ChatCompletionWithContext(context.Background(), payload, maxRetries)
+}
+
+// ChatCompletionWithContext 带重试的非流式请求，ctx 取消时立即中止
+func (cfg *ProviderConfig) ChatCompletionWithContext(ctx context.Context, payload map[string]interface{}, maxRetries int) (map[string]interface{}, error) {
+	client := cfg.httpClient()
 
 	body, err := json.Marshal(payload)
 	if err != nil {
@@ -177,10 +202,12 @@ func (cfg *ProviderConfig) ChatCompletionWithRetry(payload map[string]interface{
 	for attempt := 0; attempt <= maxRetries; attempt++ {
 		if attempt > 0 {
 			// 指数退避：100ms, 200ms, 400ms...
-			time.Sleep(time.Duration(100*(1<<(attempt-1))) * time.Millisecond)
+			if err := sleepWithContext(ctx, time.Duration(100*(1<<(attempt-1)))*time.Millisecond); err != nil {
+				return nil, err
+			}
 		}
 
-		req, err := http.NewRequest("POST", chatURL, strings.NewReader(string(body)))
+		req, err := http.NewRequestWithContext(ctx, "POST", chatURL, strings.NewReader(string(body)))
 		if err != nil {
 			return nil, err
 		}
@@ -195,6 +222,9 @@ func (cfg *ProviderConfig) ChatCompletionWithRetry(payload map[string]interface{
 
 		resp, err := client.Do(req)
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
 			lastErr = err
 			continue // 网络错误，重试
 		}
@@ -229,7 +259,12 @@ func (cfg *ProviderConfig) ChatCompletionStream(payload map[string]interface{})
 
 // ChatCompletionStreamWithRetry 带重试的流式请求
 func (cfg *ProviderConfig) ChatCompletionStreamWithRetry(payload map[string]interface{}, maxRetries int) (*http.Response, error) {
-	client := getClient(cfg.ProxyURL)
+	return cfg.ChatCompletionStreamWithContext(context.Background(), payload, maxRetries)
+}
+
+// ChatCompletionStreamWithContext 带重试的流式请求，ctx 取消时立即中止（包括读取响应体）
+func (cfg *ProviderConfig) ChatCompletionStreamWithContext(ctx context.Context, payload map[string]interface{}, maxRetries int) (*http.Response, error) {
+	client := cfg.httpClient()
 
 	body, err := json.Marshal(payload)
 	if err != nil {
@@ -242,10 +277,12 @@ func (cfg *ProviderConfig) ChatCompletionStreamWithRetry(payload map[string]inte
 	for attempt := 0; attempt <= maxRetries; attempt++ {
 		if attempt > 0 {
 			// 指数退避
-			time.Sleep(time.Duration(100*(1<<(attempt-1))) * time.Millisecond)
+			if err := sleepWithContext(ctx, time.Duration(100*(1<<(attempt-1)))*time.Millisecond); err != nil {
+				return nil, err
+			}
 		}
 
-		req, err := http.NewRequest("POST", chatURL, strings.NewReader(string(body)))
+		req, err := http.NewRequestWithContext(ctx, "POST", chatURL, strings.NewReader(string(body)))
 		if err != nil {
 			return nil, err
 		}
@@ -260,6 +297,9 @@ func (cfg *ProviderConfig) ChatCompletionStreamWithRetry(payload map[string]inte
 
 		resp, err := client.Do(req)
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
 			lastErr = err
 			continue // 网络错误，重试
 		}
@@ -280,3 +320,15 @@ func (cfg *ProviderConfig) ChatCompletionStreamWithRetry(payload map[string]inte
 
 	return nil, fmt.Errorf("max retries exceeded: %v", lastErr)
 }
+
+// sleepWithContext 等待指定时间，ctx 取消时提前返回
+func sleepWithContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,364 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"vte/internal/tokenizer"
+)
+
+// ProviderTypeMock 内置的模拟提供商，不访问任何上游
+const ProviderTypeMock = "mock"
+
+// mockBaseURL 模拟提供商的虚拟地址，请求由 mockTransport 在本地处理
+const mockBaseURL = "http://mock.local/v1"
+
+// MockConfig 模拟提供商的行为配置，以 JSON 保存在 providers.mock_config
+type MockConfig struct {
+	// Mode 回复方式：echo（复述最后一条用户消息）/ fixed（固定文本）/ tool_call（返回工具调用）
+	Mode      string         `json:"mode"`
+	Text      string         `json:"text"`
+	ToolCalls []MockToolCall `json:"tool_calls"`
+
+	LatencyMs    int `json:"latency_ms"`     // 返回响应（或第一个 chunk）前的延迟
+	ChunkDelayMs int `json:"chunk_delay_ms"` // 流式响应每个 token 之间的延迟
+
+	// ErrorStatus 大于 0 时按 ErrorRate 的概率返回该状态码，ErrorRate 为 0 表示每次都返回
+	ErrorStatus  int     `json:"error_status"`
+	ErrorRate    float64 `json:"error_rate"`
+	ErrorMessage string  `json:"error_message"`
+
+	Models []string `json:"models"` // 拉取模型时返回的模型列表
+}
+
+// MockToolCall 预设的工具调用，Arguments 为 JSON 字符串
+type MockToolCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// ParseMockConfig 解析模拟提供商配置，空或无效时使用 echo 模式
+func ParseMockConfig(raw string) *MockConfig {
+	cfg := &MockConfig{}
+	if raw != "" {
+		json.Unmarshal([]byte(raw), cfg)
+	}
+	if cfg.Mode == "" {
+		cfg.Mode = "echo"
+	}
+	if len(cfg.Models) == 0 {
+		cfg.Models = []string{"mock-echo"}
+	}
+	return cfg
+}
+
+// mockTransport 在本地生成 OpenAI 格式的响应，重试、流式读取与取消逻辑与真实上游完全一致
+type mockTransport struct {
+	cfg *MockConfig
+}
+
+func (t *mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+
+	if t.cfg.LatencyMs > 0 {
+		if err := sleepWithContext(req.Context(), time.Duration(t.cfg.LatencyMs)*time.Millisecond); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/models"):
+		return t.listModels(req), nil
+	case strings.HasSuffix(req.URL.Path, "/chat/completions"):
+		return t.chatCompletion(req)
+	}
+	return mockResponse(req, 404, "application/json", errorBody("not found", "invalid_request_error")), nil
+}
+
+func (t *mockTransport) listModels(req *http.Request) *http.Response {
+	data := make([]map[string]interface{}, 0, len(t.cfg.Models))
+	for _, id := range t.cfg.Models {
+		data = append(data, map[string]interface{}{"id": id, "object": "model", "owned_by": "mock"})
+	}
+	body, _ := json.Marshal(map[string]interface{}{"object": "list", "data": data})
+	return mockResponse(req, 200, "application/json", body)
+}
+
+func (t *mockTransport) chatCompletion(req *http.Request) (*http.Response, error) {
+	var payload map[string]interface{}
+	if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+		return mockResponse(req, 400, "application/json", errorBody("invalid JSON body", "invalid_request_error")), nil
+	}
+
+	if t.cfg.ErrorStatus > 0 && (t.cfg.ErrorRate <= 0 || rand.Float64() < t.cfg.ErrorRate) {
+		message := t.cfg.ErrorMessage
+		if message == "" {
+			message = fmt.Sprintf("mock error %d", t.cfg.ErrorStatus)
+		}
+		return mockResponse(req, t.cfg.ErrorStatus, "application/json", errorBody(message, "mock_error")), nil
+	}
+
+	model, _ := payload["model"].(string)
+	messages, _ := payload["messages"].([]interface{})
+	text, toolCalls := t.reply(payload, messages)
+
+	promptTokens := tokenizer.CountMessagesTokens(messages, model)
+	completionTokens := tokenizer.CountTokens(text, model)
+	for _, call := range toolCalls {
+		completionTokens += tokenizer.CountTokens(call.Name+call.Arguments, model)
+	}
+	usage := map[string]interface{}{
+		"prompt_tokens":     promptTokens,
+		"completion_tokens": completionTokens,
+		"total_tokens":      promptTokens + completionTokens,
+	}
+
+	id := fmt.Sprintf("chatcmpl-mock-%d", time.Now().UnixNano())
+	created := time.Now().Unix()
+	finishReason := "stop"
+	if len(toolCalls) > 0 {
+		finishReason = "tool_calls"
+	}
+
+	if stream, _ := payload["stream"].(bool); stream {
+		includeUsage := false
+		if opts, ok := payload["stream_options"].(map[string]interface{}); ok {
+			includeUsage, _ = opts["include_usage"].(bool)
+		}
+		pr, pw := io.Pipe()
+		go t.writeStream(req, pw, streamInfo{
+			id: id, created: created, model: model, text: text, toolCalls: toolCalls,
+			finishReason: finishReason, usage: usage, includeUsage: includeUsage,
+		})
+		resp := mockResponse(req, 200, "text/event-stream", nil)
+		resp.Body = pr
+		resp.ContentLength = -1
+		return resp, nil
+	}
+
+	message := map[string]interface{}{"role": "assistant", "content": text}
+	if len(toolCalls) > 0 {
+		message["content"] = nil
+		message["tool_calls"] = toolCallsJSON(id, toolCalls, false)
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":      id,
+		"object":  "chat.completion",
+		"created": created,
+		"model":   model,
+		"choices": []interface{}{
+			map[string]interface{}{"index": 0, "message": message, "finish_reason": finishReason},
+		},
+		"usage": usage,
+	})
+	return mockResponse(req, 200, "application/json", body), nil
+}
+
+// reply 按配置的模式生成回复文本或工具调用
+func (t *mockTransport) reply(payload map[string]interface{}, messages []interface{}) (string, []MockToolCall) {
+	switch t.cfg.Mode {
+	case "fixed":
+		return t.cfg.Text, nil
+	case "tool_call":
+		if len(t.cfg.ToolCalls) > 0 {
+			return "", t.cfg.ToolCalls
+		}
+		// 未预设时调用请求中声明的第一个工具
+		if tools, ok := payload["tools"].([]interface{}); ok && len(tools) > 0 {
+			if tool, ok := tools[0].(map[string]interface{}); ok {
+				if fn, ok := tool["function"].(map[string]interface{}); ok {
+					name, _ := fn["name"].(string)
+					return "", []MockToolCall{{Name: name, Arguments: "{}"}}
+				}
+			}
+		}
+		return t.cfg.Text, nil
+	default:
+		return lastUserMessage(messages), nil
+	}
+}
+
+// streamInfo 生成流式响应所需的数据
+type streamInfo struct {
+	id           string
+	created      int64
+	model        string
+	text         string
+	toolCalls    []MockToolCall
+	finishReason string
+	usage        map[string]interface{}
+	includeUsage bool
+}
+
+// writeStream 逐 token 写入 SSE chunk，请求取消时停止
+func (t *mockTransport) writeStream(req *http.Request, pw *io.PipeWriter, info streamInfo) {
+	ctx := req.Context()
+	delay := time.Duration(t.cfg.ChunkDelayMs) * time.Millisecond
+
+	write := func(choices []interface{}, usage map[string]interface{}) error {
+		chunk := map[string]interface{}{
+			"id":      info.id,
+			"object":  "chat.completion.chunk",
+			"created": info.created,
+			"model":   info.model,
+			"choices": choices,
+		}
+		if usage != nil {
+			chunk["usage"] = usage
+		}
+		data, _ := json.Marshal(chunk)
+		_, err := fmt.Fprintf(pw, "data: %s\n\n", data)
+		return err
+	}
+	delta := func(d map[string]interface{}, finishReason interface{}) []interface{} {
+		return []interface{}{map[string]interface{}{"index": 0, "delta": d, "finish_reason": finishReason}}
+	}
+	wait := func() error {
+		if delay <= 0 {
+			return ctx.Err()
+		}
+		return sleepWithContext(ctx, delay)
+	}
+
+	err := func() error {
+		if err := write(delta(map[string]interface{}{"role": "assistant", "content": ""}, nil), nil); err != nil {
+			return err
+		}
+		for _, piece := range splitMockTokens(info.text) {
+			if err := wait(); err != nil {
+				return err
+			}
+			if err := write(delta(map[string]interface{}{"content": piece}, nil), nil); err != nil {
+				return err
+			}
+		}
+		if len(info.toolCalls) > 0 {
+			if err := wait(); err != nil {
+				return err
+			}
+			calls := toolCallsJSON(info.id, info.toolCalls, true)
+			if err := write(delta(map[string]interface{}{"tool_calls": calls}, nil), nil); err != nil {
+				return err
+			}
+		}
+		if err := write(delta(map[string]interface{}{}, info.finishReason), nil); err != nil {
+			return err
+		}
+		if info.includeUsage {
+			if err := write([]interface{}{}, info.usage); err != nil {
+				return err
+			}
+		}
+		_, err := io.WriteString(pw, "data: [DONE]\n\n")
+		return err
+	}()
+	pw.CloseWithError(err)
+}
+
+// toolCallsJSON 生成 OpenAI 格式的 tool_calls，流式时附带 index
+func toolCallsJSON(id string, calls []MockToolCall, stream bool) []interface{} {
+	result := make([]interface{}, 0, len(calls))
+	for i, call := range calls {
+		args := call.Arguments
+		if args == "" {
+			args = "{}"
+		}
+		item := map[string]interface{}{
+			"id":   fmt.Sprintf("call_%s_%d", strings.TrimPrefix(id, "chatcmpl-mock-"), i),
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":      call.Name,
+				"arguments": args,
+			},
+		}
+		if stream {
+			item["index"] = i
+		}
+		result = append(result, item)
+	}
+	return result
+}
+
+// lastUserMessage 返回最后一条用户消息的文本内容
+func lastUserMessage(messages []interface{}) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		msg, ok := messages[i].(map[string]interface{})
+		if !ok || msg["role"] != "user" {
+			continue
+		}
+		switch content := msg["content"].(type) {
+		case string:
+			return content
+		case []interface{}:
+			var parts []string
+			for _, p := range content {
+				if part, ok := p.(map[string]interface{}); ok && part["type"] == "text" {
+					if text, ok := part["text"].(string); ok {
+						parts = append(parts, text)
+					}
+				}
+			}
+			return strings.Join(parts, "\n")
+		}
+	}
+	return ""
+}
+
+// splitMockTokens 将文本拆分为近似 token 的片段：ASCII 按单词（含后随空白），其余字符逐字
+func splitMockTokens(text string) []string {
+	var pieces []string
+	var current []rune
+	flush := func() {
+		if len(current) > 0 {
+			pieces = append(pieces, string(current))
+			current = current[:0]
+		}
+	}
+	for _, r := range text {
+		switch {
+		case unicode.IsSpace(r):
+			current = append(current, r)
+		case r < unicode.MaxASCII:
+			if len(current) > 0 && unicode.IsSpace(current[len(current)-1]) {
+				flush()
+			}
+			current = append(current, r)
+		default:
+			flush()
+			pieces = append(pieces, string(r))
+		}
+	}
+	flush()
+	return pieces
+}
+
+// errorBody 生成 OpenAI 格式的错误响应体
+func errorBody(message, errType string) []byte {
+	body, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{"message": message, "type": errType},
+	})
+	return body
+}
+
+func mockResponse(req *http.Request, status int, contentType string, body []byte) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{contentType}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mockProvider(cfg *MockConfig) *ProviderConfig {
+	return &ProviderConfig{ProviderType: ProviderTypeMock, Mock: cfg}
+}
+
+func userMessages(text string) []interface{} {
+	return []interface{}{map[string]interface{}{"role": "user", "content": text}}
+}
+
+// readSSE 读取流式响应中的全部 data 行
+func readSSE(t *testing.T, cfg *ProviderConfig, payload map[string]interface{}) []string {
+	t.Helper()
+	resp, err := cfg.ChatCompletionStreamWithContext(context.Background(), payload, 0)
+	if err != nil {
+		t.Fatalf("stream request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "data: ") {
+			lines = append(lines, strings.TrimPrefix(line, "data: "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("read stream: %v", err)
+	}
+	return lines
+}
+
+func TestParseMockConfigDefaults(t *testing.T) {
+	for _, raw := range []string{"", "not json", "{}"} {
+		cfg := ParseMockConfig(raw)
+		if cfg.Mode != "echo" {
+			t.Errorf("ParseMockConfig(%q).Mode = %q, want echo", raw, cfg.Mode)
+		}
+		if !reflect.DeepEqual(cfg.Models, []string{"mock-echo"}) {
+			t.Errorf("ParseMockConfig(%q).Models = %v, want [mock-echo]", raw, cfg.Models)
+		}
+	}
+
+	cfg := ParseMockConfig(`{"mode":"fixed","text":"hi","models":["a","b"],"chunk_delay_ms":5}`)
+	if cfg.Mode != "fixed" || cfg.Text != "hi" || cfg.ChunkDelayMs != 5 || len(cfg.Models) != 2 {
+		t.Errorf("ParseMockConfig kept wrong values: %+v", cfg)
+	}
+}
+
+func TestMockChatCompletionEcho(t *testing.T) {
+	cfg := mockProvider(ParseMockConfig(""))
+	result, err := cfg.ChatCompletionWithContext(context.Background(), map[string]interface{}{
+		"model":    "mock-echo",
+		"messages": userMessages("hello mock provider"),
+	}, 0)
+	if err != nil {
+		t.Fatalf("ChatCompletion: %v", err)
+	}
+
+	choice := result["choices"].([]interface{})[0].(map[string]interface{})
+	message := choice["message"].(map[string]interface{})
+	if message["content"] != "hello mock provider" {
+		t.Errorf("content = %v, want echo of the user message", message["content"])
+	}
+	if choice["finish_reason"] != "stop" {
+		t.Errorf("finish_reason = %v, want stop", choice["finish_reason"])
+	}
+
+	usage := result["usage"].(map[string]interface{})
+	prompt, completion, total := usage["prompt_tokens"].(float64), usage["completion_tokens"].(float64), usage["total_tokens"].(float64)
+	if prompt <= 0 || completion <= 0 || total != prompt+completion {
+		t.Errorf("usage = %v, want positive prompt/completion tokens that sum to total", usage)
+	}
+}
+
+func TestMockChatCompletionToolCall(t *testing.T) {
+	cfg := mockProvider(&MockConfig{Mode: "tool_call"})
+	result, err := cfg.ChatCompletionWithContext(context.Background(), map[string]interface{}{
+		"model":    "mock-echo",
+		"messages": userMessages("what's the weather?"),
+		"tools": []interface{}{map[string]interface{}{
+			"type":     "function",
+			"function": map[string]interface{}{"name": "get_weather"},
+		}},
+	}, 0)
+	if err != nil {
+		t.Fatalf("ChatCompletion: %v", err)
+	}
+
+	choice := result["choices"].([]interface{})[0].(map[string]interface{})
+	if choice["finish_reason"] != "tool_calls" {
+		t.Errorf("finish_reason = %v, want tool_calls", choice["finish_reason"])
+	}
+	calls := choice["message"].(map[string]interface{})["tool_calls"].([]interface{})
+	if len(calls) != 1 {
+		t.Fatalf("got %d tool calls, want 1", len(calls))
+	}
+	fn := calls[0].(map[string]interface{})["function"].(map[string]interface{})
+	if fn["name"] != "get_weather" || fn["arguments"] != "{}" {
+		t.Errorf("function = %v, want first declared tool with empty arguments", fn)
+	}
+}
+
+func TestMockChatCompletionStream(t *testing.T) {
+	cfg := mockProvider(&MockConfig{Mode: "fixed", Text: "one two three"})
+	payload := map[string]interface{}{
+		"model":          "mock-echo",
+		"messages":       userMessages("hi"),
+		"stream":         true,
+		"stream_options": map[string]interface{}{"include_usage": true},
+	}
+	lines := readSSE(t, cfg, payload)
+	if len(lines) == 0 || lines[len(lines)-1] != "[DONE]" {
+		t.Fatalf("stream must end with [DONE], got %v", lines)
+	}
+
+	var content strings.Builder
+	var finishReason string
+	var usage map[string]interface{}
+	ids := map[string]bool{}
+	for _, line := range lines[:len(lines)-1] {
+		var chunk map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", line, err)
+		}
+		ids[chunk["id"].(string)] = true
+		if u, ok := chunk["usage"].(map[string]interface{}); ok {
+			usage = u
+			if choices := chunk["choices"].([]interface{}); len(choices) != 0 {
+				t.Errorf("usage chunk must have empty choices, got %v", choices)
+			}
+			continue
+		}
+		choice := chunk["choices"].([]interface{})[0].(map[string]interface{})
+		if text, ok := choice["delta"].(map[string]interface{})["content"].(string); ok {
+			content.WriteString(text)
+		}
+		if reason, ok := choice["finish_reason"].(string); ok {
+			finishReason = reason
+		}
+	}
+
+	if content.String() != "one two three" {
+		t.Errorf("content = %q, want %q", content.String(), "one two three")
+	}
+	if finishReason != "stop" {
+		t.Errorf("finish_reason = %q, want stop", finishReason)
+	}
+	if usage == nil {
+		t.Error("include_usage requested but no usage chunk was sent")
+	}
+	if len(ids) != 1 {
+		t.Errorf("chunks must share one id, got %v", ids)
+	}
+
+	delete(payload, "stream_options")
+	for _, line := range readSSE(t, cfg, payload) {
+		if strings.Contains(line, `"usage"`) {
+			t.Errorf("usage chunk sent without include_usage: %s", line)
+		}
+	}
+}
+
+func TestMockErrorStatus(t *testing.T) {
+	payload := map[string]interface{}{"model": "mock-echo", "messages": userMessages("hi")}
+
+	cfg := mockProvider(&MockConfig{Mode: "echo", ErrorStatus: 503, ErrorMessage: "overloaded"})
+	_, err := cfg.ChatCompletionWithContext(context.Background(), payload, 1)
+	if err == nil || !strings.Contains(err.Error(), "max retries exceeded") || !strings.Contains(err.Error(), "overloaded") {
+		t.Errorf("5xx error = %v, want retries exhausted with the configured message", err)
+	}
+
+	cfg = mockProvider(&MockConfig{Mode: "echo", ErrorStatus: 429})
+	_, err = cfg.ChatCompletionStreamWithContext(context.Background(), payload, 3)
+	if err == nil || !strings.HasPrefix(err.Error(), "status 429") {
+		t.Errorf("4xx error = %v, want immediate status 429 without retries", err)
+	}
+}
+
+func TestMockStreamCancel(t *testing.T) {
+	cfg := mockProvider(&MockConfig{Mode: "fixed", Text: strings.Repeat("word ", 50), ChunkDelayMs: 20})
+	ctx, cancel := context.WithCancel(context.Background())
+	resp, err := cfg.ChatCompletionStreamWithContext(ctx, map[string]interface{}{
+		"model":    "mock-echo",
+		"messages": userMessages("hi"),
+		"stream":   true,
+	}, 0)
+	if err != nil {
+		t.Fatalf("stream request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	if !scanner.Scan() {
+		t.Fatalf("expected a first chunk, got error %v", scanner.Err())
+	}
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		for scanner.Scan() {
+			if scanner.Text() == "data: [DONE]" {
+				t.Error("stream completed after cancellation")
+			}
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream did not stop after the context was cancelled")
+	}
+}
+
+func TestMockListModels(t *testing.T) {
+	cfg := mockProvider(&MockConfig{Mode: "echo", Models: []string{"mock-a", "mock-b"}})
+	models, err := cfg.ListModels()
+	if err != nil {
+		t.Fatalf("ListModels: %v", err)
+	}
+	var ids []string
+	for _, m := range models {
+		ids = append(ids, m["id"].(string))
+	}
+	if !reflect.DeepEqual(ids, []string{"mock-a", "mock-b"}) {
+		t.Errorf("ListModels ids = %v, want [mock-a mock-b]", ids)
+	}
+}
+
+func TestSplitMockTokens(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"", nil},
+		{"hello", []string{"hello"}},
+		{"hello world  again", []string{"hello ", "world  ", "again"}},
+		{"ok 你好", []string{"ok ", "你", "好"}},
+	}
+	for _, tt := range tests {
+		got := splitMockTokens(tt.text)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitMockTokens(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+		if strings.Join(got, "") != tt.text {
+			t.Errorf("splitMockTokens(%q) pieces do not join back to the input", tt.text)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Package ratelimit 基于 GCRA（通用信元速率算法）的限流器
+//
+// 每个 key 只保存一个「理论到达时间」（TAT），检查与记录都是 O(1)，
+// 效果等价于容量为 limit、每 window/limit 补充一个令牌的令牌桶。
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Check 一次限流检查
+type Check struct {
+	Key    string        // 计数 key，不同 key 相互独立
+	Limit  int           // 窗口内允许的数量
+	Window time.Duration // 时间窗口
+	Cost   int           // 本次消耗的数量，小于 1 时按 1 计算
+}
+
+// Result 限流检查的结果
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int           // 本次之后剩余可用的数量
+	RetryAfter time.Duration // 被拒绝时需要等待的时间
+	ResetAfter time.Duration // 恢复到满额需要的时间
+}
+
+// Limiter GCRA 限流器，可安全地并发使用
+type Limiter struct {
+	mu        sync.Mutex
+	tats      map[string]time.Time
+	lastSweep time.Time
+}
+
+// NewLimiter 创建限流器
+func NewLimiter() *Limiter {
+	return &Limiter{tats: make(map[string]time.Time)}
+}
+
+// sweepInterval 清理已恢复满额的 key 的间隔
+const sweepInterval = time.Minute
+
+// Allow 原子地执行一组检查：全部通过时才记录，任一未通过则都不记录
+// 返回每个检查的结果，以及第一个未通过的检查的下标（全部通过时为 -1）
+func (l *Limiter) Allow(checks []Check) ([]Result, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	results := make([]Result, len(checks))
+	newTats := make([]time.Time, len(checks))
+	denied := -1
+	for i, c := range checks {
+		results[i], newTats[i] = l.evaluate(c, now)
+		if !results[i].Allowed && denied < 0 {
+			denied = i
+		}
+	}
+	if denied >= 0 {
+		return results, denied
+	}
+	for i, c := range checks {
+		if c.Limit > 0 && c.Window > 0 {
+			l.tats[c.Key] = newTats[i]
+		}
+	}
+	return results, -1
+}
+
+// evaluate 计算一次检查的结果及通过后的新 TAT，不修改状态
+func (l *Limiter) evaluate(c Check, now time.Time) (Result, time.Time) {
+	if c.Limit <= 0 || c.Window <= 0 {
+		return Result{Allowed: true, Limit: c.Limit, Remaining: c.Limit}, time.Time{}
+	}
+	cost := c.Cost
+	if cost < 1 {
+		cost = 1
+	}
+
+	interval := c.Window / time.Duration(c.Limit)
+	tat := l.tats[c.Key]
+	if tat.Before(now) {
+		tat = now
+	}
+	newTat := tat.Add(interval * time.Duration(cost))
+	allowAt := newTat.Add(-c.Window)
+
+	if now.Before(allowAt) {
+		return Result{
+			Allowed:    false,
+			Limit:      c.Limit,
+			Remaining:  remaining(tat.Sub(now), c.Window, interval),
+			RetryAfter: allowAt.Sub(now),
+			ResetAfter: tat.Sub(now),
+		}, tat
+	}
+	return Result{
+		Allowed:    true,
+		Limit:      c.Limit,
+		Remaining:  remaining(newTat.Sub(now), c.Window, interval),
+		ResetAfter: newTat.Sub(now),
+	}, newTat
+}
+
+// remaining 根据已占用的时间计算剩余数量
+func remaining(used, window, interval time.Duration) int {
+	if interval <= 0 {
+		return 0
+	}
+	return int(math.Max(0, math.Floor(float64(window-used)/float64(interval))))
+}
+
+// sweep 定期删除已恢复满额的 key，避免按用户/IP 计数时无限增长
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, tat := range l.tats {
+		if !tat.After(now) {
+			delete(l.tats, key)
+		}
+	}
+}
+
+// Adjust 按实际用量修正一次已通过的检查，delta 为实际数量与 Check.Cost 的差，为负数时归还
+func (l *Limiter) Adjust(c Check, delta int) {
+	if c.Limit <= 0 || c.Window <= 0 || delta == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	tat, ok := l.tats[c.Key]
+	if !ok || tat.Before(now) {
+		if delta < 0 {
+			return
+		}
+		tat = now
+	}
+	tat = tat.Add(c.Window / time.Duration(c.Limit) * time.Duration(delta))
+	if tat.After(now) {
+		l.tats[c.Key] = tat
+	} else {
+		delete(l.tats, c.Key)
+	}
+}
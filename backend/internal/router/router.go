@@ -1,44 +1,117 @@
 package router
 
 import (
+	"log"
 	"net/http"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"vte/internal/auth"
 	"vte/internal/config"
 	"vte/internal/handlers"
+	"vte/internal/models"
 )
 
-// CORS 中间件
-func CORSMiddleware() gin.HandlerFunc {
+// CORSMiddleware 按路径选择跨域策略：/api 使用管理接口策略，/v1 使用公开接口策略，其他路径不返回 CORS 头
+// 需要注册为全局中间件，否则没有对应路由的预检请求不会经过它
+func CORSMiddleware(admin, public config.CORSPolicy) gin.HandlerFunc {
+	adminCORS := corsHandler(admin)
+	publicCORS := corsHandler(public)
 	return func(c *gin.Context) {
-		origin := c.Request.Header.Get("Origin")
+		path := c.Request.URL.Path
+		switch {
+		case hasPathPrefix(path, "/api"):
+			adminCORS(c)
+		case hasPathPrefix(path, "/v1"):
+			publicCORS(c)
+		default:
+			c.Next()
+		}
+	}
+}
+
+func hasPathPrefix(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// corsHandler 来源不在允许列表中时不返回 CORS 头，由浏览器拦截跨域响应，同源请求不受影响；预检请求直接拒绝
+// 不返回 Access-Control-Allow-Credentials，接口都通过请求头认证，不需要浏览器携带 Cookie
+func corsHandler(policy config.CORSPolicy) gin.HandlerFunc {
+	anyOrigin := containsWildcard(policy.Origins)
+	anyMethod := containsWildcard(policy.Methods)
+	anyHeader := containsWildcard(policy.Headers)
+	methods := strings.Join(policy.Methods, ", ")
+	headers := strings.Join(policy.Headers, ", ")
+
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
 		if origin == "" {
-			origin = "*"
+			c.Next()
+			return
 		}
+		preflight := c.Request.Method == "OPTIONS" && c.GetHeader("Access-Control-Request-Method") != ""
 
-		c.Header("Access-Control-Allow-Origin", origin)
-		c.Header("Access-Control-Allow-Credentials", "true")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		c.Header("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE, PATCH")
-		c.Header("Access-Control-Max-Age", "86400")
+		c.Writer.Header().Add("Vary", "Origin")
+		if !policy.AllowsOrigin(origin) {
+			if preflight {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"detail": "不允许的跨域来源"})
+				return
+			}
+			c.Next()
+			return
+		}
 
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(http.StatusNoContent)
+		if anyOrigin {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Header("Access-Control-Allow-Origin", origin)
+		}
+		if !preflight {
+			c.Next()
 			return
 		}
 
-		c.Next()
+		// * 不包含 Authorization 请求头，因此不限时回显浏览器请求的方法和请求头
+		if anyMethod {
+			c.Header("Access-Control-Allow-Methods", c.GetHeader("Access-Control-Request-Method"))
+		} else {
+			c.Header("Access-Control-Allow-Methods", methods)
+		}
+		if anyHeader {
+			if requested := c.GetHeader("Access-Control-Request-Headers"); requested != "" {
+				c.Header("Access-Control-Allow-Headers", requested)
+			}
+			c.Writer.Header().Add("Vary", "Access-Control-Request-Headers")
+		} else {
+			c.Header("Access-Control-Allow-Headers", headers)
+		}
+		c.Header("Access-Control-Max-Age", "86400")
+		c.AbortWithStatus(http.StatusNoContent)
+	}
+}
+
+func containsWildcard(list []string) bool {
+	for _, item := range list {
+		if item == "*" {
+			return true
+		}
 	}
+	return false
 }
 
 func Setup(cfg *config.Config) *gin.Engine {
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
+	// 只信任配置的反向代理转发的客户端 IP，否则直接连接的客户端可以伪造 X-Forwarded-For
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+	auth.SetTrustedProxies(cfg.TrustedProxies)
+	handlers.SetWebSocketOrigins(cfg.PublicCORS)
 	r.Use(gin.Recovery())
-	r.Use(CORSMiddleware())
+	r.Use(CORSMiddleware(cfg.AdminCORS, cfg.PublicCORS))
 
 	// 设置 JWT 密钥
 	auth.SetSecretKey(cfg.SecretKey)
@@ -58,77 +131,170 @@ func Setup(cfg *config.Config) *gin.Engine {
 		authGroup := api.Group("/auth")
 		{
 			authGroup.POST("/login", handlers.Login)
+			authGroup.POST("/login/2fa", handlers.LoginTwoFactor)
+			authGroup.POST("/refresh", handlers.RefreshToken)
+			authGroup.POST("/logout", auth.JWTAuth(), handlers.AuditLog(), handlers.Logout)
+			authGroup.POST("/logout-all", auth.JWTAuth(), handlers.AuditLog(), handlers.LogoutAll)
+			authGroup.GET("/sessions", auth.JWTAuth(), handlers.ListMySessions)
+			authGroup.DELETE("/sessions/:sid", auth.JWTAuth(), handlers.AuditLog(), handlers.RevokeMySession)
+			authGroup.GET("/oidc", handlers.GetOIDCStatus)
+			authGroup.GET("/oidc/login", handlers.OIDCLogin)
+			authGroup.GET("/oidc/callback", handlers.OIDCCallback)
 			authGroup.GET("/me", auth.JWTAuth(), handlers.GetMe)
-			authGroup.POST("/change-password", auth.JWTAuth(), handlers.ChangePassword)
-			authGroup.POST("/change-username", auth.JWTAuth(), handlers.ChangeUsername)
-			authGroup.POST("/regenerate-api-key", auth.JWTAuth(), handlers.RegenerateAPIKey)
+			authGroup.POST("/change-password", auth.JWTAuth(), handlers.AuditLog(), handlers.ChangePassword)
+			authGroup.POST("/change-username", auth.JWTAuth(), handlers.AuditLog(), handlers.ChangeUsername)
+			authGroup.POST("/regenerate-api-key", auth.JWTAuth(), handlers.AuditLog(), handlers.RegenerateAPIKey)
+			authGroup.GET("/usage", auth.JWTAuth(), handlers.GetMyTokenStats)
+			authGroup.GET("/credits", auth.JWTAuth(), handlers.GetMyCredits)
+			authGroup.GET("/2fa", auth.JWTAuth(), handlers.GetTwoFactorStatus)
+			authGroup.POST("/2fa/setup", auth.JWTAuth(), handlers.AuditLog(), handlers.SetupTwoFactor)
+			authGroup.POST("/2fa/enable", auth.JWTAuth(), handlers.AuditLog(), handlers.EnableTwoFactor)
+			authGroup.POST("/2fa/disable", auth.JWTAuth(), handlers.AuditLog(), handlers.DisableTwoFactor)
+			authGroup.POST("/2fa/recovery-codes", auth.JWTAuth(), handlers.AuditLog(), handlers.RegenerateRecoveryCodes)
+		}
+
+		// 网关密钥（当前用户，管理员可操作任意用户的密钥）
+		keys := api.Group("/keys", auth.JWTAuth(), handlers.AuditLog())
+		{
+			keys.GET("", handlers.ListGatewayKeys)
+			keys.POST("", handlers.CreateGatewayKey)
+			keys.PUT("/:keyId", handlers.UpdateGatewayKey)
+			keys.POST("/:keyId/revoke", handlers.RevokeGatewayKey)
+			keys.DELETE("/:keyId", handlers.DeleteGatewayKey)
+		}
+
+		// 管理令牌（自动化脚本使用，只能在登录会话中创建）
+		adminTokens := api.Group("/admin-tokens", auth.JWTAuth(), handlers.AuditLog())
+		{
+			adminTokens.GET("", handlers.ListAdminTokens)
+			adminTokens.POST("", handlers.CreateAdminToken)
+			adminTokens.POST("/:id/revoke", handlers.RevokeAdminToken)
+			adminTokens.DELETE("/:id", handlers.DeleteAdminToken)
+		}
+
+		// 用户管理
+		users := api.Group("/users", auth.AdminAuth(), handlers.AuditLog())
+		{
+			users.GET("", auth.RequirePermission(auth.PermManageUsers), handlers.ListUsers)
+			users.POST("", auth.RequirePermission(auth.PermManageUsers), handlers.CreateUser)
+			users.PUT("/:id", auth.RequirePermission(auth.PermManageUsers), handlers.UpdateUser)
+			users.DELETE("/:id", auth.RequirePermission(auth.PermManageUsers), handlers.DeleteUser)
+			users.POST("/:id/reset-password", auth.RequirePermission(auth.PermManageUsers), handlers.ResetUserPassword)
+			users.POST("/:id/regenerate-api-key", auth.RequirePermission(auth.PermManageUsers), handlers.RegenerateUserAPIKey)
+			users.POST("/:id/2fa/reset", auth.RequirePermission(auth.PermManageUsers), handlers.ResetUserTwoFactor)
+			users.POST("/:id/unlock", auth.RequirePermission(auth.PermManageUsers), handlers.UnlockUser)
+			users.GET("/:id/sessions", auth.RequirePermission(auth.PermManageUsers), handlers.ListUserSessions)
+			users.DELETE("/:id/sessions", auth.RequirePermission(auth.PermManageUsers), handlers.RevokeUserSessions)
+			users.GET("/:id/credits", auth.RequirePermission(auth.PermManageUsers), handlers.ListUserCreditTransactions)
+			users.POST("/:id/credits", auth.RequirePermission(auth.PermManageUsers), handlers.AdjustUserCredit)
+			users.GET("/:id/keys", auth.RequirePermission(auth.PermManageUsers), handlers.ListUserGatewayKeys)
+			users.POST("/:id/keys", auth.RequirePermission(auth.PermManageUsers), handlers.CreateUserGatewayKey)
 		}
 
 		// 提供商管理
-		providers := api.Group("/providers", auth.JWTAuth(), auth.AdminRequired())
+		providers := api.Group("/providers", auth.AdminAuth(), handlers.AuditLog())
 		{
-			providers.GET("", handlers.ListProviders)
-			providers.POST("", handlers.CreateProvider)
-			providers.PUT("/:id", handlers.UpdateProvider)
-			providers.DELETE("/:id", handlers.DeleteProvider)
-			providers.POST("/:id/fetch-models", handlers.FetchModels)
-			providers.POST("/:id/add-model", handlers.AddModel)
-			providers.GET("/:id/models", handlers.ListProviderModels)
+			providers.GET("", auth.RequirePermission(auth.PermViewStats), handlers.ListProviders)
+			providers.POST("", auth.RequirePermission(auth.PermManageProviders), handlers.CreateProvider)
+			providers.PUT("/:id", auth.RequirePermission(auth.PermManageProviders), handlers.UpdateProvider)
+			providers.DELETE("/:id", auth.RequirePermission(auth.PermManageProviders), handlers.DeleteProvider)
+			providers.POST("/:id/fetch-models", auth.RequirePermission(auth.PermManageProviders), handlers.FetchModels)
+			providers.POST("/:id/add-model", auth.RequirePermission(auth.PermManageProviders), handlers.AddModel)
+			providers.GET("/:id/models", auth.RequirePermission(auth.PermViewStats), handlers.ListProviderModels)
 			// API Keys 轮询管理
-			providers.GET("/:id/api-keys", handlers.ListAPIKeys)
-			providers.POST("/:id/api-keys", handlers.AddAPIKey)
-			providers.PUT("/:id/api-keys/:keyId", handlers.UpdateAPIKey)
-			providers.DELETE("/:id/api-keys/:keyId", handlers.DeleteAPIKey)
+			providers.GET("/:id/api-keys", auth.RequirePermission(auth.PermManageModels), handlers.ListAPIKeys)
+			providers.POST("/:id/api-keys", auth.RequirePermission(auth.PermManageProviders), handlers.AddAPIKey)
+			providers.PUT("/:id/api-keys/:keyId", auth.RequirePermission(auth.PermManageModels), handlers.UpdateAPIKey)
+			providers.DELETE("/:id/api-keys/:keyId", auth.RequirePermission(auth.PermManageProviders), handlers.DeleteAPIKey)
 			// 测试连接
-			providers.POST("/:id/test", handlers.TestConnection)
-			providers.GET("/:id/test-options", handlers.GetTestOptions)
+			providers.POST("/:id/test", auth.RequirePermission(auth.PermRunTests), handlers.TestConnection)
+			providers.GET("/:id/test-options", auth.RequirePermission(auth.PermRunTests), handlers.GetTestOptions)
 		}
 
 		// 模型管理
-		models := api.Group("/models", auth.JWTAuth(), auth.AdminRequired())
+		models := api.Group("/models", auth.AdminAuth(), handlers.AuditLog())
 		{
-			models.GET("", handlers.ListAllModels)
-			models.PUT("/:id", handlers.UpdateModel)
-			models.DELETE("/:id", handlers.DeleteModel)
-			models.POST("/:id/reset-name", handlers.ResetModelDisplayName)
-			models.POST("/batch-toggle", handlers.BatchToggleModels)
+			models.GET("", auth.RequirePermission(auth.PermViewStats), handlers.ListAllModels)
+			models.PUT("/:id", auth.RequirePermission(auth.PermManageModels), handlers.UpdateModel)
+			models.DELETE("/:id", auth.RequirePermission(auth.PermManageProviders), handlers.DeleteModel)
+			models.POST("/:id/reset-name", auth.RequirePermission(auth.PermManageModels), handlers.ResetModelDisplayName)
+			models.POST("/batch-toggle", auth.RequirePermission(auth.PermManageModels), handlers.BatchToggleModels)
+		}
+
+		// 模型价格
+		pricing := api.Group("/pricing", auth.AdminAuth(), handlers.AuditLog())
+		{
+			pricing.GET("", auth.RequirePermission(auth.PermViewStats), handlers.ListModelPrices)
+			pricing.POST("", auth.RequirePermission(auth.PermManageSettings), handlers.CreateModelPrice)
+			pricing.PUT("/:id", auth.RequirePermission(auth.PermManageSettings), handlers.UpdateModelPrice)
+			pricing.DELETE("/:id", auth.RequirePermission(auth.PermManageSettings), handlers.DeleteModelPrice)
 		}
 
 		// 日志
-		logs := api.Group("/logs", auth.JWTAuth(), auth.AdminRequired())
+		logs := api.Group("/logs", auth.AdminAuth(), handlers.AuditLog())
 		{
-			logs.GET("", handlers.GetLogs)
-			logs.DELETE("", handlers.ClearLogs)
-			logs.GET("/stats", handlers.GetStats)
-			logs.DELETE("/stats", handlers.ResetStats)
+			logs.GET("", auth.RequirePermission(auth.PermViewStats), handlers.GetLogs)
+			logs.DELETE("", auth.RequirePermission(auth.PermManageSettings), handlers.ClearLogs)
+			logs.GET("/stats", auth.RequirePermission(auth.PermViewStats), handlers.GetStats)
+			logs.DELETE("/stats", auth.RequirePermission(auth.PermManageSettings), handlers.ResetStats)
 		}
 
 		// Token统计
-		tokens := api.Group("/tokens", auth.JWTAuth(), auth.AdminRequired())
+		tokens := api.Group("/tokens", auth.AdminAuth(), handlers.AuditLog())
 		{
-			tokens.GET("/stats", handlers.GetTodayTokenStats)
-			tokens.DELETE("/stats", handlers.ResetTodayTokenStats)
+			tokens.GET("/stats", auth.RequirePermission(auth.PermViewStats), handlers.GetTodayTokenStats)
+			tokens.DELETE("/stats", auth.RequirePermission(auth.PermManageSettings), handlers.ResetTodayTokenStats)
+			tokens.GET("/spend", auth.RequirePermission(auth.PermViewStats), handlers.GetSpendStats)
 		}
 
 		// 设置
-		settings := api.Group("/settings", auth.JWTAuth(), auth.AdminRequired())
+		settings := api.Group("/settings", auth.AdminAuth(), handlers.AuditLog())
+		{
+			settings.GET("/stream-mode", auth.RequirePermission(auth.PermManageSettings), handlers.GetStreamMode)
+			settings.PUT("/stream-mode", auth.RequirePermission(auth.PermManageSettings), handlers.SetStreamMode)
+			settings.GET("/retry", auth.RequirePermission(auth.PermManageSettings), handlers.GetRetrySettings)
+			settings.PUT("/retry", auth.RequirePermission(auth.PermManageSettings), handlers.SetRetrySettings)
+			settings.GET("/theme", auth.RequirePermission(auth.PermManageSettings), handlers.GetThemeSettings)
+			settings.PUT("/theme", auth.RequirePermission(auth.PermManageSettings), handlers.SetThemeSettings)
+			settings.GET("/system-prompt", auth.RequirePermission(auth.PermManageSettings), handlers.GetSystemPrompt)
+			settings.PUT("/system-prompt", auth.RequirePermission(auth.PermManageSettings), handlers.SetSystemPrompt)
+			settings.GET("/custom-error", auth.RequirePermission(auth.PermManageSettings), handlers.GetCustomErrorResponse)
+			settings.PUT("/custom-error", auth.RequirePermission(auth.PermManageSettings), handlers.SetCustomErrorResponse)
+			settings.GET("/rate-limit", auth.RequirePermission(auth.PermManageSettings), handlers.GetRateLimitSettings)
+			settings.PUT("/rate-limit", auth.RequirePermission(auth.PermManageSettings), handlers.SetRateLimitSettings)
+			settings.GET("/concurrency", auth.RequirePermission(auth.PermManageSettings), handlers.GetConcurrencySettings)
+			settings.PUT("/concurrency", auth.RequirePermission(auth.PermManageSettings), handlers.SetConcurrencySettings)
+			settings.GET("/custom-rate-limit", auth.RequirePermission(auth.PermManageSettings), handlers.GetCustomRateLimitRules)
+			settings.PUT("/custom-rate-limit", auth.RequirePermission(auth.PermManageSettings), handlers.SetCustomRateLimitRules)
+			settings.GET("/quota-price", auth.RequirePermission(auth.PermManageSettings), handlers.GetQuotaPriceSettings)
+			settings.PUT("/quota-price", auth.RequirePermission(auth.PermManageSettings), handlers.SetQuotaPriceSettings)
+			settings.GET("/credit", auth.RequirePermission(auth.PermManageSettings), handlers.GetCreditSettings)
+			settings.PUT("/credit", auth.RequirePermission(auth.PermManageSettings), handlers.SetCreditSettings)
+			settings.GET("/token-retention", auth.RequirePermission(auth.PermManageSettings), handlers.GetTokenRetentionSettings)
+			settings.PUT("/token-retention", auth.RequirePermission(auth.PermManageSettings), handlers.SetTokenRetentionSettings)
+			settings.GET("/oidc", auth.RequirePermission(auth.PermManageSettings), handlers.GetOIDCSettings)
+			settings.PUT("/oidc", auth.RequirePermission(auth.PermManageSettings), handlers.SetOIDCSettings)
+			settings.GET("/2fa", auth.RequirePermission(auth.PermManageSettings), handlers.GetTwoFactorSettings)
+			settings.PUT("/2fa", auth.RequirePermission(auth.PermManageSettings), handlers.SetTwoFactorSettings)
+			settings.GET("/login-protection", auth.RequirePermission(auth.PermManageSettings), handlers.GetLoginProtectionSettings)
+			settings.PUT("/login-protection", auth.RequirePermission(auth.PermManageSettings), handlers.SetLoginProtectionSettings)
+			settings.GET("/ip-access", auth.RequirePermission(auth.PermManageSettings), handlers.GetIPAccessSettings)
+			settings.PUT("/ip-access", auth.RequirePermission(auth.PermManageSettings), handlers.SetIPAccessSettings)
+		}
+
+		// 登录安全
+		security := api.Group("/security", auth.AdminAuth(), handlers.AuditLog())
+		{
+			security.GET("/lockouts", auth.RequirePermission(auth.PermManageUsers), handlers.ListLoginLockouts)
+			security.POST("/unlock", auth.RequirePermission(auth.PermManageUsers), handlers.UnlockLogin)
+			security.GET("/login-failures", auth.RequirePermission(auth.PermManageUsers), handlers.ListLoginFailures)
+		}
+
+		// 审计日志
+		audit := api.Group("/audit", auth.AdminAuth())
 		{
-			settings.GET("/stream-mode", handlers.GetStreamMode)
-			settings.PUT("/stream-mode", handlers.SetStreamMode)
-			settings.GET("/retry", handlers.GetRetrySettings)
-			settings.PUT("/retry", handlers.SetRetrySettings)
-			settings.GET("/theme", handlers.GetThemeSettings)
-			settings.PUT("/theme", handlers.SetThemeSettings)
-			settings.GET("/system-prompt", handlers.GetSystemPrompt)
-			settings.PUT("/system-prompt", handlers.SetSystemPrompt)
-			settings.GET("/custom-error", handlers.GetCustomErrorResponse)
-			settings.PUT("/custom-error", handlers.SetCustomErrorResponse)
-			settings.GET("/rate-limit", handlers.GetRateLimitSettings)
-			settings.PUT("/rate-limit", handlers.SetRateLimitSettings)
-			settings.GET("/concurrency", handlers.GetConcurrencySettings)
-			settings.PUT("/concurrency", handlers.SetConcurrencySettings)
-			settings.GET("/custom-rate-limit", handlers.GetCustomRateLimitRules)
-			settings.PUT("/custom-rate-limit", handlers.SetCustomRateLimitRules)
+			audit.GET("", auth.RequirePermission(auth.PermViewAudit), handlers.ListAuditLog)
+			audit.GET("/export", auth.RequirePermission(auth.PermViewAudit), handlers.ExportAuditLog)
 		}
 
 		// 版本
@@ -139,7 +305,7 @@ func Setup(cfg *config.Config) *gin.Engine {
 	v1 := r.Group("/v1", auth.APIKeyAuth())
 	{
 		v1.GET("/models", handlers.OpenAIListModels)
-		v1.POST("/chat/completions", handlers.OpenAIChatCompletions)
+		v1.POST("/chat/completions", auth.RequireScope(models.ScopeChat), handlers.OpenAIChatCompletions)
 	}
 
 	// WebSocket 接口 (需要单独处理认证)
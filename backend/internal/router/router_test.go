@@ -0,0 +1,60 @@
+package router
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"vte/internal/auth"
+	"vte/internal/config"
+	"vte/internal/database"
+	"vte/internal/models"
+	"vte/internal/secret"
+)
+
+func TestAdminReadKeyOnlyReachesAdminRoutes(t *testing.T) {
+	masterKey, _ := secret.GenerateMasterKey()
+	if err := secret.Init(masterKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Init(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(database.Close)
+
+	result, err := database.DB().Exec("INSERT INTO users (username, hashed_password, api_key, is_admin) VALUES ('key-admin', '', 'legacy', 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, _ := result.LastInsertId()
+	apiKey := auth.GenerateAPIKey()
+	if _, err := auth.InsertGatewayKey(int(userID), apiKey, &models.GatewayAPIKeyCreate{
+		Name: "admin-read", Scopes: []string{models.ScopeAdminRead},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := Setup(&config.Config{SecretKey: "test-secret-key"})
+	tests := []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", "/api/providers", 200},
+		{"POST", "/api/providers", 401},
+		{"GET", "/api/admin-tokens", 401},
+		{"GET", "/api/keys", 401},
+		{"GET", "/api/auth/sessions", 401},
+		{"GET", "/api/auth/credits", 401},
+		{"GET", "/api/auth/me", 401},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader("{}"))
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		r.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%s %s with an admin-read key = %d, want %d", tt.method, tt.path, w.Code, tt.status)
+		}
+	}
+}
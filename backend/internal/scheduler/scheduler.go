@@ -3,6 +3,7 @@ package scheduler
 import (
 	"log"
 	"time"
+	"vte/internal/auth"
 	"vte/internal/handlers"
 	"vte/internal/logger"
 )
@@ -55,6 +56,12 @@ func dailyCleanupTask() {
 		} else {
 			logger.Info("token记录清理完成")
 		}
+		if err := handlers.CleanOldLoginFailures(); err != nil {
+			logger.Error("清理登录失败记录失败: " + err.Error())
+		}
+		if err := auth.DeleteExpiredSessions(); err != nil {
+			logger.Error("清理过期会话失败: " + err.Error())
+		}
 		
 		// 同时重置日志统计
 		logger.ResetStats()
@@ -0,0 +1,250 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// encryptedPrefix 加密值的前缀，格式为 enc:v1:<主密钥ID>:<加密的数据密钥>:<加密的内容>
+const encryptedPrefix = "enc:v1:"
+
+// Keyring 用主密钥做信封加密：每个值使用随机的数据密钥加密，数据密钥再由主密钥加密后一起保存
+type Keyring struct {
+	id  string
+	key []byte
+}
+
+var (
+	current   *Keyring
+	currentMu sync.RWMutex
+)
+
+// NewKeyring 从任意字符串派生 256 位主密钥
+func NewKeyring(masterKey string) (*Keyring, error) {
+	masterKey = strings.TrimSpace(masterKey)
+	if masterKey == "" {
+		return nil, errors.New("master key is empty")
+	}
+	sum := sha256.Sum256([]byte(masterKey))
+	id := sha256.Sum256(sum[:])
+	return &Keyring{id: hex.EncodeToString(id[:4]), key: sum[:]}, nil
+}
+
+// ID 主密钥的标识，用于识别加密值由哪个主密钥加密
+func (k *Keyring) ID() string {
+	return k.id
+}
+
+// Encrypt 加密明文，空字符串原样返回
+func (k *Keyring) Encrypt(plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	wrappedKey, err := seal(k.key, dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(dataKey, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedPrefix + k.id + ":" +
+		base64.RawStdEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.RawStdEncoding.EncodeToString(ciphertext), nil
+}
+
+// Decrypt 解密由 Encrypt 生成的值，未加密的值原样返回
+func (k *Keyring) Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if len(parts) != 3 {
+		return "", errors.New("malformed encrypted value")
+	}
+	if parts[0] != k.id {
+		return "", fmt.Errorf("value was encrypted with master key %s, current key is %s", parts[0], k.id)
+	}
+
+	wrappedKey, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+
+	dataKey, err := open(k.key, wrappedKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(dataKey, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+func seal(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// IsEncrypted 判断值是否已加密
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
+
+// KeyIDOf 返回加密值所用主密钥的标识，未加密时返回空字符串
+func KeyIDOf(value string) string {
+	if !IsEncrypted(value) {
+		return ""
+	}
+	id, _, _ := strings.Cut(strings.TrimPrefix(value, encryptedPrefix), ":")
+	return id
+}
+
+// LoadMasterKey 读取主密钥：优先使用 masterKey，其次读取 keyFile；
+// keyFile 不存在时生成随机主密钥并写入该文件
+func LoadMasterKey(masterKey, keyFile string) (string, bool, error) {
+	if masterKey != "" {
+		return masterKey, false, nil
+	}
+	if keyFile == "" {
+		return "", false, errors.New("MASTER_KEY or MASTER_KEY_FILE is required")
+	}
+
+	data, err := os.ReadFile(keyFile)
+	if err == nil {
+		return strings.TrimSpace(string(data)), false, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", false, err
+	}
+
+	generated, err := GenerateMasterKey()
+	if err != nil {
+		return "", false, err
+	}
+	if err := WriteKeyFile(keyFile, generated); err != nil {
+		return "", false, err
+	}
+	return generated, true, nil
+}
+
+// GenerateMasterKey 生成随机主密钥
+func GenerateMasterKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// WriteKeyFile 写入主密钥文件，仅所有者可读写
+func WriteKeyFile(path, masterKey string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(masterKey+"\n"), 0600)
+}
+
+// Init 设置全局使用的主密钥
+func Init(masterKey string) error {
+	k, err := NewKeyring(masterKey)
+	if err != nil {
+		return err
+	}
+	currentMu.Lock()
+	current = k
+	currentMu.Unlock()
+	return nil
+}
+
+func keyring() (*Keyring, error) {
+	currentMu.RLock()
+	defer currentMu.RUnlock()
+	if current == nil {
+		return nil, errors.New("master key is not initialized")
+	}
+	return current, nil
+}
+
+// KeyID 全局主密钥的标识
+func KeyID() string {
+	k, err := keyring()
+	if err != nil {
+		return ""
+	}
+	return k.ID()
+}
+
+// Encrypt 使用全局主密钥加密
+func Encrypt(plaintext string) (string, error) {
+	k, err := keyring()
+	if err != nil {
+		return "", err
+	}
+	return k.Encrypt(plaintext)
+}
+
+// Decrypt 使用全局主密钥解密
+func Decrypt(value string) (string, error) {
+	k, err := keyring()
+	if err != nil {
+		return "", err
+	}
+	return k.Decrypt(value)
+}
+
+// Hint 生成用于界面展示的密钥提示（只保留末 4 位）
+func Hint(plaintext string) string {
+	if len(plaintext) <= 8 {
+		return ""
+	}
+	return plaintext[len(plaintext)-4:]
+}
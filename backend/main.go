@@ -10,6 +10,7 @@ import (
 	"vte/internal/database"
 	"vte/internal/router"
 	"vte/internal/scheduler"
+	"vte/internal/secret"
 )
 
 func main() {
@@ -24,12 +25,32 @@ func main() {
 	// 初始化配置
 	cfg := config.Load()
 
+	// 加载主密钥，数据库迁移时需要用它加密提供商密钥
+	masterKey, generated, err := secret.LoadMasterKey(cfg.MasterKey, cfg.MasterKeyFile)
+	if err != nil {
+		log.Fatalf("Failed to load master key: %v", err)
+	}
+	if generated {
+		log.Printf("Generated master key at %s, keep this file safe and back it up separately from the database", cfg.MasterKeyFile)
+	}
+	if cfg.MasterKeyInDataDir() {
+		log.Printf("Warning: master key %s is in the database directory, backups of that directory contain both the encrypted secrets and their key. Move it elsewhere and set MASTER_KEY_FILE", cfg.MasterKeyFile)
+	}
+	if err := secret.Init(masterKey); err != nil {
+		log.Fatalf("Failed to init master key: %v", err)
+	}
+
 	// 初始化数据库
 	if err := database.Init(cfg.DatabasePath); err != nil {
 		log.Fatalf("Failed to init database: %v", err)
 	}
 	defer database.Close()
 
+	if len(os.Args) > 1 && os.Args[1] == "rotate-master-key" {
+		rotateMasterKey(cfg, masterKey)
+		return
+	}
+
 	// 确保管理员账户存在
 	if err := database.EnsureAdmin(cfg.AdminUsername, cfg.AdminPassword); err != nil {
 		log.Fatalf("Failed to ensure admin: %v", err)
@@ -68,3 +89,60 @@ func main() {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
+
+// rotateMasterKey 用新主密钥重新加密所有提供商密钥、TOTP 密钥和单点登录的 client_secret
+// 新主密钥取自 NEW_MASTER_KEY 或 NEW_MASTER_KEY_FILE；都未设置且当前主密钥来自文件时，生成新主密钥并替换该文件
+func rotateMasterKey(cfg *config.Config, masterKey string) {
+	oldKey, err := secret.NewKeyring(masterKey)
+	if err != nil {
+		log.Fatalf("Invalid master key: %v", err)
+	}
+
+	newMasterKey := os.Getenv("NEW_MASTER_KEY")
+	if newMasterKey == "" {
+		if file := os.Getenv("NEW_MASTER_KEY_FILE"); file != "" {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				log.Fatalf("Failed to read new master key: %v", err)
+			}
+			newMasterKey = string(data)
+		}
+	}
+
+	// 先把新主密钥写入临时文件，重新加密成功后再替换，避免中途失败丢失密钥
+	pendingFile := ""
+	if newMasterKey == "" {
+		if cfg.MasterKey != "" {
+			log.Fatalf("MASTER_KEY is set, provide the new key with NEW_MASTER_KEY or NEW_MASTER_KEY_FILE")
+		}
+		if newMasterKey, err = secret.GenerateMasterKey(); err != nil {
+			log.Fatalf("Failed to generate master key: %v", err)
+		}
+		pendingFile = cfg.MasterKeyFile + ".new"
+		if err := secret.WriteKeyFile(pendingFile, newMasterKey); err != nil {
+			log.Fatalf("Failed to write new master key: %v", err)
+		}
+	}
+
+	newKey, err := secret.NewKeyring(newMasterKey)
+	if err != nil {
+		log.Fatalf("Invalid new master key: %v", err)
+	}
+	if newKey.ID() == oldKey.ID() {
+		log.Fatalf("The new master key is the same as the current one")
+	}
+
+	count, err := database.RotateMasterKey(oldKey, newKey)
+	if err != nil {
+		log.Fatalf("Failed to rotate master key: %v", err)
+	}
+
+	if pendingFile != "" {
+		if err := os.Rename(pendingFile, cfg.MasterKeyFile); err != nil {
+			log.Fatalf("Re-encrypted %d secrets, but failed to replace %s, move %s into place manually: %v", count, cfg.MasterKeyFile, pendingFile, err)
+		}
+		log.Printf("Re-encrypted %d secrets, new master key %s written to %s", count, newKey.ID(), cfg.MasterKeyFile)
+		return
+	}
+	log.Printf("Re-encrypted %d secrets with master key %s, update MASTER_KEY / MASTER_KEY_FILE before restarting", count, newKey.ID())
+}
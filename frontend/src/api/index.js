@@ -15,14 +15,55 @@ api.interceptors.request.use(config => {
   return config
 })
 
+let refreshing = null
+
+// refreshAccessToken 用刷新令牌换取新的访问令牌，并发的请求共用同一次刷新
+function refreshAccessToken() {
+  if (!refreshing) {
+    const refreshToken = localStorage.getItem('refresh_token')
+    refreshing = axios.post('/api/auth/refresh', { refresh_token: refreshToken })
+      .then(res => {
+        localStorage.setItem('token', res.data.access_token)
+        localStorage.setItem('refresh_token', res.data.refresh_token)
+        return res.data.access_token
+      })
+      .catch(err => {
+        // 其他标签页已经刷新过时直接使用新令牌
+        if (localStorage.getItem('refresh_token') !== refreshToken) {
+          return localStorage.getItem('token')
+        }
+        throw err
+      })
+      .finally(() => {
+        refreshing = null
+      })
+  }
+  return refreshing
+}
+
 // 响应拦截器
 api.interceptors.response.use(
   response => response,
-  error => {
+  async error => {
+    const config = error.config
+    // 访问令牌过期时刷新后重试一次，登录相关接口除外
+    if (error.response?.status === 401 && config && !config._retried &&
+        localStorage.getItem('refresh_token') && !config.url.startsWith('/api/auth/login')) {
+      config._retried = true
+      try {
+        const token = await refreshAccessToken()
+        config.headers.Authorization = `Bearer ${token}`
+        return api(config)
+      } catch {
+        // 刷新失败，按未登录处理
+      }
+    }
+
     const msg = error.response?.data?.detail || error.message || '请求失败'
     ElMessage.error(msg)
     if (error.response?.status === 401) {
       localStorage.removeItem('token')
+      localStorage.removeItem('refresh_token')
       window.location.href = '/login'
     }
     return Promise.reject(error)
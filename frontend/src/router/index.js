@@ -14,11 +14,14 @@ const routes = [
     children: [
       { path: '', redirect: '/dashboard' },
       { path: 'dashboard', name: 'Dashboard', component: () => import('../views/Dashboard.vue') },
-      { path: 'providers', name: 'Providers', component: () => import('../views/Providers.vue') },
-      { path: 'models', name: 'Models', component: () => import('../views/Models.vue') },
-      { path: 'logs', name: 'Logs', component: () => import('../views/Logs.vue') },
-      { path: 'token-stats', name: 'TokenStats', component: () => import('../views/TokenStats.vue') },
-      { path: 'settings', name: 'Settings', component: () => import('../views/Settings.vue') },
+      { path: 'providers', name: 'Providers', component: () => import('../views/Providers.vue'), meta: { permission: 'view_stats' } },
+      { path: 'models', name: 'Models', component: () => import('../views/Models.vue'), meta: { permission: 'view_stats' } },
+      { path: 'pricing', name: 'Pricing', component: () => import('../views/Pricing.vue'), meta: { permission: 'view_stats' } },
+      { path: 'logs', name: 'Logs', component: () => import('../views/Logs.vue'), meta: { permission: 'view_stats' } },
+      { path: 'token-stats', name: 'TokenStats', component: () => import('../views/TokenStats.vue'), meta: { permission: 'view_stats' } },
+      { path: 'audit', name: 'Audit', component: () => import('../views/Audit.vue'), meta: { permission: 'view_audit' } },
+      { path: 'users', name: 'Users', component: () => import('../views/Users.vue'), meta: { permission: 'manage_users' } },
+      { path: 'settings', name: 'Settings', component: () => import('../views/Settings.vue'), meta: { permission: 'manage_settings' } },
       { path: 'about', name: 'About', component: () => import('../views/About.vue') }
     ]
   }
@@ -29,12 +32,16 @@ const router = createRouter({
   routes
 })
 
-router.beforeEach((to, from, next) => {
+router.beforeEach(async (to, from, next) => {
   const userStore = useUserStore()
   if (to.meta.requiresAuth && !userStore.isLoggedIn) {
     next('/login')
   } else if (to.path === '/login' && userStore.isLoggedIn) {
     next('/')
+  } else if (to.meta.permission) {
+    // 管理页面按角色权限开放
+    if (!userStore.user) await userStore.fetchUser()
+    next(userStore.can(to.meta.permission) ? undefined : '/dashboard')
   } else {
     next()
   }
@@ -7,11 +7,35 @@ export const useUserStore = defineStore('user', () => {
   const user = ref(null)
 
   const isLoggedIn = computed(() => !!token.value)
+  const isAdmin = computed(() => !!user.value?.is_admin)
 
+  // can 当前用户是否拥有指定的管理权限
+  function can(permission) {
+    return !!user.value?.permissions?.includes(permission)
+  }
+  // isStaff 是否拥有任何管理权限（只读、运维或管理员）
+  const isStaff = computed(() => !!user.value?.permissions?.length)
+
+  // 启用两步验证时返回临时令牌，需再调用 loginTwoFactor
   async function login(username, password) {
     const res = await api.post('/api/auth/login', { username, password })
-    token.value = res.data.access_token
+    if (res.data.two_factor_required) {
+      return res.data.challenge_token
+    }
+    await setToken(res.data.access_token, res.data.refresh_token)
+    return ''
+  }
+
+  async function loginTwoFactor(challengeToken, code) {
+    const res = await api.post('/api/auth/login/2fa', { challenge_token: challengeToken, code })
+    await setToken(res.data.access_token, res.data.refresh_token)
+  }
+
+  // 保存访问令牌和刷新令牌，单点登录回调后也使用
+  async function setToken(accessToken, refreshToken) {
+    token.value = accessToken
     localStorage.setItem('token', token.value)
+    localStorage.setItem('refresh_token', refreshToken || '')
     await fetchUser()
   }
 
@@ -29,6 +53,15 @@ export const useUserStore = defineStore('user', () => {
     token.value = ''
     user.value = null
     localStorage.removeItem('token')
+    localStorage.removeItem('refresh_token')
+  }
+
+  // signOut 吊销服务端会话后清除本地令牌
+  async function signOut() {
+    try {
+      await api.post('/api/auth/logout')
+    } catch {}
+    logout()
   }
 
   // 初始化时获取用户信息
@@ -36,5 +69,5 @@ export const useUserStore = defineStore('user', () => {
     fetchUser()
   }
 
-  return { token, user, isLoggedIn, login, fetchUser, logout }
+  return { token, user, isLoggedIn, isAdmin, isStaff, can, login, loginTwoFactor, setToken, fetchUser, logout, signOut }
 })
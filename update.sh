@@ -24,6 +24,7 @@ docker run -d \
   --name vte \
   -p 8050:8050 \
   -v vte-data:/app/data \
+  -v vte-keys:/app/keys \
   --restart unless-stopped \
   rtyedfty/vte:latest
 